@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Child actions of audit records.
+const (
+	auditChildStart   = "start"
+	auditChildRestart = "restart"
+	auditChildFailed  = "failed"
+	auditChildBlocked = "blocked"
+	auditChildReplace = "replace"
+)
+
+// auditRecord is a line of the audit log, written for every change of the
+// environment of the child process. Values are never written, only their HMAC.
+type auditRecord struct {
+	Time string `json:"time"`
+
+	// Added, Changed and Removed are the sorted names of the keys.
+	Added   []string `json:"added,omitempty"`
+	Changed []string `json:"changed,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+
+	// Hashes are the HMACs of the new values of the added and changed keys,
+	// keyed with the HMAC key or, without one, with the salt of the file.
+	Hashes map[string]string `json:"hashes,omitempty"`
+
+	// Sources are the dependencies the added and changed keys come from.
+	Sources map[string]string `json:"sources,omitempty"`
+
+	// ChildAction is what happened to the child process because of the
+	// change, with the pid of the new child or the error.
+	ChildAction string `json:"child_action"`
+	Pid         int    `json:"pid,omitempty"`
+	Error       string `json:"error,omitempty"`
+
+	// Prev is the HMAC of the previous record and HMAC the one of this record,
+	// chaining the records when an HMAC key is configured.
+	Prev string `json:"prev,omitempty"`
+	HMAC string `json:"hmac,omitempty"`
+
+	// Salt is only set in the header record, see auditHeader.
+	Salt string `json:"salt,omitempty"`
+}
+
+// auditHeader is the first line of an audit log without an HMAC key. It holds
+// the random salt the values are hashed with, so that the hashes of a short
+// secret cannot be looked up in a precomputed table, and are not comparable
+// across files.
+type auditHeader struct {
+	Time string `json:"time"`
+	Salt string `json:"salt"`
+}
+
+// auditLog appends audit records as JSON lines to a file.
+type auditLog struct {
+	sync.Mutex
+
+	file *os.File
+	key  []byte
+
+	// salt is the key of the value hashes without an HMAC key.
+	salt []byte
+
+	// prev is the HMAC of the last record in the file.
+	prev string
+}
+
+// openAuditLog opens the audit log at the given path for appending. With an
+// HMAC key, the chain continues from the last record already in the file.
+// Without one, the values are hashed with the salt of the file, which is
+// written in a header record when the file does not have one yet.
+func openAuditLog(path string, key []byte) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &auditLog{file: f, key: key}
+	prev, salt, err := readAuditLog(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading audit log %s: %s", path, err)
+	}
+	if len(key) > 0 {
+		a.prev = prev
+		return a, nil
+	}
+
+	if salt != "" {
+		if a.salt, err = hex.DecodeString(salt); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("reading audit log %s: invalid salt: %s", path, err)
+		}
+		return a, nil
+	}
+	if err := a.writeHeader(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("writing audit log %s: %s", path, err)
+	}
+	return a, nil
+}
+
+// readAuditLog returns the HMAC of the last record and the salt of the last
+// header record read from r.
+func readAuditLog(r io.Reader) (string, string, error) {
+	var last, salt string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return "", "", err
+		}
+		last = rec.HMAC
+		if rec.Salt != "" {
+			salt = rec.Salt
+		}
+	}
+	return last, salt, scanner.Err()
+}
+
+// writeHeader writes a header record with a new random salt.
+func (a *auditLog) writeHeader() error {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(&auditHeader{
+		Time: time.Now().UTC().Format(time.RFC3339Nano),
+		Salt: hex.EncodeToString(salt),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := a.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	a.salt = salt
+	return nil
+}
+
+// Record writes a record for the change of the environment to env. Sources
+// maps keys to the dependency they come from.
+func (a *auditLog) Record(diff *EnvDiff, env, sources map[string]string, action string, pid int, err error) error {
+	rec := &auditRecord{
+		Time:        diff.Time.Format(time.RFC3339Nano),
+		Added:       diff.Added,
+		Changed:     diff.Changed,
+		Removed:     diff.Removed,
+		ChildAction: action,
+		Pid:         pid,
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+
+	for _, keys := range [][]string{rec.Added, rec.Changed} {
+		for _, k := range keys {
+			if rec.Hashes == nil {
+				rec.Hashes = make(map[string]string)
+			}
+			rec.Hashes[k] = a.hashValue(env[k])
+			if s, ok := sources[k]; ok {
+				if rec.Sources == nil {
+					rec.Sources = make(map[string]string)
+				}
+				rec.Sources[k] = s
+			}
+		}
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if len(a.key) > 0 {
+		rec.Prev = a.prev
+		sum, err := auditHMAC(a.key, rec)
+		if err != nil {
+			return err
+		}
+		rec.HMAC = sum
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := a.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	a.prev = rec.HMAC
+	return nil
+}
+
+func (a *auditLog) Close() error {
+	return a.file.Close()
+}
+
+// hashValue returns the HMAC of a value with the HMAC key, or the salt of the
+// file without one.
+func (a *auditLog) hashValue(v string) string {
+	key := a.key
+	if len(key) == 0 {
+		key = a.salt
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(v))
+	return "hmac-sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// auditHMAC returns the HMAC of a record without its HMAC field, which
+// includes the HMAC of the previous record.
+func auditHMAC(key []byte, rec *auditRecord) (string, error) {
+	r := *rec
+	r.HMAC = ""
+	b, err := json.Marshal(&r)
+	if err != nil {
+		return "", err
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyAuditLog checks the HMAC chain of the audit records read from r. It
+// returns the number of records verified, and an error naming the first line
+// that was changed, or follows a removed line.
+func verifyAuditLog(r io.Reader, key []byte) (int, error) {
+	var prev string
+	var n, line int
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return n, fmt.Errorf("line %d: %s", line, err)
+		}
+		if rec.Prev != prev {
+			return n, fmt.Errorf("line %d: chain broken, a record was removed or reordered", line)
+		}
+		sum, err := auditHMAC(key, &rec)
+		if err != nil {
+			return n, fmt.Errorf("line %d: %s", line, err)
+		}
+		if !hmac.Equal([]byte(sum), []byte(rec.HMAC)) {
+			return n, fmt.Errorf("line %d: HMAC mismatch, the record was changed", line)
+		}
+
+		prev = rec.HMAC
+		n++
+	}
+	return n, scanner.Err()
+}
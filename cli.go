@@ -18,6 +18,7 @@ import (
 	"github.com/hashicorp/envconsul/version"
 	"github.com/hashicorp/go-hclog"
 	gsyslog "github.com/hashicorp/go-syslog"
+	"github.com/pkg/errors"
 )
 
 // Exit codes are int values that represent an exit code for a particular error.
@@ -57,6 +58,15 @@ type CLI struct {
 	// stopCh is an internal channel used to trigger a shutdown of the CLI.
 	stopCh  chan struct{}
 	stopped bool
+
+	// logFile is the file logs are written to, if configured, and logOutput
+	// the output of all the loggers, writing to the log file or errStream.
+	logFile   *logFile
+	logOutput *logWriter
+
+	// notifier sends the state of Envconsul to systemd, if it runs as a
+	// Type=notify service.
+	notifier *notifier
 }
 
 // NewCLI creates a new command line interface with the given streams.
@@ -66,12 +76,24 @@ func NewCLI(out, err io.Writer) *CLI {
 		errStream: err,
 		signalCh:  make(chan os.Signal, 1),
 		stopCh:    make(chan struct{}),
+		logOutput: &logWriter{},
 	}
 }
 
 // Run accepts a slice of arguments and returns an int representing the exit
 // status from the command.
 func (cli *CLI) Run(args []string) int {
+	if len(args) > 1 {
+		switch args[1] {
+		case "validate":
+			return cli.validate(args[2:])
+		case "config":
+			return cli.configCommand(args[2:])
+		case "audit":
+			return cli.auditCommand(args[2:])
+		}
+	}
+
 	// Parse the flags and args
 	cfg, paths, once, isVersion, err := cli.ParseFlags(args[1:])
 	if err != nil {
@@ -99,6 +121,7 @@ func (cli *CLI) Run(args []string) int {
 	if err != nil {
 		return logError(err, ExitCodeConfigError)
 	}
+	defer cli.closeLog()
 	logger := namedLogger("cli")
 
 	// If the version was requested, return an "error" containing the version
@@ -118,16 +141,52 @@ func (cli *CLI) Run(args []string) int {
 	// Print version information for debugging
 	logger.Info(version.HumanVersion)
 
+	// In init mode, reap the orphaned processes below envconsul. The mode is
+	// not changed by reloads.
+	initMode := config.BoolVal(cfg.Init)
+	if initMode {
+		if err := startReaper(); err != nil {
+			logger.Warn("not reaping orphaned processes", "error", err)
+		}
+	}
+
 	// Initial runner
+	cli.notifier = newNotifier()
 	runner, err := NewRunner(cfg, once)
 	if err != nil {
 		return logError(err, ExitCodeRunnerError)
 	}
+	runner.notifier = cli.notifier
+	cli.notifier.notify("STATUS=" + runner.status())
 	go runner.Start()
 
+	// Watch the configuration files, if requested
+	var watchCh <-chan struct{}
+	var debounceCh <-chan time.Time
+	var snapshot string
+	if config.BoolVal(cfg.ConfigWatch.Enabled) && len(paths) > 0 {
+		watcher, err := newConfigWatcher(paths)
+		if err != nil {
+			return logError(err, ExitCodeConfigError)
+		}
+		defer watcher.Stop()
+		watchCh = watcher.ch
+
+		if snapshot, err = configSnapshot(paths); err != nil {
+			return logError(err, ExitCodeConfigError)
+		}
+	}
+
 	// Listen for signals
 	signal.Notify(cli.signalCh)
 
+	// terminating is set once the child was told to stop in init mode,
+	// terminatedCh reports whether Terminate signaled a child, and killCh
+	// fires when it has to be killed
+	var terminating bool
+	var terminatedCh <-chan bool
+	var killCh <-chan time.Time
+
 	for {
 		select {
 		case err := <-runner.ErrCh:
@@ -144,6 +203,14 @@ func (cli *CLI) Run(args []string) int {
 			logger.Info("subprocess exited")
 			runner.Stop()
 
+			// The child was asked to stop, any exit is expected
+			if terminating {
+				if code < 0 {
+					return ExitCodeInterrupt
+				}
+				return code
+			}
+
 			if code == ExitCodeOK {
 				return ExitCodeOK
 			} else {
@@ -157,52 +224,169 @@ func (cli *CLI) Run(args []string) int {
 				logger.Debug("receiving signal", "signal", s)
 			}
 
-			switch s {
-			case *cfg.ReloadSignal:
-				fmt.Fprintf(cli.errStream, "Reloading configuration...\n")
-				runner.Stop()
-
-				// Re-parse any configuration files or paths
-				cfg, err = loadConfigs(paths, cliConfig)
-				if err != nil {
-					return logError(err, ExitCodeConfigError)
+			// The log file is reopened instead of signaling the child
+			if s == *cfg.LogReopenSignal && config.StringVal(cfg.LogFile) != "" {
+				if err := cli.reopenLog(); err != nil {
+					logger.Error("failed reopening log file", "error", err)
 				}
-				cfg.Finalize()
+				continue
+			}
 
-				// Load the new configuration from disk
-				err = cli.setupLogger(cfg)
-				if err != nil {
-					return logError(err, ExitCodeConfigError)
+			// In init mode, SIGTERM and the kill signal stop the child and
+			// wait for it to exit, killing it after the exec kill timeout
+			if initMode && (s == *cfg.KillSignal || s == signals.SignalLookup["SIGTERM"]) {
+				if terminating {
+					continue
 				}
+				terminating = true
+				fmt.Fprintf(cli.errStream, "Cleaning up...\n")
+				cli.notifier.notify("STOPPING=1", "STATUS=Stopping")
+				// The pre_stop hook may take a while, during which this loop
+				// keeps reaping orphans
+				ch := make(chan bool, 1)
+				go func(runner *Runner) { ch <- runner.Terminate() }(runner)
+				terminatedCh = ch
+				continue
+			}
 
-				runner, err = NewRunner(cfg, once)
+			switch s {
+			case *cfg.ReloadSignal:
+				if terminating {
+					continue
+				}
+				fmt.Fprintf(cli.errStream, "Reloading configuration...\n")
+				newCfg, newRunner, err := cli.reload(paths, cliConfig, runner, once)
 				if err != nil {
-					return logError(err, ExitCodeRunnerError)
+					logger.Error("rejecting new configuration, keeping the current one",
+						"error", err)
+					continue
+				}
+				cfg, runner = newCfg, newRunner
+				if watchCh != nil {
+					snapshot, _ = configSnapshot(paths)
 				}
-				go runner.Start()
 			case *cfg.KillSignal:
 				fmt.Fprintf(cli.errStream, "Cleaning up...\n")
+				cli.notifier.notify("STOPPING=1", "STATUS=Stopping")
 				runner.Stop()
 				return ExitCodeInterrupt
 			case signals.SignalLookup["SIGCHLD"]:
 				// The SIGCHLD signal is sent to the parent of a child process when it
 				// exits, is interrupted, or resumes after being interrupted. We ignore
-				// this signal because the child process is monitored on its own.
+				// this signal because the child process is monitored on its own,
+				// except in init mode where the orphaned processes have to be reaped.
 				//
 				// Also, the reason we do a lookup instead of a direct syscall.SIGCHLD
 				// is because that isn't defined on Windows.
+				if initMode {
+					reapZombies()
+				}
 			case RuntimeSig:
 				// ignore these as the runtime uses them with the scheduler
 			default:
 				// Propogate the signal to the child process
 				runner.Signal(s)
 			}
+		case running := <-terminatedCh:
+			terminatedCh = nil
+			if !running {
+				runner.Stop()
+				return ExitCodeInterrupt
+			}
+			killCh = time.After(config.TimeDurationVal(cfg.Exec.KillTimeout))
+		case <-killCh:
+			logger.Warn("child did not exit within the kill timeout")
+			runner.Kill()
+		case <-watchCh:
+			// Wait for the files to stop changing
+			debounceCh = time.After(config.TimeDurationVal(cfg.ConfigWatch.Debounce))
+		case <-debounceCh:
+			debounceCh = nil
+			if terminating {
+				continue
+			}
+
+			current, err := configSnapshot(paths)
+			if err != nil {
+				logger.Error("failed reading configuration files", "error", err)
+				continue
+			}
+			if current == snapshot {
+				logger.Trace("configuration files unchanged")
+				continue
+			}
+			snapshot = current
+
+			fmt.Fprintf(cli.errStream, "Configuration files changed, reloading...\n")
+			newCfg, newRunner, err := cli.reload(paths, cliConfig, runner, once)
+			if err != nil {
+				logger.Error("rejecting new configuration, keeping the current one",
+					"error", err)
+				continue
+			}
+			cfg, runner = newCfg, newRunner
 		case <-cli.stopCh:
 			return ExitCodeOK
 		}
 	}
 }
 
+// reload loads the configuration again and replaces the runner with one for
+// the new configuration. If the new configuration fails to load or validate,
+// it is rejected and the given runner keeps running. Systemd is told about
+// the reload, and that Envconsul is ready again once it is done.
+func (cli *CLI) reload(paths []string, cliConfig *Config, runner *Runner, once bool) (*Config, *Runner, error) {
+	cli.notifier.notify("RELOADING=1", "STATUS=Reloading configuration")
+
+	cfg, newRunner, err := cli.reloadRunner(paths, cliConfig, runner, once)
+	if err != nil {
+		cli.notifier.notify("READY=1", "STATUS="+runner.status())
+		return nil, nil, err
+	}
+	cli.notifier.notify("READY=1", "STATUS="+newRunner.status())
+	return cfg, newRunner, nil
+}
+
+// reloadRunner creates the runner for the reloaded configuration, which takes
+// over the child process of the given runner.
+func (cli *CLI) reloadRunner(paths []string, cliConfig *Config, runner *Runner, once bool) (*Config, *Runner, error) {
+	logger := namedLogger("cli")
+
+	// Re-parse any configuration files or paths. Like on startup, only a
+	// config that does not load or is invalid for the selected profile is
+	// rejected.
+	cfg, err := loadConfigs(paths, cliConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	var v validator
+	v.validateConfig(cfg)
+	for _, i := range v.issues {
+		if i.Error {
+			return nil, nil, errors.New(i.String())
+		}
+		logger.Warn(i.String())
+	}
+
+	// Load the new configuration from disk
+	if err := cli.setupLogger(cfg); err != nil {
+		return nil, nil, err
+	}
+
+	newRunner, err := NewRunner(cfg, once)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The child is only restarted if its environment or settings change
+	newRunner.Inherit(runner)
+	newRunner.notifier = cli.notifier
+	go newRunner.Start()
+
+	namedLogger("cli").Info("configuration reloaded", "event", "config_reloaded")
+	return cfg, newRunner, nil
+}
+
 // stop is used internally to shutdown a running CLI
 func (cli *CLI) stop() {
 	cli.Lock()
@@ -216,6 +400,233 @@ func (cli *CLI) stop() {
 	cli.stopped = true
 }
 
+// validate runs the validate command: it loads the configuration given by the
+// flags and prints the issues found, without starting the runner.
+func (cli *CLI) validate(args []string) int {
+	cfg, paths, _, _, err := cli.ParseFlags(args)
+	if err != nil {
+		if err == flag.ErrHelp {
+			fmt.Fprintf(cli.outStream, usage, version.Name)
+			return 0
+		}
+		fmt.Fprintln(cli.errStream, err.Error())
+		return ExitCodeParseFlagsError
+	}
+
+	status := ExitCodeOK
+	issues := validateConfigs(paths, cfg)
+	for _, i := range issues {
+		fmt.Fprintln(cli.outStream, i.String())
+		if i.Error {
+			status = ExitCodeConfigError
+		}
+	}
+	if len(issues) == 0 {
+		fmt.Fprintln(cli.outStream, "configuration is valid")
+	}
+	return status
+}
+
+// configCommand runs the config subcommands.
+func (cli *CLI) configCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(cli.errStream, "config: missing subcommand, expected migrate or show")
+		return ExitCodeParseFlagsError
+	}
+
+	switch args[0] {
+	case "migrate":
+		return cli.configMigrate(args[1:])
+	case "show":
+		return cli.configShow(args[1:])
+	}
+	fmt.Fprintf(cli.errStream, "config: unknown subcommand %q, expected migrate or show\n", args[0])
+	return ExitCodeParseFlagsError
+}
+
+// configMigrate rewrites configuration files without the deprecated keys. The
+// migrated config is printed, or written back to the files with -write.
+func (cli *CLI) configMigrate(args []string) int {
+	flags := flag.NewFlagSet("config migrate", flag.ContinueOnError)
+	flags.SetOutput(cli.errStream)
+	format := flags.String("format", "", "")
+	write := flags.Bool("write", false, "")
+	flags.Usage = func() { fmt.Fprintf(cli.errStream, usage, version.Name) }
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return ExitCodeParseFlagsError
+	}
+
+	var files []string
+	for _, path := range flags.Args() {
+		f, err := configFiles(path)
+		if err != nil {
+			return logError(err, ExitCodeConfigError)
+		}
+		files = append(files, f...)
+	}
+
+	switch {
+	case len(files) == 0:
+		fmt.Fprintln(cli.errStream, "config migrate: no configuration files given")
+		return ExitCodeParseFlagsError
+	case *write && *format != "":
+		fmt.Fprintln(cli.errStream, "config migrate: -format cannot be used with -write, "+
+			"files keep their format")
+		return ExitCodeParseFlagsError
+	case !*write && len(files) > 1:
+		fmt.Fprintln(cli.errStream, "config migrate: use -write to migrate several files")
+		return ExitCodeParseFlagsError
+	}
+
+	for _, file := range files {
+		c, err := FromFile(file)
+		if err != nil {
+			return logError(err, ExitCodeConfigError)
+		}
+
+		f := *format
+		if *write || f == "" {
+			if f, _ = formatFromPath(file); f == "" {
+				f = FormatHCL
+			}
+		}
+
+		b, err := EncodeConfig(c, f, false)
+		if err != nil {
+			return logError(err, ExitCodeConfigError)
+		}
+
+		if !*write {
+			cli.outStream.Write(b)
+			continue
+		}
+
+		stat, err := os.Stat(file)
+		if err != nil {
+			return logError(err, ExitCodeConfigError)
+		}
+		if err := ioutil.WriteFile(file, b, stat.Mode()); err != nil {
+			return logError(err, ExitCodeConfigError)
+		}
+		fmt.Fprintf(cli.outStream, "migrated %s\n", file)
+	}
+
+	return ExitCodeOK
+}
+
+// configShow prints the merged and finalized configuration given by the
+// flags, with tokens and passwords redacted.
+func (cli *CLI) configShow(args []string) int {
+	format, args := extractFormatFlag(args)
+	if format == "" {
+		format = FormatHCL
+	}
+
+	cfg, paths, _, _, err := cli.ParseFlags(args)
+	if err != nil {
+		if err == flag.ErrHelp {
+			fmt.Fprintf(cli.outStream, usage, version.Name)
+			return 0
+		}
+		fmt.Fprintln(cli.errStream, err.Error())
+		return ExitCodeParseFlagsError
+	}
+
+	cfg, err = loadConfigs(paths, cfg)
+	if err != nil {
+		return logError(err, ExitCodeConfigError)
+	}
+
+	// The selected profile is already applied
+	cfg.Profiles = nil
+
+	b, err := EncodeConfig(cfg, format, true)
+	if err != nil {
+		return logError(err, ExitCodeConfigError)
+	}
+	cli.outStream.Write(b)
+
+	return ExitCodeOK
+}
+
+// auditCommand runs the audit subcommands.
+func (cli *CLI) auditCommand(args []string) int {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintln(cli.errStream, "audit: missing or unknown subcommand, expected verify")
+		return ExitCodeParseFlagsError
+	}
+	return cli.auditVerify(args[1:])
+}
+
+// auditVerify checks the HMAC chain of the audit log given by the options, to
+// detect records that were changed or removed.
+func (cli *CLI) auditVerify(args []string) int {
+	cfg, paths, _, _, err := cli.ParseFlags(args)
+	if err != nil {
+		if err == flag.ErrHelp {
+			fmt.Fprintf(cli.outStream, usage, version.Name)
+			return 0
+		}
+		fmt.Fprintln(cli.errStream, err.Error())
+		return ExitCodeParseFlagsError
+	}
+
+	cfg, err = loadConfigs(paths, cfg)
+	if err != nil {
+		return logError(err, ExitCodeConfigError)
+	}
+
+	path := config.StringVal(cfg.Audit.Path)
+	key := config.StringVal(cfg.Audit.HMACKey)
+	switch {
+	case path == "":
+		fmt.Fprintln(cli.errStream, "audit verify: no audit path configured")
+		return ExitCodeConfigError
+	case key == "":
+		fmt.Fprintln(cli.errStream, "audit verify: no audit hmac_key configured")
+		return ExitCodeConfigError
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return logError(err, ExitCodeError)
+	}
+	defer f.Close()
+
+	n, err := verifyAuditLog(f, []byte(key))
+	if err != nil {
+		fmt.Fprintf(cli.errStream, "audit verify: %s: %s\n", path, err)
+		return ExitCodeError
+	}
+	fmt.Fprintf(cli.outStream, "%d records verified\n", n)
+	return ExitCodeOK
+}
+
+// extractFormatFlag removes the -format flag of the config show command from
+// the arguments, so the rest can be parsed by ParseFlags.
+func extractFormatFlag(args []string) (string, []string) {
+	var format string
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		a := strings.TrimPrefix(args[i], "-")
+		switch {
+		case a == "-format" || a == "format":
+			if i+1 < len(args) {
+				format = args[i+1]
+				i++
+			}
+		case strings.HasPrefix(a, "-format=") || strings.HasPrefix(a, "format="):
+			format = a[strings.Index(a, "=")+1:]
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	return format, rest
+}
+
 // ParseFlags is a helper function for parsing command line flags using Go's
 // Flag library. This is extracted into a helper to keep the main function
 // small, but it also makes writing tests for parsing command line arguments
@@ -239,6 +650,16 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 		return nil
 	}), "config", "")
 
+	flags.Var((funcBoolVar)(func(b bool) error {
+		c.ConfigWatch.Enabled = config.Bool(b)
+		return nil
+	}), "config-watch", "")
+
+	flags.Var((funcDurationVar)(func(d time.Duration) error {
+		c.ConfigWatch.Debounce = config.TimeDuration(d)
+		return nil
+	}), "config-watch-debounce", "")
+
 	flags.Var((funcVar)(func(s string) error {
 		c.Consul.Address = config.String(s)
 		return nil
@@ -363,6 +784,11 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 		return nil
 	}), "exec-splay", "")
 
+	flags.Var((funcBoolVar)(func(b bool) error {
+		c.Init = config.Bool(b)
+		return nil
+	}), "init", "")
+
 	flags.Var((funcVar)(func(s string) error {
 		sig, err := signals.Parse(s)
 		if err != nil {
@@ -372,11 +798,35 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 		return nil
 	}), "kill-signal", "")
 
+	flags.Var((funcBoolVar)(func(b bool) error {
+		c.LogEnvValues = config.Bool(b)
+		return nil
+	}), "log-env-values", "")
+
+	flags.Var((funcVar)(func(s string) error {
+		c.LogFile = config.String(s)
+		return nil
+	}), "log-file", "")
+
+	flags.Var((funcVar)(func(s string) error {
+		c.LogFormat = config.String(s)
+		return nil
+	}), "log-format", "")
+
 	flags.Var((funcVar)(func(s string) error {
 		c.LogLevel = config.String(s)
 		return nil
 	}), "log-level", "")
 
+	flags.Var((funcVar)(func(s string) error {
+		sig, err := signals.Parse(s)
+		if err != nil {
+			return err
+		}
+		c.LogReopenSignal = config.Signal(sig)
+		return nil
+	}), "log-reopen-signal", "")
+
 	flags.Var((funcDurationVar)(func(d time.Duration) error {
 		c.MaxStale = config.TimeDuration(d)
 		return nil
@@ -409,6 +859,11 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 		return nil
 	}), "pristine", "")
 
+	flags.Var((funcVar)(func(s string) error {
+		c.Profile = config.String(s)
+		return nil
+	}), "profile", "")
+
 	flags.Var((funcVar)(func(s string) error {
 		sig, err := signals.Parse(s)
 		if err != nil {
@@ -486,6 +941,11 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 		return nil
 	}), "service-format-port", "")
 
+	flags.Var((funcVar)(func(s string) error {
+		c.StatusFile = config.String(s)
+		return nil
+	}), "status-file", "")
+
 	flags.Var((funcBoolVar)(func(b bool) error {
 		c.Syslog.Enabled = config.Bool(b)
 		return nil
@@ -737,7 +1197,8 @@ func (cli *CLI) ParseFlags(args []string) (*Config, []string, bool, bool, error)
 
 // loadConfigs loads the configuration from the list of paths. The optional
 // configuration is the list of overrides to apply at the very end, taking
-// precendence over any configurations that were loaded from the paths. If any
+// precendence over any configurations that were loaded from the paths. The
+// environment variable references in the loaded configs are replaced. If any
 // errors occur when reading or parsing those sub-configs, it is returned.
 func loadConfigs(paths []string, o *Config) (*Config, error) {
 	finalC := DefaultConfig()
@@ -748,9 +1209,33 @@ func loadConfigs(paths []string, o *Config) (*Config, error) {
 			return nil, err
 		}
 
+		// Environment variables are read on every load, so reloads pick up
+		// their changes
+		if err := interpolateEnv(c); err != nil {
+			return nil, errors.Wrap(err, "config "+path)
+		}
+
 		finalC = finalC.Merge(c)
 	}
 
+	// Overlay the selected profile, below the CLI options
+	profile := stringFromEnv([]string{"ENVCONSUL_PROFILE"}, "")
+	if o != nil && o.Profile != nil {
+		profile = o.Profile
+	}
+	if name := config.StringVal(profile); name != "" {
+		p, ok := finalC.Profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile %q", name)
+		}
+		p = p.Copy()
+		if err := interpolateEnv(p); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("profile %q", name))
+		}
+		finalC = finalC.Merge(p)
+	}
+	finalC.Profile = profile
+
 	finalC = finalC.Merge(o)
 	finalC.Finalize()
 	return finalC, nil
@@ -775,35 +1260,84 @@ func (cli *CLI) setupLogger(conf *Config) error {
 		return fmt.Errorf("invalid log level: %s", logLevel)
 	}
 
-	var logOutput io.Writer
+	// Validate the log format
+	logFormat := strings.ToLower(valueFrom(conf.LogFormat))
+	if logFormat != "text" && logFormat != "json" {
+		return fmt.Errorf("invalid log format: %s", logFormat)
+	}
+
+	// Open the log file, keeping the current one across reloads. The new file
+	// is opened first so a failed reload keeps logging to the current one.
+	path := valueFrom(conf.LogFile)
+	file := cli.logFile
+	if file == nil || file.path != path {
+		file = nil
+		if path != "" {
+			var err error
+			if file, err = openLogFile(path); err != nil {
+				return fmt.Errorf("error opening log file: %s", err)
+			}
+		}
+	}
+
+	var logOutput io.Writer = cli.errStream
+	if file != nil {
+		logOutput = file
+	}
 	if valueFrom(conf.Syslog.Enabled) {
 		syslog, err := gsyslog.NewLogger(
 			gsyslog.LOG_NOTICE, valueFrom(conf.Syslog.Facility), version.Name)
 		if err != nil {
+			if file != cli.logFile {
+				file.Close()
+			}
 			return fmt.Errorf("error setting up syslog logger: %s", err)
 		}
-		logOutput = io.MultiWriter(cli.errStream, syslog)
-	} else {
-		logOutput = cli.errStream
+		logOutput = io.MultiWriter(logOutput, syslog)
+	}
+
+	// The loggers created before keep writing through logOutput, so the
+	// previous file is only closed once it is swapped out
+	cli.logOutput.Swap(logOutput)
+	if file != cli.logFile {
+		cli.closeLog()
+		cli.logFile = file
 	}
 
 	logger := hclog.New(&hclog.LoggerOptions{
 		Name:       "envconsul",
 		Level:      hclog.LevelFromString(logLevel),
-		Output:     logOutput,
+		Output:     cli.logOutput,
 		TimeFormat: hclog.TimeFormat,
+		JSONFormat: logFormat == "json",
 	})
 
 	hclog.SetDefault(logger)
 	// XXX consul-template still uses 'log' package
 	// XXX this gets 'log' playing mostly nice with hclog
 	// XXX remove after consul-template uses hclog??
-	log.SetFlags(0)                      // only log the message
-	log.SetOutput(logger.StandardWriter( // send message to hclog
+	log.SetFlags(0) // only log the message
+	ctLogger := logger.Named("consul-template")
+	log.SetOutput(ctLogger.StandardWriter( // send message to hclog
 		&hclog.StandardLoggerOptions{InferLevels: true}))
 	return nil
 }
 
+// reopenLog reopens the log file, if logs are written to one.
+func (cli *CLI) reopenLog() error {
+	if cli.logFile == nil {
+		return nil
+	}
+	return cli.logFile.Reopen()
+}
+
+// closeLog closes the log file, if logs are written to one.
+func (cli *CLI) closeLog() {
+	if cli.logFile != nil {
+		cli.logFile.Close()
+	}
+}
+
 // use generics (woo!) simplify getting values from pointers
 func valueFrom[T any](p *T) T {
 	if p == nil {
@@ -818,13 +1352,42 @@ const usage = `Usage: %s [options] <command>
   variables when the values are changed. It spawns a child process populated
   with the environment variables.
 
+  Run "%[1]s validate [options]" to check the configuration given by the
+  options without starting a child process. Unknown keys, ignored blocks,
+  invalid format templates and missing Vault tokens are reported, and the exit
+  status is non-zero if there are errors.
+
+  Run "%[1]s config migrate [-format=<format>] [-write] <path>..." to rewrite
+  configuration files without the deprecated keys. The migrated config is
+  printed, or written back to the files with -write. Comments are not kept.
+
+  Run "%[1]s config show [-format=<format>] [options]" to print the merged and
+  finalized configuration given by the options, with tokens and passwords
+  redacted. The format is hcl (default), json or yaml.
+
+  Run "%[1]s audit verify [options]" to check the HMAC chain of the audit log
+  given by the options. The exit status is non-zero if a record was changed
+  or removed.
+
 Options:
 
   -config=<path>
       Sets the path to a configuration file or folder on disk. This can be
       specified multiple times to load multiple files or folders. If multiple
       values are given, they are merged left-to-right, and CLI arguments take
-      the top-most precedence.
+      the top-most precedence. Files may be written in HCL, JSON or YAML,
+      detected by their extension. Glob patterns are expanded, and files in
+      folders are loaded in lexical order, following symlinks and skipping
+      hidden files and files with other extensions.
+
+  -config-watch
+      Watch the -config paths and reload when the configuration files change.
+      A new configuration that fails to load or validate is rejected and the
+      current one keeps running
+
+  -config-watch-debounce=<duration>
+      Sets the time to wait for the configuration files to stop changing
+      before reloading (default 1s)
 
   -consul-addr=<address>
       Sets the address of the Consul instance
@@ -900,13 +1463,31 @@ Options:
   -exec-splay=<duration>
       Amount of time to wait before sending signals
 
+  -init[=<bool>]
+      Act as the init process of a container, reaping orphaned processes and
+      stopping the child on SIGTERM
+
   -kill-signal=<signal>
       Signal to listen to gracefully terminate the process
 
+  -log-env-values[=<bool>]
+      Log the values of the environment variables that changed, not only their
+      names
+
+  -log-file=<path>
+      Write logs to the file at the given path instead of stderr. The file is
+      reopened on the -log-reopen-signal, for log rotation
+
+  -log-format=<format>
+      Set the format of log lines - values are "text" (default) and "json"
+
   -log-level=<level>
       Set the logging level - values are "trace", "debug", "info", "warn", 
       and "error"
 
+  -log-reopen-signal=<signal>
+      Signal to listen to reopen the -log-file, defaults to SIGUSR1
+
   -max-stale=<duration>
       Set the maximum staleness and allow stale queries to Consul which will
       distribute work among all servers instead of just the leader
@@ -930,6 +1511,11 @@ Options:
       Only use values retrieved from prefixes and secrets, do not inherit the
       existing environment variables
 
+  -profile=<name>
+      Overlay the configuration of the profile "name" {} block with this name
+      on the configuration files. Defaults to the ENVCONSUL_PROFILE environment
+      variable
+
   -reload-signal=<signal>
       Signal to listen to reload configuration
 
@@ -960,6 +1546,10 @@ Options:
   -service-format-port=<{{service}}/{{key}}>
       Format key environment for service port.
 
+  -status-file=<path>
+      Path on disk to write the status of the child process and the last
+      change of its environment as JSON
+
   -syslog
       Send the output to syslog instead of standard error and standard out. The
       syslog facility defaults to LOCAL0 and can be changed using a
@@ -1,16 +1,23 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"net"
 	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/consul-template/config"
 	"github.com/hashicorp/go-gatedio"
+	"github.com/hashicorp/go-hclog"
 )
 
 func TestCLI_ParseFlags(t *testing.T) {
@@ -76,9 +83,9 @@ func TestCLI_ParseFlags(t *testing.T) {
 			"splay",
 			[]string{"-splay", "10s"},
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					Splay: config.TimeDuration(10 * time.Second),
-				},
+				}},
 			},
 			false,
 		},
@@ -154,9 +161,9 @@ func TestCLI_ParseFlags(t *testing.T) {
 			"timeout",
 			[]string{"-timeout", "10s"},
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					Timeout: config.TimeDuration(10 * time.Second),
-				},
+				}},
 			},
 			false,
 		},
@@ -188,6 +195,26 @@ func TestCLI_ParseFlags(t *testing.T) {
 			&Config{},
 			false,
 		},
+		{
+			"config-watch",
+			[]string{"-config-watch"},
+			&Config{
+				ConfigWatch: &ConfigWatchConfig{
+					Enabled: config.Bool(true),
+				},
+			},
+			false,
+		},
+		{
+			"config-watch-debounce",
+			[]string{"-config-watch-debounce", "5s"},
+			&Config{
+				ConfigWatch: &ConfigWatchConfig{
+					Debounce: config.TimeDuration(5 * time.Second),
+				},
+			},
+			false,
+		},
 		{
 			"consul_addr",
 			[]string{"-consul-addr", "1.2.3.4"},
@@ -435,10 +462,10 @@ func TestCLI_ParseFlags(t *testing.T) {
 			"exec",
 			[]string{"-exec", "command"},
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					Enabled: config.Bool(true),
 					Command: []string{"command"},
-				},
+				}},
 			},
 			false,
 		},
@@ -446,9 +473,9 @@ func TestCLI_ParseFlags(t *testing.T) {
 			"exec-kill-signal",
 			[]string{"-exec-kill-signal", "SIGUSR1"},
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					KillSignal: config.Signal(syscall.SIGUSR1),
-				},
+				}},
 			},
 			false,
 		},
@@ -456,9 +483,9 @@ func TestCLI_ParseFlags(t *testing.T) {
 			"exec-kill-timeout",
 			[]string{"-exec-kill-timeout", "10s"},
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					KillTimeout: config.TimeDuration(10 * time.Second),
-				},
+				}},
 			},
 			false,
 		},
@@ -466,9 +493,17 @@ func TestCLI_ParseFlags(t *testing.T) {
 			"exec-splay",
 			[]string{"-exec-splay", "10s"},
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					Splay: config.TimeDuration(10 * time.Second),
-				},
+				}},
+			},
+			false,
+		},
+		{
+			"init",
+			[]string{"-init"},
+			&Config{
+				Init: config.Bool(true),
 			},
 			false,
 		},
@@ -480,6 +515,38 @@ func TestCLI_ParseFlags(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"log-file",
+			[]string{"-log-file", "/var/log/envconsul.log"},
+			&Config{
+				LogFile: config.String("/var/log/envconsul.log"),
+			},
+			false,
+		},
+		{
+			"log-env-values",
+			[]string{"-log-env-values"},
+			&Config{
+				LogEnvValues: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"log-format",
+			[]string{"-log-format", "json"},
+			&Config{
+				LogFormat: config.String("json"),
+			},
+			false,
+		},
+		{
+			"log-reopen-signal",
+			[]string{"-log-reopen-signal", "SIGUSR2"},
+			&Config{
+				LogReopenSignal: config.Signal(syscall.SIGUSR2),
+			},
+			false,
+		},
 		{
 			"log-level",
 			[]string{"-log-level", "DEBUG"},
@@ -594,6 +661,14 @@ func TestCLI_ParseFlags(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"profile",
+			[]string{"-profile", "dev"},
+			&Config{
+				Profile: config.String("dev"),
+			},
+			false,
+		},
 		{
 			"reload-signal",
 			[]string{"-reload-signal", "SIGUSR1"},
@@ -738,6 +813,14 @@ func TestCLI_ParseFlags(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"status-file",
+			[]string{"-status-file", "/run/envconsul/status.json"},
+			&Config{
+				StatusFile: config.String("/run/envconsul/status.json"),
+			},
+			false,
+		},
 		{
 			"syslog",
 			[]string{"-syslog"},
@@ -1076,10 +1159,10 @@ func TestCLI_ParseFlags(t *testing.T) {
 			"command",
 			[]string{"my", "command", "to", "run"},
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					Enabled: config.Bool(true),
 					Command: []string{"my command to run"},
-				},
+				}},
 			},
 			false,
 		},
@@ -1090,10 +1173,10 @@ func TestCLI_ParseFlags(t *testing.T) {
 				"command", "2",
 			},
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					Enabled: config.Bool(true),
 					Command: []string{"command 1"},
-				},
+				}},
 			},
 			false,
 		},
@@ -1119,3 +1202,747 @@ func TestCLI_ParseFlags(t *testing.T) {
 		})
 	}
 }
+
+func TestCLI_Validate(t *testing.T) {
+	// Keep the Vault token sources of the environment out of the way
+	t.Setenv("VAULT_TOKEN", "")
+	t.Setenv("HOME", t.TempDir())
+
+	cases := []struct {
+		name   string
+		ext    string
+		config string
+		out    string
+		code   int
+	}{
+		{
+			"valid",
+			".hcl",
+			`prefix { path = "foo" }`,
+			"configuration is valid\n",
+			ExitCodeOK,
+		},
+		{
+			"unknown_keys",
+			".hcl",
+			"bogus = 1\nconsul {\n  adress = \"x\"\n}",
+			"error: %[1]s:1:1: unknown key \"bogus\"\n" +
+				"error: %[1]s:3:3: unknown key \"adress\" in consul, did you mean \"address\"?\n",
+			ExitCodeConfigError,
+		},
+		{
+			"audit_no_path",
+			".hcl",
+			`audit { enabled = true }`,
+			"error: audit is enabled but has no path\n",
+			ExitCodeConfigError,
+		},
+		{
+			"listen",
+			".hcl",
+			`listen { network = "udp", address = ":53" }` + "\n" +
+				`listen { name = "a:b" }`,
+			"error: invalid listen network \"udp\", expected tcp, tcp4, tcp6 or unix\n" +
+				"error: listen requires an address\n" +
+				"error: invalid listen name \"a:b\", names cannot contain \":\"\n",
+			ExitCodeConfigError,
+		},
+		{
+			"exec_user",
+			".hcl",
+			`exec {` + "\n" +
+				`  user = "envconsul-no-such-user"` + "\n" +
+				`  umask = "0999"` + "\n" +
+				`}`,
+			"error: invalid exec umask \"0999\", expected an octal mode like \"027\"\n" +
+				"warning: exec user \"envconsul-no-such-user\": user: unknown user envconsul-no-such-user\n",
+			ExitCodeConfigError,
+		},
+		{
+			"exec_limits",
+			".hcl",
+			`exec {` + "\n" +
+				`  limits {` + "\n" +
+				`    nofile = "4096:1024"` + "\n" +
+				`    cgroup { path = "../app" }` + "\n" +
+				`  }` + "\n" +
+				`}`,
+			"error: invalid exec limits nofile \"4096:1024\": the soft limit is above the hard limit\n" +
+				"error: exec limits cgroup path \"../app\" is not below the cgroup of envconsul\n",
+			ExitCodeConfigError,
+		},
+		{
+			"exec_output",
+			".hcl",
+			`exec {` + "\n" +
+				`  stdout { format = "prefix" }` + "\n" +
+				`  stderr {` + "\n" +
+				`    format = "xml"` + "\n" +
+				`    file = "/var/log/app.err"` + "\n" +
+				`    max_size = "10X"` + "\n" +
+				`  }` + "\n" +
+				`}`,
+			"error: invalid exec stderr format \"xml\", expected raw, prefix or json\n" +
+				"error: exec stderr max_size: invalid size \"10X\"\n",
+			ExitCodeConfigError,
+		},
+		{
+			"replace_strategy",
+			".hcl",
+			`exec { replace_strategy = "blue_green" }`,
+			"error: invalid exec replace_strategy \"blue_green\", expected stop_first or start_first\n",
+			ExitCodeConfigError,
+		},
+		{
+			"start_first_no_ready",
+			".hcl",
+			`exec { replace_strategy = "start_first" }`,
+			"warning: exec replace_strategy \"start_first\" has no ready check, the new child " +
+				"is considered ready as soon as it starts\n",
+			ExitCodeOK,
+		},
+		{
+			"start_first_tcp_listen",
+			".hcl",
+			"listen { address = \"127.0.0.1:8080\" }\n" +
+				"exec {\n  replace_strategy = \"start_first\"\n  ready {\n    tcp = \"127.0.0.1:8080\"\n" +
+				"    file = \"/run/app/ready\"\n  }\n}",
+			"error: exec ready tcp and http checks cannot tell the children apart " +
+				"on a listen socket with replace_strategy \"start_first\", use a command or file check\n",
+			ExitCodeConfigError,
+		},
+		{
+			"start_first_http_only",
+			".hcl",
+			"exec {\n  replace_strategy = \"start_first\"\n  ready { http = \"http://127.0.0.1:8080/health\" }\n}",
+			"warning: exec ready tcp and http checks may be answered by the current " +
+				"child if both bind with SO_REUSEPORT, add a command or file check\n",
+			ExitCodeOK,
+		},
+		{
+			"deprecated_keys",
+			".hcl",
+			"token = \"abc\"\nexec {\n  env {\n    whitelist = [\"A\"]\n  }\n}",
+			"warning: %[1]s:1:1: token is deprecated, use consul { token = \"...\" } instead\n" +
+				"warning: %[1]s:4:5: exec.env.whitelist is deprecated, use exec { env { allowlist = [...] } } instead\n",
+			ExitCodeOK,
+		},
+		{
+			"empty_path",
+			".hcl",
+			"prefix {\n  format = \"x\"\n}\nsecret {\n  path = \"\"\n}",
+			"warning: %[1]s:1:1: prefix block without a path is ignored\n" +
+				"warning: %[1]s:4:1: secret block without a path is ignored\n",
+			ExitCodeOK,
+		},
+		{
+			"rename_without_pattern",
+			".hcl",
+			"prefix {\n  path = \"foo\"\n  rename {\n    pattern = \"\"\n    replacement = \"X\"\n  }\n}",
+			"error: prefix \"foo\": rename requires a pattern\n",
+			ExitCodeConfigError,
+		},
+		{
+			"invalid_format",
+			".hcl",
+			`prefix {
+				path = "foo"
+				format = "{{ key "
+				key {
+					name = "bar"
+					format = "{{ nope }}"
+				}
+			}`,
+			"error: invalid format of prefix \"foo\": template: filter:1: unclosed action\n" +
+				"error: invalid format of key \"bar\" in prefix \"foo\": template: filter:1: function \"nope\" not defined\n",
+			ExitCodeConfigError,
+		},
+		{
+			"conflicting_globs",
+			".hcl",
+			`prefix {
+				path = "foo"
+				include = ["DB_*"]
+				exclude = ["DB_*"]
+			}
+			exec {
+				env {
+					allowlist = ["FOO"]
+					denylist = ["F*"]
+				}
+			}`,
+			"warning: prefix \"foo\": include pattern \"DB_*\" is always removed by exclude pattern \"DB_*\"\n" +
+				"warning: exec env allowlist pattern \"FOO\" is always removed by denylist pattern \"F*\"\n",
+			ExitCodeOK,
+		},
+		{
+			"invalid_globs",
+			".hcl",
+			`exec {
+				env {
+					denylist = ["["]
+				}
+			}`,
+			"error: invalid exec env pattern \"[\": syntax error in pattern\n",
+			ExitCodeConfigError,
+		},
+		{
+			"vault_without_token",
+			".hcl",
+			`secret { path = "foo" }`,
+			"warning: secrets are read from Vault but there is no Vault token: " +
+				"set vault { token }, VAULT_TOKEN, ~/.vault-token, " +
+				"vault_agent_token_file or k8s_auth_role_name, unless a Vault " +
+				"agent proxy adds it\n",
+			ExitCodeOK,
+		},
+		{
+			"vault_with_token",
+			".hcl",
+			`secret { path = "foo" }
+			vault { token = "abc" }`,
+			"configuration is valid\n",
+			ExitCodeOK,
+		},
+		{
+			"profiles",
+			".hcl",
+			"prefix {\n  path = \"foo\"\n}\nprofile \"dev\" {\n  bogus = 1\n  prefix {\n    path = \"bar\"\n    format = \"{{ key \"\n  }\n}",
+			"error: %[1]s:5:3: unknown key \"bogus\"\n",
+			ExitCodeConfigError,
+		},
+		{
+			"profile_format",
+			".hcl",
+			`prefix { path = "foo" }
+			profile "dev" {
+				prefix {
+					path = "bar"
+					format = "{{ key "
+				}
+			}`,
+			"error: profile \"dev\": invalid format of prefix \"bar\": template: filter:1: unclosed action\n",
+			ExitCodeConfigError,
+		},
+		{
+			"json",
+			".json",
+			`{"prefix": [{"format": "x"}], "bogus": 1}`,
+			"warning: %[1]s:1:2: prefix block without a path is ignored\n" +
+				"error: %[1]s:1:31: unknown key \"bogus\"\n",
+			ExitCodeConfigError,
+		},
+		{
+			"json_nested",
+			".json",
+			"{\n  \"consul\": {\n    \"retry\": {\n      \"atempts\": 1\n    }\n  }\n}",
+			"error: %[1]s:4:7: unknown key \"atempts\" in consul.retry, did you mean \"attempts\"?\n",
+			ExitCodeConfigError,
+		},
+		{
+			"yaml",
+			".yaml",
+			"secret:\n  format: x\nbogus: 1\n",
+			"error: %[1]s: unknown key \"bogus\"\n" +
+				"warning: %[1]s: secret block without a path is ignored\n",
+			ExitCodeConfigError,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config"+tc.ext)
+			if err := ioutil.WriteFile(path, []byte(tc.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			out := gatedio.NewByteBuffer()
+			cli := NewCLI(out, out)
+
+			code := cli.Run([]string{"envconsul", "validate", "-config", path})
+			if code != tc.code {
+				t.Errorf("expected exit code %d, got %d", tc.code, code)
+			}
+
+			exp := tc.out
+			if strings.Contains(exp, "%[1]s") {
+				exp = fmt.Sprintf(exp, path)
+			}
+			if act := out.String(); act != exp {
+				t.Errorf("\nexp: %q\nact: %q", exp, act)
+			}
+		})
+	}
+}
+
+func TestCLI_ConfigMigrate(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	hclPath := filepath.Join(dir, "a.hcl")
+	jsonPath := filepath.Join(dir, "b.json")
+	if err := ioutil.WriteFile(hclPath, []byte(`token = "abcd"`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(jsonPath, []byte(`{"splay": "5s"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	out := gatedio.NewByteBuffer()
+	cli := NewCLI(out, out)
+	if code := cli.Run([]string{"envconsul", "config", "migrate", "-write", dir}); code != ExitCodeOK {
+		t.Fatalf("expected exit code %d, got %d: %s", ExitCodeOK, code, out.String())
+	}
+
+	cases := []struct {
+		path string
+		exp  string
+	}{
+		{hclPath, "consul {\n  token = \"abcd\"\n}\n"},
+		{jsonPath, "{\n  \"exec\": {\n    \"splay\": \"5s\"\n  }\n}\n"},
+	}
+	for _, tc := range cases {
+		b, err := ioutil.ReadFile(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tc.exp {
+			t.Errorf("%s\nexp: %q\nact: %q", tc.path, tc.exp, string(b))
+		}
+	}
+
+	// Several files need -write
+	out = gatedio.NewByteBuffer()
+	cli = NewCLI(out, out)
+	if code := cli.Run([]string{"envconsul", "config", "migrate", dir}); code != ExitCodeParseFlagsError {
+		t.Errorf("expected exit code %d, got %d", ExitCodeParseFlagsError, code)
+	}
+}
+
+func TestCLI_ConfigShow(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config.hcl")
+	contents := `
+		consul {
+			token = "abcd"
+		}
+		prefix {
+			path = "foo"
+		}
+	`
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	out := gatedio.NewByteBuffer()
+	cli := NewCLI(out, out)
+	code := cli.Run([]string{"envconsul", "config", "show", "-format=json",
+		"-config", path, "-upcase"})
+	if code != ExitCodeOK {
+		t.Fatalf("expected exit code %d, got %d: %s", ExitCodeOK, code, out.String())
+	}
+
+	c, err := ParseFormat(out.String(), FormatJSON)
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out.String())
+	}
+	if act := config.StringVal(c.Consul.Token); act != redactedValue {
+		t.Errorf("expected redacted token, got %q", act)
+	}
+	if len(*c.Prefixes) != 1 || config.StringVal((*c.Prefixes)[0].Path) != "foo" {
+		t.Errorf("expected prefix foo, got %#v", c.Prefixes)
+	}
+	if !config.BoolVal(c.Upcase) {
+		t.Errorf("expected upcase from the CLI flags")
+	}
+	if act := config.StringVal(c.LogLevel); act != DefaultLogLevel {
+		t.Errorf("expected finalized log level %q, got %q", DefaultLogLevel, act)
+	}
+}
+
+func TestCLI_AuditVerify(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	a, err := openAuditLog(path, []byte("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, env := range []map[string]string{{"foo": "bar"}, {"foo": "baz"}} {
+		if err := a.Record(diffEnv(nil, env), env, nil, auditChildStart, 1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Close()
+
+	cases := []struct {
+		name   string
+		config string
+		out    string
+		code   int
+	}{
+		{
+			"verified",
+			fmt.Sprintf(`audit { path = %q, hmac_key = "s3cret" }`, path),
+			"2 records verified\n",
+			ExitCodeOK,
+		},
+		{
+			"wrong_key",
+			fmt.Sprintf(`audit { path = %q, hmac_key = "other" }`, path),
+			fmt.Sprintf("audit verify: %s: line 1: HMAC mismatch, the record was changed\n", path),
+			ExitCodeError,
+		},
+		{
+			"no_key",
+			fmt.Sprintf(`audit { path = %q }`, path),
+			"audit verify: no audit hmac_key configured\n",
+			ExitCodeConfigError,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			configPath := filepath.Join(dir, fmt.Sprintf("config%d.hcl", i))
+			if err := ioutil.WriteFile(configPath, []byte(tc.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			out := gatedio.NewByteBuffer()
+			cli := NewCLI(out, out)
+			code := cli.Run([]string{"envconsul", "audit", "verify", "-config", configPath})
+			if code != tc.code {
+				t.Errorf("expected exit code %d, got %d", tc.code, code)
+			}
+			if act := out.String(); act != tc.out {
+				t.Errorf("\nexp: %#v\nact: %#v", tc.out, act)
+			}
+		})
+	}
+}
+
+func TestCLI_configWatcher(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.hcl")
+	if err := ioutil.WriteFile(path, []byte(`upcase = true`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := configSnapshot([]string{path, dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newConfigWatcher([]string{path, dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	// Nothing is reported while the files do not change, which would keep
+	// pushing back the debounce timer
+	select {
+	case <-w.ch:
+		t.Fatal("expected no change to be reported")
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	// Replace the file like editors do
+	tmp := filepath.Join(dir, ".config.hcl.swp")
+	if err := ioutil.WriteFile(tmp, []byte(`upcase = false`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-w.ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a change to be reported")
+	}
+
+	after, err := configSnapshot([]string{path, dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == after {
+		t.Errorf("expected the snapshot to change")
+	}
+}
+
+func TestCLI_reload(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config.hcl")
+	if err := ioutil.WriteFile(path, []byte(`upcase = true`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	out := gatedio.NewByteBuffer()
+	cli := NewCLI(out, out)
+
+	// Systemd is told about the reloads
+	var notifyCh <-chan string
+	if runtime.GOOS != "windows" {
+		var socket string
+		socket, notifyCh = notifySocket(t)
+		cli.notifier = &notifier{addr: &net.UnixAddr{Name: socket, Net: "unixgram"}}
+	}
+	expectNotify := func(exp string) {
+		t.Helper()
+		if notifyCh == nil {
+			return
+		}
+		if act := receiveNotify(t, notifyCh); act != exp {
+			t.Errorf("expected %q, got %q", exp, act)
+		}
+	}
+
+	cliConfig := DefaultConfig()
+	cliConfig.Exec.Command = []string{"sleep 30"}
+
+	cfg, err := loadConfigs([]string{path}, cliConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner, err := NewRunner(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer runner.Stop()
+
+	// An invalid config is rejected
+	if err := ioutil.WriteFile(path, []byte(`bogus = true`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cli.reload([]string{path}, cliConfig, runner, false); err == nil {
+		t.Fatal("expected an error")
+	}
+	expectNotify("RELOADING=1\nSTATUS=Reloading configuration")
+	expectNotify("READY=1\nSTATUS=Waiting for data")
+
+	// A valid config replaces the runner, even if a profile that is not
+	// selected is invalid
+	contents := "upcase = false\nprofile \"prod\" {\n  log_format = \"xml\"\n}"
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	newCfg, newRunner, err := cli.reload([]string{path}, cliConfig, runner, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newRunner.Stop()
+	expectNotify("RELOADING=1\nSTATUS=Reloading configuration")
+	expectNotify("READY=1\nSTATUS=Waiting for data")
+
+	if config.BoolVal(newCfg.Upcase) {
+		t.Errorf("expected the new config to be loaded")
+	}
+	if newRunner == runner {
+		t.Errorf("expected a new runner")
+	}
+}
+
+func TestLoadConfigs_profile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.hcl")
+	contents := `
+		upcase = true
+		prefix {
+			path = "base"
+		}
+		profile "dev" {
+			upcase = false
+			prefix {
+				path = "dev"
+			}
+		}
+	`
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		env      string
+		flag     *string
+		upcase   bool
+		prefixes []string
+		err      bool
+	}{
+		{
+			"none",
+			"",
+			nil,
+			true,
+			[]string{"base"},
+			false,
+		},
+		{
+			"flag",
+			"",
+			config.String("dev"),
+			false,
+			[]string{"base", "dev"},
+			false,
+		},
+		{
+			"env",
+			"dev",
+			nil,
+			false,
+			[]string{"base", "dev"},
+			false,
+		},
+		{
+			"flag_over_env",
+			"dev",
+			config.String(""),
+			true,
+			[]string{"base"},
+			false,
+		},
+		{
+			"unknown",
+			"",
+			config.String("prod"),
+			false,
+			nil,
+			true,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			t.Setenv("ENVCONSUL_PROFILE", tc.env)
+
+			c, err := loadConfigs([]string{path}, &Config{Profile: tc.flag})
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+			if err != nil {
+				return
+			}
+
+			if act := config.BoolVal(c.Upcase); act != tc.upcase {
+				t.Errorf("\nexp: %#v\nact: %#v", tc.upcase, act)
+			}
+			var prefixes []string
+			for _, p := range *c.Prefixes {
+				prefixes = append(prefixes, config.StringVal(p.Path))
+			}
+			if !reflect.DeepEqual(tc.prefixes, prefixes) {
+				t.Errorf("\nexp: %#v\nact: %#v", tc.prefixes, prefixes)
+			}
+		})
+	}
+}
+
+func TestCLI_setupLogger(t *testing.T) {
+	defer hclog.SetDefault(hclog.Default())
+	defer log.SetOutput(os.Stderr)
+
+	path := filepath.Join(t.TempDir(), "envconsul.log")
+
+	cli := NewCLI(ioutil.Discard, ioutil.Discard)
+	defer cli.closeLog()
+
+	cfg := DefaultConfig()
+	cfg.LogFile = config.String(path)
+	cfg.LogFormat = config.String("json")
+	cfg.LogLevel = config.String("info")
+	cfg.Finalize()
+	if err := cli.setupLogger(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	namedLogger("runner").Info("child started", "event", "child_started", "pid", 42)
+	log.Printf("[WARN] (view) kv.list(foo): no data")
+
+	// logrotate moves the file away and sends the reopen signal
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.reopenLog(); err != nil {
+		t.Fatal(err)
+	}
+	namedLogger("cli").Info("reopened")
+
+	read := func(path string) []map[string]interface{} {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lines []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			var m map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &m); err != nil {
+				t.Fatalf("%s: %q", err, line)
+			}
+			delete(m, "@timestamp")
+			lines = append(lines, m)
+		}
+		return lines
+	}
+
+	exp := []map[string]interface{}{
+		{
+			"@level":   "info",
+			"@message": "child started",
+			"@module":  "envconsul.runner",
+			"event":    "child_started",
+			"pid":      float64(42),
+		},
+		{
+			"@level":   "warn",
+			"@message": "(view) kv.list(foo): no data",
+			"@module":  "envconsul.consul-template",
+		},
+	}
+	if act := read(path + ".1"); !reflect.DeepEqual(exp, act) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, act)
+	}
+
+	exp = []map[string]interface{}{
+		{
+			"@level":   "info",
+			"@message": "reopened",
+			"@module":  "envconsul.cli",
+		},
+	}
+	if act := read(path); !reflect.DeepEqual(exp, act) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, act)
+	}
+
+	// Loggers created before a reload write to the new file
+	logger := namedLogger("cli")
+	cfg.LogFile = config.String(path + ".new")
+	if err := cli.setupLogger(cfg); err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("reloaded")
+
+	exp = []map[string]interface{}{
+		{
+			"@level":   "info",
+			"@message": "reloaded",
+			"@module":  "envconsul.cli",
+		},
+	}
+	if act := read(path + ".new"); !reflect.DeepEqual(exp, act) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, act)
+	}
+
+	t.Run("invalid_format", func(t *testing.T) {
+		cfg := DefaultConfig()
+		cfg.LogFormat = config.String("xml")
+		cfg.Finalize()
+		if err := cli.setupLogger(cfg); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -13,8 +14,17 @@ import (
 	"github.com/hashicorp/consul-template/config"
 	"github.com/hashicorp/consul-template/signals"
 	"github.com/hashicorp/hcl"
+	jsonParser "github.com/hashicorp/hcl/json/parser"
 	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Config file formats supported by ParseFormat.
+const (
+	FormatHCL  = "hcl"
+	FormatJSON = "json"
+	FormatYAML = "yaml"
 )
 
 const (
@@ -30,30 +40,79 @@ const (
 
 	// DefaultKillSignal is the default signal for termination.
 	DefaultKillSignal = syscall.SIGINT
+
+	// DefaultLogFormat is the default format of log lines.
+	DefaultLogFormat = "text"
 )
 
+// DefaultLogReopenSignal is the default signal to reopen the log file, after
+// it was rotated. The lookup is nil on Windows, which has no SIGUSR1.
+var DefaultLogReopenSignal = signals.SignalLookup["SIGUSR1"]
+
 // Config is used to configure Consul ENV
 type Config struct {
+	// Audit is the configuration for the audit log of environment changes.
+	Audit *AuditConfig `mapstructure:"audit"`
+
+	// ConfigWatch is the configuration for reloading when the configuration
+	// files change.
+	ConfigWatch *ConfigWatchConfig `mapstructure:"config_watch"`
+
 	// Consul is the configuration for connecting to a Consul cluster.
 	Consul *config.ConsulConfig `mapstructure:"consul"`
 
 	// Exec is the configuration for exec/supervise mode.
-	Exec *config.ExecConfig `mapstructure:"exec"`
+	Exec *ExecConfig `mapstructure:"exec"`
+
+	// Init makes envconsul act as the init process of a container: it reaps
+	// the orphaned processes below it, runs the child in its own process group
+	// and stops it with the exec kill signal on SIGTERM.
+	Init *bool `mapstructure:"init"`
 
 	// KillSignal is the signal to listen for a graceful terminate event.
 	KillSignal *os.Signal `mapstructure:"kill_signal"`
 
+	// Listeners are the sockets envconsul listens on and passes to the child
+	// process, which stay open across restarts of the child.
+	Listeners *ListenConfigs `mapstructure:"listen"`
+
+	// LogEnvValues logs the values of the environment variables that changed,
+	// not only their names.
+	LogEnvValues *bool `mapstructure:"log_env_values"`
+
+	// LogFile is the path of a file to write logs to instead of stderr.
+	LogFile *string `mapstructure:"log_file"`
+
+	// LogFormat is the format of log lines, "text" or "json".
+	LogFormat *string `mapstructure:"log_format"`
+
 	// LogLevel is the level with which to log for this config.
 	LogLevel *string `mapstructure:"log_level"`
 
+	// LogReopenSignal is the signal to listen for to reopen the log file, for
+	// log rotation. It is only handled when LogFile is set.
+	LogReopenSignal *os.Signal `mapstructure:"log_reopen_signal"`
+
 	// MaxStale is the maximum amount of time for staleness from Consul as given
 	// by LastContact.
 	MaxStale *time.Duration `mapstructure:"max_stale"`
 
+	// Meta is the list of sources holding additional prefixes and secrets to
+	// watch, which are added and removed at runtime.
+	Meta *MetaConfigs `mapstructure:"meta"`
+
 	// PidFile is the path on disk where a PID file should be written containing
 	// this processes PID.
 	PidFile *string `mapstructure:"pid_file"`
 
+	// Profile is the name of the profile to apply, from the -profile flag or
+	// the ENVCONSUL_PROFILE environment variable.
+	Profile *string `mapstructure:"-"`
+
+	// Profiles are the named configs that overlay this config when selected,
+	// from the `profile "name" {}` blocks. They are decoded separately.
+	Profiles map[string]*Config `mapstructure:"-"`
+
 	// Prefixes is the list of all prefix dependencies (consul)
 	// in merge order.
 	Prefixes *PrefixConfigs `mapstructure:"prefix"`
@@ -74,6 +133,10 @@ type Config struct {
 
 	Services *ServiceConfigs `mapstructure:"service"`
 
+	// StatusFile is the path on disk where the status of the child process and
+	// the last change of its environment are written as JSON.
+	StatusFile *string `mapstructure:"status_file"`
+
 	// Syslog is the configuration for syslog.
 	Syslog *config.SyslogConfig `mapstructure:"syslog"`
 
@@ -92,6 +155,14 @@ type Config struct {
 func (c *Config) Copy() *Config {
 	var o Config
 
+	if c.Audit != nil {
+		o.Audit = c.Audit.Copy()
+	}
+
+	if c.ConfigWatch != nil {
+		o.ConfigWatch = c.ConfigWatch.Copy()
+	}
+
 	if c.Consul != nil {
 		o.Consul = c.Consul.Copy()
 	}
@@ -100,12 +171,30 @@ func (c *Config) Copy() *Config {
 		o.Exec = c.Exec.Copy()
 	}
 
+	o.Init = c.Init
+
 	o.KillSignal = c.KillSignal
 
+	if c.Listeners != nil {
+		o.Listeners = c.Listeners.Copy()
+	}
+
+	o.LogEnvValues = c.LogEnvValues
+
+	o.LogFile = c.LogFile
+
+	o.LogFormat = c.LogFormat
+
 	o.LogLevel = c.LogLevel
 
+	o.LogReopenSignal = c.LogReopenSignal
+
 	o.MaxStale = c.MaxStale
 
+	if c.Meta != nil {
+		o.Meta = c.Meta.Copy()
+	}
+
 	o.PidFile = c.PidFile
 
 	o.ReloadSignal = c.ReloadSignal
@@ -114,6 +203,15 @@ func (c *Config) Copy() *Config {
 		o.Prefixes = c.Prefixes.Copy()
 	}
 
+	o.Profile = c.Profile
+
+	if c.Profiles != nil {
+		o.Profiles = make(map[string]*Config, len(c.Profiles))
+		for name, p := range c.Profiles {
+			o.Profiles[name] = p.Copy()
+		}
+	}
+
 	o.Services = c.Services
 
 	o.Pristine = c.Pristine
@@ -124,6 +222,8 @@ func (c *Config) Copy() *Config {
 		o.Secrets = c.Secrets.Copy()
 	}
 
+	o.StatusFile = c.StatusFile
+
 	if c.Syslog != nil {
 		o.Syslog = c.Syslog.Copy()
 	}
@@ -155,6 +255,14 @@ func (c *Config) Merge(o *Config) *Config {
 
 	r := c.Copy()
 
+	if o.Audit != nil {
+		r.Audit = r.Audit.Merge(o.Audit)
+	}
+
+	if o.ConfigWatch != nil {
+		r.ConfigWatch = r.ConfigWatch.Merge(o.ConfigWatch)
+	}
+
 	if o.Consul != nil {
 		r.Consul = r.Consul.Merge(o.Consul)
 	}
@@ -163,18 +271,46 @@ func (c *Config) Merge(o *Config) *Config {
 		r.Exec = r.Exec.Merge(o.Exec)
 	}
 
+	if o.Init != nil {
+		r.Init = o.Init
+	}
+
 	if o.KillSignal != nil {
 		r.KillSignal = o.KillSignal
 	}
 
+	if o.Listeners != nil {
+		r.Listeners = r.Listeners.Merge(o.Listeners)
+	}
+
+	if o.LogEnvValues != nil {
+		r.LogEnvValues = o.LogEnvValues
+	}
+
+	if o.LogFile != nil {
+		r.LogFile = o.LogFile
+	}
+
+	if o.LogFormat != nil {
+		r.LogFormat = o.LogFormat
+	}
+
 	if o.LogLevel != nil {
 		r.LogLevel = o.LogLevel
 	}
 
+	if o.LogReopenSignal != nil {
+		r.LogReopenSignal = o.LogReopenSignal
+	}
+
 	if o.MaxStale != nil {
 		r.MaxStale = o.MaxStale
 	}
 
+	if o.Meta != nil {
+		r.Meta = r.Meta.Merge(o.Meta)
+	}
+
 	if o.PidFile != nil {
 		r.PidFile = o.PidFile
 	}
@@ -187,6 +323,19 @@ func (c *Config) Merge(o *Config) *Config {
 		r.Prefixes = r.Prefixes.Merge(o.Prefixes)
 	}
 
+	if o.Profile != nil {
+		r.Profile = o.Profile
+	}
+
+	if o.Profiles != nil {
+		if r.Profiles == nil {
+			r.Profiles = make(map[string]*Config, len(o.Profiles))
+		}
+		for name, p := range o.Profiles {
+			r.Profiles[name] = r.Profiles[name].Merge(p)
+		}
+	}
+
 	if o.Services != nil {
 		r.Services = r.Services.Merge(o.Services)
 	}
@@ -203,6 +352,10 @@ func (c *Config) Merge(o *Config) *Config {
 		r.Secrets = r.Secrets.Merge(o.Secrets)
 	}
 
+	if o.StatusFile != nil {
+		r.StatusFile = o.StatusFile
+	}
+
 	if o.Syslog != nil {
 		r.Syslog = r.Syslog.Merge(o.Syslog)
 	}
@@ -224,10 +377,39 @@ func (c *Config) Merge(o *Config) *Config {
 
 // Parse parses the given string contents as a config
 func Parse(s string) (*Config, error) {
-	logger := namedLogger("parse")
+	return ParseFormat(s, FormatHCL)
+}
+
+// ParseFormat parses the given string contents as a config in the given
+// format. All formats are decoded into the same intermediate structure as HCL,
+// so equivalent contents produce identical configs.
+func ParseFormat(s, format string) (*Config, error) {
 	var shadow interface{}
-	if err := hcl.Decode(&shadow, s); err != nil {
-		return nil, errors.Wrap(err, "error decoding config")
+	switch format {
+	case FormatHCL:
+		if err := hcl.Decode(&shadow, s); err != nil {
+			return nil, syntaxError(err)
+		}
+	case FormatJSON:
+		root, err := jsonParser.Parse([]byte(s))
+		if err != nil {
+			return nil, syntaxError(err)
+		}
+		if err := hcl.DecodeObject(&shadow, root); err != nil {
+			return nil, errors.Wrap(err, "error decoding config")
+		}
+	case FormatYAML:
+		var raw interface{}
+		if err := yaml.Unmarshal([]byte(s), &raw); err != nil {
+			return nil, syntaxError(err)
+		}
+		// An empty document is an empty config.
+		if raw == nil {
+			raw = map[interface{}]interface{}{}
+		}
+		shadow = yamlToHCL(raw, true)
+	default:
+		return nil, fmt.Errorf("unknown config format %q", format)
 	}
 
 	// Convert to a map and flatten the keys we want to flatten
@@ -236,7 +418,29 @@ func Parse(s string) (*Config, error) {
 		return nil, errors.New("error converting config")
 	}
 
+	c, err := decode(parsed)
+	if err != nil {
+		// Find the position of the error in the file, only once it failed
+		return nil, locateError(err, []byte(s), format)
+	}
+	return c, nil
+}
+
+// decode populates a new Config from the intermediate structure of a parsed
+// config file, applying the deprecation rewrites along the way.
+func decode(parsed map[string]interface{}) (*Config, error) {
+	logger := namedLogger("parse")
+
+	// Profiles are full configs, decoded on their own
+	profiles, err := decodeProfiles(parsed["profile"])
+	if err != nil {
+		return nil, err
+	}
+	delete(parsed, "profile")
+
 	flattenKeys(parsed, []string{
+		"audit",
+		"config_watch",
 		"consul",
 		"consul.auth",
 		"consul.retry",
@@ -244,6 +448,12 @@ func Parse(s string) (*Config, error) {
 		"consul.transport",
 		"exec",
 		"exec.env",
+		"exec.hooks",
+		"exec.limits",
+		"exec.limits.cgroup",
+		"exec.ready",
+		"exec.stderr",
+		"exec.stdout",
 		"syslog",
 		"vault",
 		"vault.retry",
@@ -366,6 +576,24 @@ func Parse(s string) (*Config, error) {
 		delete(parsed, "token")
 	}
 
+	// Limits and output sizes are given as numbers, or as strings like
+	// "unlimited" or "512M"
+	if exec, ok := parsed["exec"].(map[string]interface{}); ok {
+		if limits, ok := exec["limits"].(map[string]interface{}); ok {
+			stringifyNumbers(limits)
+			if cgroup, ok := limits["cgroup"].(map[string]interface{}); ok {
+				stringifyNumbers(cgroup)
+			}
+		}
+		for _, stream := range []string{"stdout", "stderr"} {
+			if output, ok := exec[stream].(map[string]interface{}); ok {
+				if size, ok := output["max_size"]; ok {
+					output["max_size"] = stringifyNumber(size)
+				}
+			}
+		}
+	}
+
 	// Create a new, empty config
 	var c Config
 
@@ -390,12 +618,82 @@ func Parse(s string) (*Config, error) {
 	}
 	if err := decoder.Decode(parsed); err != nil {
 		logger.Debug(fmt.Sprintf("%#v", parsed))
-		return nil, errors.Wrap(err, "mapstructure decode failed")
+		return nil, decodeError(err)
 	}
+	c.Profiles = profiles
 
 	return &c, nil
 }
 
+// decodeProfiles decodes the `profile "name" {}` blocks of a parsed config.
+// A profile given several times is merged in order.
+func decodeProfiles(raw interface{}) (map[string]*Config, error) {
+	if raw == nil {
+		return nil, nil
+	}
+
+	profiles := make(map[string]*Config)
+	for _, block := range hclObjects(raw) {
+		for name, body := range block {
+			for _, b := range hclObjects(body) {
+				if _, ok := b["profile"]; ok {
+					return nil, fmt.Errorf("profile %q: profiles cannot be nested", name)
+				}
+				p, err := decode(b)
+				if pe, ok := err.(*ParseError); ok && pe.key != "" {
+					pe.key = fmt.Sprintf("profile[0].%s[0].%s", name, pe.key)
+					pe.Err = errors.Wrap(pe.Err, fmt.Sprintf("profile %q", name))
+					return nil, pe
+				}
+				if err != nil {
+					return nil, errors.Wrap(err, fmt.Sprintf("profile %q", name))
+				}
+				profiles[name] = profiles[name].Merge(p)
+			}
+			if _, ok := profiles[name]; !ok {
+				profiles[name] = &Config{}
+			}
+		}
+	}
+	return profiles, nil
+}
+
+// hclObjects returns the objects of a decoded block, which is an object or a
+// list of objects.
+func hclObjects(v interface{}) []map[string]interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{v}
+	case []map[string]interface{}:
+		return v
+	case []interface{}:
+		var r []map[string]interface{}
+		for _, e := range v {
+			r = append(r, hclObjects(e)...)
+		}
+		return r
+	}
+	return nil
+}
+
+func profilesGoString(p map[string]*Config) string {
+	if p == nil {
+		return "(map[string]*Config)(nil)"
+	}
+
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	s := make([]string, len(names))
+	for i, name := range names {
+		s[i] = fmt.Sprintf("%q:%s", name, p[name].GoString())
+	}
+	return "{" + strings.Join(s, ", ") + "}"
+}
+
 // Must returns a config object that must compile. If there are any errors, this
 // function will panic. This is most useful in testing or constants.
 func Must(s string) *Config {
@@ -415,14 +713,24 @@ func TestConfig(c *Config) *Config {
 }
 
 // FromFile reads the configuration file at the given path and returns a new
-// Config struct with the data populated.
+// Config struct with the data populated. The format is detected from the file
+// extension, files without a known extension are parsed as HCL.
 func FromFile(path string) (*Config, error) {
 	c, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, errors.Wrap(err, "from file: "+path)
 	}
 
-	config, err := Parse(string(c))
+	format, ok := formatFromPath(path)
+	if !ok {
+		format = FormatHCL
+	}
+
+	config, err := ParseFormat(string(c), format)
+	if pe, ok := err.(*ParseError); ok {
+		pe.File = path
+		return nil, pe
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, "from file: "+path)
 	}
@@ -432,6 +740,55 @@ func FromFile(path string) (*Config, error) {
 // FromPath iterates and merges all configuration files in a given
 // directory, returning the resulting config.
 func FromPath(path string) (*Config, error) {
+	files, err := configFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Single load files
+	if len(files) == 1 && files[0] == path {
+		return FromFile(path)
+	}
+
+	// Create a blank config to merge off of
+	var c *Config
+	for _, file := range files {
+		// Parse and merge the config
+		newConfig, err := FromFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "walk error")
+		}
+		c = c.Merge(newConfig)
+	}
+
+	return c, nil
+}
+
+// configFiles returns the configuration files at the given path in merge
+// order: the path itself for a file, or every config file below it for a
+// directory. A path that does not exist is expanded as a glob pattern, with
+// the matches loaded in lexical order.
+func configFiles(path string) ([]string, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) && hasGlobMeta(path) {
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid pattern: "+path)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match: %s", path)
+		}
+
+		var files []string
+		for _, match := range matches {
+			f, err := configFiles(match)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, f...)
+		}
+		return files, nil
+	}
+
 	// Ensure the given filepath exists
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return nil, errors.Wrap(err, "missing file/folder: "+path)
@@ -443,49 +800,101 @@ func FromPath(path string) (*Config, error) {
 		return nil, errors.Wrap(err, "failed stating file: "+path)
 	}
 
-	// Recursively parse directories, single load files
-	if stat.Mode().IsDir() {
-		// Ensure the given filepath has at least one config file
-		_, err := ioutil.ReadDir(path)
-		if err != nil {
-			return nil, errors.Wrap(err, "failed listing dir: "+path)
+	if stat.Mode().IsRegular() {
+		return []string{path}, nil
+	} else if !stat.Mode().IsDir() {
+		return nil, fmt.Errorf("unknown filetype: %q", stat.Mode().String())
+	}
+
+	var files []string
+	err = walkConfigDir(path, func(path string, info os.FileInfo) error {
+		if info.IsDir() {
+			return nil
 		}
 
-		// Create a blank config to merge off of
-		var c *Config
+		// Skip files that are not config files, like editor swap and backup
+		// files. Files without an extension are parsed as HCL.
+		if !isConfigFile(path) {
+			namedLogger("parse").Debug("skipping file with unknown extension", "path", path)
+			return nil
+		}
 
-		// Potential bug: Walk does not follow symlinks!
-		err = filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
-			// If WalkFunc had an error, just return it
-			if err != nil {
-				return err
-			}
+		files = append(files, path)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "walk error")
+	}
 
-			// Do nothing for directories
-			if info.IsDir() {
-				return nil
-			}
+	return files, nil
+}
 
-			// Parse and merge the config
-			newConfig, err := FromFile(path)
-			if err != nil {
+// walkConfigDir calls fn for every file and directory below root in lexical
+// order. Unlike filepath.Walk it follows symlinks, like the ones of
+// Kubernetes ConfigMap mounts, and it skips hidden entries, like the
+// "..data" directories of those mounts which would load every file twice.
+func walkConfigDir(root string, fn func(path string, info os.FileInfo) error) error {
+	return walkConfigDirSeen(root, fn, map[string]bool{})
+}
+
+// walkConfigDirSeen walks the directory dir. Seen holds the resolved paths of
+// the directories being walked, to stop at symlink loops.
+func walkConfigDirSeen(dir string, fn func(path string, info os.FileInfo) error, seen map[string]bool) error {
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if seen[real] {
+		namedLogger("parse").Debug("skipping directory symlink loop", "path", dir)
+		return nil
+	}
+	seen[real] = true
+	defer delete(seen, real)
+
+	// ReadDir sorts the entries by name
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Wrap(err, "failed listing dir: "+dir)
+	}
+
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		info := entry
+		if entry.Mode()&os.ModeSymlink != 0 {
+			if info, err = os.Stat(path); err != nil {
 				return err
 			}
-			c = c.Merge(newConfig)
-
-			return nil
-		})
+		}
 
-		if err != nil {
-			return nil, errors.Wrap(err, "walk error")
+		if err := fn(path, info); err != nil {
+			return err
 		}
+		if info.IsDir() {
+			if err := walkConfigDirSeen(path, fn, seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-		return c, nil
-	} else if stat.Mode().IsRegular() {
-		return FromFile(path)
+// isConfigFile returns whether a file in a config directory is loaded: files
+// with a known config extension or without an extension, except backups.
+func isConfigFile(path string) bool {
+	if strings.HasSuffix(path, "~") {
+		return false
 	}
+	_, ok := formatFromPath(path)
+	return ok || filepath.Ext(path) == ""
+}
 
-	return nil, fmt.Errorf("unknown filetype: %q", stat.Mode().String())
+// hasGlobMeta returns whether the path contains glob pattern characters.
+func hasGlobMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[`)
 }
 
 // GoString defines the printable version of this struct.
@@ -495,35 +904,59 @@ func (c *Config) GoString() string {
 	}
 
 	return fmt.Sprintf("&Config{"+
+		"Audit:%s, "+
+		"ConfigWatch:%s, "+
 		"Consul:%s, "+
 		"Exec:%s, "+
+		"Init:%s, "+
 		"KillSignal:%s, "+
+		"Listeners:%s, "+
+		"LogEnvValues:%s, "+
+		"LogFile:%s, "+
+		"LogFormat:%s, "+
 		"LogLevel:%s, "+
+		"LogReopenSignal:%s, "+
 		"MaxStale:%s, "+
+		"Meta:%s, "+
 		"PidFile:%s, "+
 		"Prefixes:%s, "+
 		"Pristine:%s, "+
+		"Profile:%s, "+
+		"Profiles:%s, "+
 		"ReloadSignal:%s, "+
 		"Sanitize:%s, "+
 		"Secrets:%s, "+
 		"Services:%s, "+
+		"StatusFile:%s, "+
 		"Syslog:%s, "+
 		"Upcase:%s, "+
 		"Vault:%s, "+
 		"Wait:%s"+
 		"}",
+		c.Audit.GoString(),
+		c.ConfigWatch.GoString(),
 		c.Consul.GoString(),
 		c.Exec.GoString(),
+		config.BoolGoString(c.Init),
 		config.SignalGoString(c.KillSignal),
+		c.Listeners.GoString(),
+		config.BoolGoString(c.LogEnvValues),
+		config.StringGoString(c.LogFile),
+		config.StringGoString(c.LogFormat),
 		config.StringGoString(c.LogLevel),
+		config.SignalGoString(c.LogReopenSignal),
 		config.TimeDurationGoString(c.MaxStale),
+		c.Meta.GoString(),
 		config.StringGoString(c.PidFile),
 		c.Prefixes.GoString(),
 		config.BoolGoString(c.Pristine),
+		config.StringGoString(c.Profile),
+		profilesGoString(c.Profiles),
 		config.SignalGoString(c.ReloadSignal),
 		config.BoolGoString(c.Sanitize),
 		c.Secrets.GoString(),
 		c.Services.GoString(),
+		config.StringGoString(c.StatusFile),
 		c.Syslog.GoString(),
 		config.BoolGoString(c.Upcase),
 		c.Vault.GoString(),
@@ -535,14 +968,18 @@ func (c *Config) GoString() string {
 // variables may be set which control the values for the default configuration.
 func DefaultConfig() *Config {
 	return &Config{
-		Consul:   config.DefaultConsulConfig(),
-		Exec:     config.DefaultExecConfig(),
-		Prefixes: DefaultPrefixConfigs(),
-		Secrets:  DefaultPrefixConfigs(),
-		Services: DefaultServiceConfigs(),
-		Syslog:   config.DefaultSyslogConfig(),
-		Vault:    config.DefaultVaultConfig(),
-		Wait:     config.DefaultWaitConfig(),
+		Audit:       DefaultAuditConfig(),
+		ConfigWatch: DefaultConfigWatchConfig(),
+		Consul:      config.DefaultConsulConfig(),
+		Exec:        DefaultExecConfig(),
+		Listeners:   DefaultListenConfigs(),
+		Meta:        DefaultMetaConfigs(),
+		Prefixes:    DefaultPrefixConfigs(),
+		Secrets:     DefaultPrefixConfigs(),
+		Services:    DefaultServiceConfigs(),
+		Syslog:      config.DefaultSyslogConfig(),
+		Vault:       config.DefaultVaultConfig(),
+		Wait:        config.DefaultWaitConfig(),
 	}
 }
 
@@ -552,16 +989,30 @@ func DefaultConfig() *Config {
 // data was given, but the user did not explicitly add "Enabled: true" to the
 // configuration.
 func (c *Config) Finalize() {
+	if c.Audit == nil {
+		c.Audit = DefaultAuditConfig()
+	}
+	c.Audit.Finalize()
+
+	if c.ConfigWatch == nil {
+		c.ConfigWatch = DefaultConfigWatchConfig()
+	}
+	c.ConfigWatch.Finalize()
+
 	if c.Consul == nil {
 		c.Consul = config.DefaultConsulConfig()
 	}
 	c.Consul.Finalize()
 
 	if c.Exec == nil {
-		c.Exec = config.DefaultExecConfig()
+		c.Exec = DefaultExecConfig()
 	}
 	c.Exec.Finalize()
 
+	if c.Init == nil {
+		c.Init = config.Bool(false)
+	}
+
 	if c.KillSignal == nil {
 		c.KillSignal = config.Signal(DefaultKillSignal)
 	}
@@ -573,10 +1024,38 @@ func (c *Config) Finalize() {
 		}, DefaultLogLevel)
 	}
 
+	if c.Listeners == nil {
+		c.Listeners = DefaultListenConfigs()
+	}
+	c.Listeners.Finalize()
+
+	if c.LogEnvValues == nil {
+		c.LogEnvValues = config.Bool(false)
+	}
+
+	if c.LogFile == nil {
+		c.LogFile = config.String("")
+	}
+
+	if c.LogFormat == nil {
+		c.LogFormat = stringFromEnv([]string{
+			"ENVCONSUL_LOG_FORMAT",
+		}, DefaultLogFormat)
+	}
+
+	if c.LogReopenSignal == nil {
+		c.LogReopenSignal = config.Signal(DefaultLogReopenSignal)
+	}
+
 	if c.MaxStale == nil {
 		c.MaxStale = config.TimeDuration(DefaultMaxStale)
 	}
 
+	if c.Meta == nil {
+		c.Meta = DefaultMetaConfigs()
+	}
+	c.Meta.Finalize()
+
 	if c.Prefixes == nil {
 		c.Prefixes = DefaultPrefixConfigs()
 	}
@@ -590,6 +1069,10 @@ func (c *Config) Finalize() {
 		c.Pristine = config.Bool(false)
 	}
 
+	if c.Profile == nil {
+		c.Profile = stringFromEnv([]string{"ENVCONSUL_PROFILE"}, "")
+	}
+
 	if c.ReloadSignal == nil {
 		c.ReloadSignal = config.Signal(DefaultReloadSignal)
 	}
@@ -608,6 +1091,10 @@ func (c *Config) Finalize() {
 	}
 	c.Services.Finalize()
 
+	if c.StatusFile == nil {
+		c.StatusFile = config.String("")
+	}
+
 	if c.Syslog == nil {
 		c.Syslog = config.DefaultSyslogConfig()
 	}
@@ -671,6 +1158,71 @@ func boolFromEnv(list []string, def bool) *bool {
 	return config.Bool(def)
 }
 
+// formatFromPath returns the config format for the extension of the given
+// path, and false if the extension is not a known config file extension.
+func formatFromPath(path string) (string, bool) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".hcl":
+		return FormatHCL, true
+	case ".json":
+		return FormatJSON, true
+	case ".yaml", ".yml":
+		return FormatYAML, true
+	}
+	return "", false
+}
+
+// yamlToHCL converts a decoded YAML document into the structure hcl.Decode
+// produces: maps have string keys and, except for the root, every map is
+// wrapped in a list like an HCL block, so the same flattening applies.
+func yamlToHCL(v interface{}, root bool) interface{} {
+	switch typed := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(typed))
+		for k, v := range typed {
+			m[fmt.Sprint(k)] = yamlToHCL(v, false)
+		}
+		if root {
+			return m
+		}
+		return []map[string]interface{}{m}
+	case []interface{}:
+		// A list of maps is a repeated block, which HCL represents as a single
+		// list of maps.
+		blocks := make([]map[string]interface{}, 0, len(typed))
+		list := make([]interface{}, len(typed))
+		for i, v := range typed {
+			list[i] = yamlToHCL(v, false)
+			if b, ok := list[i].([]map[string]interface{}); ok {
+				blocks = append(blocks, b...)
+			}
+		}
+		if len(typed) > 0 && len(blocks) == len(typed) {
+			return blocks
+		}
+		return list
+	}
+	return v
+}
+
+// stringifyNumbers replaces the numbers among the values of m by their string
+// representation, for the fields that accept either.
+func stringifyNumbers(m map[string]interface{}) {
+	for k, v := range m {
+		m[k] = stringifyNumber(v)
+	}
+}
+
+func stringifyNumber(v interface{}) interface{} {
+	switch typed := v.(type) {
+	case int, int64:
+		return fmt.Sprint(typed)
+	case float64:
+		return strconv.FormatFloat(typed, 'f', -1, 64)
+	}
+	return v
+}
+
 // flattenKeys is a function that takes a map[string]interface{} and recursively
 // flattens any keys that are a []map[string]interface{} where the key is in the
 // given list of keys.
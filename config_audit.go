@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+// AuditConfig is the configuration for the audit log of the changes to the
+// environment of the child process.
+type AuditConfig struct {
+	// Enabled turns the audit log on. It defaults to true when a path is given.
+	Enabled *bool `mapstructure:"enabled"`
+
+	// Path is the file the audit records are appended to.
+	Path *string `mapstructure:"path"`
+
+	// HMACKey is the key to chain the audit records with HMAC-SHA256, so that
+	// changed or removed records are detected. It is also used to hash the
+	// values, which are hashed with a random salt of the file without it.
+	HMACKey *string `mapstructure:"hmac_key" json:"-"`
+}
+
+func DefaultAuditConfig() *AuditConfig {
+	return &AuditConfig{}
+}
+
+func (c *AuditConfig) Copy() *AuditConfig {
+	if c == nil {
+		return nil
+	}
+
+	return &AuditConfig{
+		Enabled: c.Enabled,
+		Path:    c.Path,
+		HMACKey: c.HMACKey,
+	}
+}
+
+func (c *AuditConfig) Merge(o *AuditConfig) *AuditConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.Enabled != nil {
+		r.Enabled = o.Enabled
+	}
+
+	if o.Path != nil {
+		r.Path = o.Path
+	}
+
+	if o.HMACKey != nil {
+		r.HMACKey = o.HMACKey
+	}
+
+	return r
+}
+
+func (c *AuditConfig) Finalize() {
+	if c.Path == nil {
+		c.Path = config.String("")
+	}
+
+	if c.HMACKey == nil {
+		c.HMACKey = config.String("")
+	}
+
+	if c.Enabled == nil {
+		c.Enabled = config.Bool(config.StringPresent(c.Path))
+	}
+}
+
+func (c *AuditConfig) GoString() string {
+	if c == nil {
+		return "(*AuditConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&AuditConfig{"+
+		"Enabled:%s, "+
+		"Path:%s, "+
+		"HMACKey:%s"+
+		"}",
+		config.BoolGoString(c.Enabled),
+		config.StringGoString(c.Path),
+		config.StringGoString(c.HMACKey),
+	)
+}
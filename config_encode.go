@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/consul-template/signals"
+	"gopkg.in/yaml.v2"
+)
+
+// redactedKeys are the dotted paths of the configuration values that are
+// replaced by redactedValue when encoding a config with redaction.
+var redactedKeys = map[string]bool{
+	"audit.hmac_key":                  true,
+	"consul.auth.password":            true,
+	"consul.token":                    true,
+	"vault.k8s_service_account_token": true,
+	"vault.token":                     true,
+}
+
+const redactedValue = "<redacted>"
+
+// configField is a key and its value in an encoded config block. The value is
+// a string, bool, int, float64, []string, configBlock or []configBlock.
+type configField struct {
+	key   string
+	value interface{}
+}
+
+// configBlock is an encoded config block, with its fields in the order of the
+// struct they are decoded into.
+type configBlock []configField
+
+// EncodeConfig encodes the config in the given format, so that parsing the
+// result gives back an equivalent config. Unset values are left out. If
+// redact is true, tokens and passwords are replaced by a placeholder.
+func EncodeConfig(c *Config, format string, redact bool) ([]byte, error) {
+	root := encodeBlock(reflect.ValueOf(c).Elem(), "", redact)
+
+	// Profiles are blocks of named configs, see decodeProfiles
+	if len(c.Profiles) > 0 {
+		names := make([]string, 0, len(c.Profiles))
+		for name := range c.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		profiles := make(configBlock, len(names))
+		for i, name := range names {
+			profiles[i] = configField{
+				key:   name,
+				value: encodeBlock(reflect.ValueOf(c.Profiles[name]).Elem(), "", redact),
+			}
+		}
+		root = append(root, configField{key: "profile", value: profiles})
+	}
+
+	switch format {
+	case FormatHCL:
+		var buf bytes.Buffer
+		writeHCL(&buf, root, 0)
+		return buf.Bytes(), nil
+	case FormatJSON:
+		b, err := json.MarshalIndent(root, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	case FormatYAML:
+		return yaml.Marshal(root.mapSlice())
+	default:
+		return nil, fmt.Errorf("unknown config format %q", format)
+	}
+}
+
+// encodeBlock encodes the fields of a config struct that are decoded by
+// mapstructure.
+func encodeBlock(v reflect.Value, parent string, redact bool) configBlock {
+	var b configBlock
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if squashed(t.Field(i)) {
+			b = append(b, encodeBlock(v.Field(i), parent, redact)...)
+			continue
+		}
+		tag := configKey(t.Field(i))
+		if tag == "" {
+			continue
+		}
+		path := tag
+		if parent != "" {
+			path = parent + "." + tag
+		}
+
+		value := encodeValue(v.Field(i), path, redact)
+		if value == nil {
+			continue
+		}
+		if s, ok := value.(string); ok && s != "" && redact && redactedKeys[path] {
+			value = redactedValue
+		}
+		b = append(b, configField{key: tag, value: value})
+	}
+
+	return b
+}
+
+// encodeValue encodes a single config value, returning nil for unset values,
+// empty lists and empty blocks.
+func encodeValue(v reflect.Value, path string, redact bool) interface{} {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return nil
+		}
+	}
+
+	switch i := v.Interface().(type) {
+	case *config.WaitConfig:
+		// The wait block is decoded from a "min:max" string
+		if i.Min == nil {
+			return nil
+		}
+		return fmt.Sprintf("%s:%s", config.TimeDurationVal(i.Min),
+			config.TimeDurationVal(i.Max))
+	case *time.Duration:
+		return i.String()
+	case *os.Signal:
+		return signalName(*i)
+	}
+
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Int, reflect.Int64:
+		return int(v.Int())
+	case reflect.Float64:
+		return v.Float()
+	case reflect.Struct:
+		if b := encodeBlock(v, path, redact); len(b) > 0 {
+			return b
+		}
+		return nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String {
+			s := make([]string, v.Len())
+			for j := range s {
+				s[j] = v.Index(j).String()
+			}
+			return s
+		}
+
+		var blocks []configBlock
+		for j := 0; j < v.Len(); j++ {
+			e := v.Index(j)
+			if e.IsNil() {
+				continue
+			}
+			blocks = append(blocks, encodeBlock(e.Elem(), path, redact))
+		}
+		if len(blocks) == 0 {
+			return nil
+		}
+		return blocks
+	}
+
+	return nil
+}
+
+// signalName returns the name a signal is parsed from. The null signal is the
+// empty string.
+func signalName(s os.Signal) string {
+	if s == nil || s == signals.SIGNULL {
+		return ""
+	}
+
+	// Some signals have several names, pick the same one every time
+	names := make([]string, 0, len(signals.SignalLookup))
+	for name := range signals.SignalLookup {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if signals.SignalLookup[name] == s {
+			return name
+		}
+	}
+	return s.String()
+}
+
+// MarshalJSON encodes the block as a JSON object, keeping the field order.
+func (b configBlock) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range b {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(f.key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// mapSlice converts the block for YAML encoding, keeping the field order.
+func (b configBlock) mapSlice() yaml.MapSlice {
+	m := make(yaml.MapSlice, len(b))
+	for i, f := range b {
+		v := f.value
+		switch typed := v.(type) {
+		case configBlock:
+			v = typed.mapSlice()
+		case []configBlock:
+			l := make([]yaml.MapSlice, len(typed))
+			for j, e := range typed {
+				l[j] = e.mapSlice()
+			}
+			v = l
+		}
+		m[i] = yaml.MapItem{Key: f.key, Value: v}
+	}
+	return m
+}
+
+// writeHCL writes the block as HCL at the given indentation level. Lists of
+// blocks are written as repeated blocks.
+func writeHCL(buf *bytes.Buffer, b configBlock, level int) {
+	indent := strings.Repeat("  ", level)
+
+	prevBlock := false
+	for i, f := range b {
+		var blocks []configBlock
+		switch v := f.value.(type) {
+		case configBlock:
+			blocks = []configBlock{v}
+		case []configBlock:
+			blocks = v
+		}
+		isBlock := blocks != nil
+
+		// Separate top-level blocks from the values around them
+		if level == 0 && i > 0 && (isBlock || prevBlock) {
+			buf.WriteByte('\n')
+		}
+		prevBlock = isBlock
+
+		if !isBlock {
+			fmt.Fprintf(buf, "%s%s = %s\n", indent, f.key, hclValue(f.value))
+			continue
+		}
+
+		// Profiles are written as labeled blocks
+		if level == 0 && f.key == "profile" {
+			for j, p := range blocks[0] {
+				if j > 0 {
+					buf.WriteByte('\n')
+				}
+				fmt.Fprintf(buf, "profile %s {\n", strconv.Quote(p.key))
+				body, _ := p.value.(configBlock)
+				writeHCL(buf, body, level+1)
+				buf.WriteString("}\n")
+			}
+			continue
+		}
+
+		for j, e := range blocks {
+			if level == 0 && j > 0 {
+				buf.WriteByte('\n')
+			}
+			fmt.Fprintf(buf, "%s%s {\n", indent, f.key)
+			writeHCL(buf, e, level+1)
+			fmt.Fprintf(buf, "%s}\n", indent)
+		}
+	}
+}
+
+// hclValue formats a scalar or list value as HCL.
+func hclValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return strconv.Quote(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []string:
+		s := make([]string, len(v))
+		for i, e := range v {
+			s[i] = strconv.Quote(e)
+		}
+		return "[" + strings.Join(s, ", ") + "]"
+	}
+	return fmt.Sprintf("%v", v)
+}
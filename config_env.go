@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+)
+
+// envRefPattern matches the environment variable references in config
+// strings: "${VAR}", "${VAR:-default}", "${VAR-default}", `{{ env "VAR" }}`,
+// `{{ env "VAR" "default" }}` and the "$${" escape for a literal "${".
+var envRefPattern = regexp.MustCompile(
+	`\$\$\{` +
+		`|\$\{([A-Za-z_][A-Za-z0-9_]*)(?:(:?-)([^}]*))?\}` +
+		`|\{\{-?\s*env\s+("(?:[^"\\]|\\.)*")(?:\s+("(?:[^"\\]|\\.)*"))?\s*-?\}\}`)
+
+// interpolateEnv replaces the environment variable references in every string
+// of the config. It returns an error naming the config key if a referenced
+// variable is not set and has no default.
+func interpolateEnv(c *Config) error {
+	if c == nil {
+		return nil
+	}
+	return interpolateValue(reflect.ValueOf(c).Elem(), "")
+}
+
+func interpolateValue(v reflect.Value, path string) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		// Replace strings instead of changing them in place, the pointers may
+		// be shared with other configs.
+		if v.Elem().Kind() == reflect.String {
+			s, err := expandEnvRefs(v.Elem().String())
+			if err != nil {
+				return fmt.Errorf("%s: %s", path, err)
+			}
+			v.Set(reflect.ValueOf(&s).Convert(v.Type()))
+			return nil
+		}
+		return interpolateValue(v.Elem(), path)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if squashed(t.Field(i)) {
+				if err := interpolateValue(v.Field(i), path); err != nil {
+					return err
+				}
+				continue
+			}
+			key := configKey(t.Field(i))
+			if key == "" {
+				continue
+			}
+			if path != "" {
+				key = path + "." + key
+			}
+			if err := interpolateValue(v.Field(i), key); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := interpolateValue(v.Index(i), path); err != nil {
+				return err
+			}
+		}
+	case reflect.String:
+		s, err := expandEnvRefs(v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		v.SetString(s)
+	}
+	return nil
+}
+
+// expandEnvRefs replaces the environment variable references in s.
+func expandEnvRefs(s string) (string, error) {
+	var err error
+	r := envRefPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		m := envRefPattern.FindStringSubmatch(ref)
+
+		// ${VAR}, with "-" using the default if VAR is unset and ":-" if it
+		// is unset or empty
+		if m[1] != "" {
+			value, ok := os.LookupEnv(m[1])
+			switch {
+			case m[2] == ":-" && value == "", m[2] == "-" && !ok:
+				return m[3]
+			case !ok && err == nil:
+				err = fmt.Errorf("environment variable %q is not set, "+
+					"write \"$${%s}\" for a literal reference", m[1], m[1])
+			}
+			return value
+		}
+
+		// {{ env "VAR" }}, with an optional default if VAR is unset
+		name, qerr := strconv.Unquote(m[4])
+		if qerr != nil {
+			return ref
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			return value
+		}
+		if m[5] != "" {
+			if def, qerr := strconv.Unquote(m[5]); qerr == nil {
+				return def
+			}
+		}
+		if err == nil {
+			err = fmt.Errorf("environment variable %q is not set", name)
+		}
+		return ""
+	})
+	return r, err
+}
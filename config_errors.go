@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	hclParser "github.com/hashicorp/hcl/hcl/parser"
+	"github.com/hashicorp/hcl/hcl/token"
+	jsonParser "github.com/hashicorp/hcl/json/parser"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// ParseError is an error in a configuration file, with the position of the
+// offending key when it is known.
+type ParseError struct {
+	// File is the path of the configuration file, empty when parsing a string.
+	File string
+
+	// Line and Column are the position of the error, zero when unknown.
+	Line   int
+	Column int
+
+	Err error
+
+	// key is the mapstructure path of the key that failed to decode, like
+	// "prefix[0].format", to find its position.
+	key string
+}
+
+func (e *ParseError) Error() string {
+	if pos := e.pos(); pos != "" {
+		return pos + ": " + e.Err.Error()
+	}
+	return e.Err.Error()
+}
+
+// pos returns the position of the error as "file:line:col", leaving out the
+// parts that are unknown.
+func (e *ParseError) pos() string {
+	var pos []string
+	if e.File != "" {
+		pos = append(pos, e.File)
+	}
+	if e.Line > 0 {
+		pos = append(pos, strconv.Itoa(e.Line))
+		if e.Column > 0 {
+			pos = append(pos, strconv.Itoa(e.Column))
+		}
+	}
+	return strings.Join(pos, ":")
+}
+
+// Cause returns the underlying error, for errors.Cause.
+func (e *ParseError) Cause() error {
+	return e.Err
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// yamlErrorPattern matches the line in the errors of the YAML parser.
+var yamlErrorPattern = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// syntaxError returns a ParseError with the position of a syntax error, when
+// the parser reports one.
+func syntaxError(err error) error {
+	if e, ok := err.(*hclParser.PosError); ok {
+		return &ParseError{Line: e.Pos.Line, Column: e.Pos.Column, Err: e.Err}
+	}
+	if m := yamlErrorPattern.FindStringSubmatch(err.Error()); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return &ParseError{Line: line, Err: errors.New(m[2])}
+	}
+	return errors.Wrap(err, "error decoding config")
+}
+
+// mapstructureKeyPattern matches the key in mapstructure errors, like
+// "'consul.address' expected type 'string'".
+var mapstructureKeyPattern = regexp.MustCompile(`'([^']+)'`)
+
+// decodeError returns a ParseError for a mapstructure error, with the key of
+// the first error to find its position.
+func decodeError(err error) error {
+	e, ok := err.(*mapstructure.Error)
+	if !ok || len(e.Errors) == 0 {
+		return errors.Wrap(err, "mapstructure decode failed")
+	}
+
+	pe := &ParseError{Err: errors.New(strings.Join(e.Errors, "; "))}
+	if m := mapstructureKeyPattern.FindStringSubmatch(e.Errors[0]); m != nil {
+		pe.key = m[1]
+	}
+	return pe
+}
+
+// locateError adds the position in the contents of a config to an error from
+// decode. Unknown keys are found by walking the file, which also suggests the
+// key that was likely meant.
+func locateError(err error, contents []byte, format string) error {
+	root, withPos, perr := parseAST(contents, format)
+	if perr != nil || root == nil {
+		return err
+	}
+	list, ok := root.Node.(*ast.ObjectList)
+	if !ok {
+		return err
+	}
+
+	var positions map[string]token.Pos
+	if format == FormatJSON {
+		positions = jsonKeyPositions(contents)
+	}
+
+	var v validator
+	w := &fileWalker{validator: &v, withPos: withPos, positions: positions}
+	w.walk(list, reflect.TypeOf(Config{}), "", "")
+	for _, i := range v.issues {
+		if i.Error {
+			return &ParseError{Line: i.line, Column: i.column, Err: errors.New(i.Message)}
+		}
+	}
+
+	pe, ok := err.(*ParseError)
+	if !ok || pe.key == "" || !withPos {
+		return err
+	}
+
+	var p token.Pos
+	switch format {
+	case FormatHCL:
+		p = hclKeyPos(list, pe.key)
+	case FormatJSON:
+		p = positions[indexedKey(pe.key)]
+	}
+	pe.Line, pe.Column = p.Line, p.Column
+	return pe
+}
+
+// parseAST parses the contents of a config file into an HCL AST. YAML has no
+// AST with positions, so it is converted to the same structure as JSON and
+// withPos is false.
+func parseAST(contents []byte, format string) (root *ast.File, withPos bool, err error) {
+	switch format {
+	case FormatHCL:
+		root, err = hcl.Parse(string(contents))
+		return root, true, err
+	case FormatJSON:
+		root, err = jsonParser.Parse(contents)
+		return root, true, err
+	case FormatYAML:
+		var raw interface{}
+		if err := yaml.Unmarshal(contents, &raw); err != nil || raw == nil {
+			return nil, false, err
+		}
+		b, err := json.Marshal(yamlToHCL(raw, true))
+		if err != nil {
+			return nil, false, err
+		}
+		root, err = jsonParser.Parse(b)
+		return root, false, err
+	}
+	return nil, false, fmt.Errorf("unknown config format %q", format)
+}
+
+// suggestKey returns the valid key closest to the unknown key name, or an
+// empty string if none is close enough to be a typo.
+func suggestKey(name string, keys map[string]reflect.Type) string {
+	name = strings.ToLower(name)
+	max := len(name) / 3
+	if max < 1 {
+		max = 1
+	}
+
+	var best string
+	bestD := max + 1
+	for key := range keys {
+		d := editDistance(name, key)
+		if d < bestD || d == bestD && key < best {
+			best, bestD = key, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the number of single character insertions, deletions,
+// substitutions and transpositions to turn a into b.
+func editDistance(a, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = minInt(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = minInt(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+func minInt(v int, vs ...int) int {
+	for _, o := range vs {
+		if o < v {
+			v = o
+		}
+	}
+	return v
+}
+
+// indexedKey converts a mapstructure key path to the form used to find key
+// positions, where every block has an index: "consul.retry.attempts" is
+// "consul[0].retry[0].attempts" and "exec.env.allowlist[0]" is
+// "exec[0].env[0].allowlist".
+func indexedKey(key string) string {
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		if i == len(parts)-1 {
+			if j := strings.Index(part, "["); j >= 0 {
+				parts[i] = part[:j]
+			}
+		} else if !strings.Contains(part, "[") {
+			parts[i] = part + "[0]"
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// splitIndex splits a key path segment like "prefix[1]" into its name and
+// index.
+func splitIndex(part string) (string, int) {
+	i := strings.Index(part, "[")
+	if i < 0 {
+		return part, 0
+	}
+	idx, _ := strconv.Atoi(strings.TrimSuffix(part[i+1:], "]"))
+	return part[:i], idx
+}
+
+// hclKeyPos returns the position of the key at the given mapstructure path in
+// an HCL AST, or of the closest parent found. Labeled blocks match one path
+// segment per key.
+func hclKeyPos(list *ast.ObjectList, key string) token.Pos {
+	var pos token.Pos
+	parts := strings.Split(key, ".")
+
+	for len(parts) > 0 {
+		var next *ast.ObjectList
+		var consumed, n int
+
+		for _, item := range list.Items {
+			idx, ok := matchKeys(item, parts)
+			if !ok {
+				continue
+			}
+
+			objs := objectValues(item.Val)
+			if len(objs) == 0 {
+				// A value, not a block
+				if len(item.Keys) == len(parts) {
+					return item.Keys[0].Pos()
+				}
+				continue
+			}
+			for _, obj := range objs {
+				if n == idx && next == nil {
+					pos, next, consumed = item.Keys[0].Pos(), obj.List, len(item.Keys)
+				}
+				n++
+			}
+		}
+
+		if next == nil {
+			return pos
+		}
+		list, parts = next, parts[consumed:]
+	}
+	return pos
+}
+
+// matchKeys returns whether the keys of the item match the first segments of
+// the path, and the index of the last matched segment.
+func matchKeys(item *ast.ObjectItem, parts []string) (int, bool) {
+	if len(item.Keys) == 0 || len(item.Keys) > len(parts) {
+		return 0, false
+	}
+
+	var idx int
+	for i, k := range item.Keys {
+		var name string
+		name, idx = splitIndex(parts[i])
+		if v, _ := k.Token.Value().(string); !strings.EqualFold(v, name) {
+			return 0, false
+		}
+	}
+	return idx, true
+}
+
+// jsonKeyPositions returns the positions of the keys of a JSON config by their
+// path, where every object has an index like "prefix[1].format". The HCL JSON
+// parser does not keep positions.
+func jsonKeyPositions(data []byte) map[string]token.Pos {
+	positions := make(map[string]token.Pos)
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	var walkObject, walkArray func(path string) error
+
+	walkObject = func(prefix string) error {
+		for dec.More() {
+			offset := int(dec.InputOffset())
+			t, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			key, _ := t.(string)
+			path := key
+			if prefix != "" {
+				path = prefix + "." + key
+			}
+			if _, ok := positions[path]; !ok {
+				positions[path] = offsetPos(data, offset)
+			}
+
+			if t, err = dec.Token(); err != nil {
+				return err
+			}
+			switch t {
+			case json.Delim('{'):
+				err = walkObject(path + "[0]")
+			case json.Delim('['):
+				err = walkArray(path)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		_, err := dec.Token()
+		return err
+	}
+
+	walkArray = func(path string) error {
+		for i := 0; dec.More(); i++ {
+			t, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			switch t {
+			case json.Delim('{'):
+				err = walkObject(fmt.Sprintf("%s[%d]", path, i))
+			case json.Delim('['):
+				err = walkArray(fmt.Sprintf("%s[%d]", path, i))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		_, err := dec.Token()
+		return err
+	}
+
+	if t, err := dec.Token(); err == nil && t == json.Delim('{') {
+		walkObject("")
+	}
+	return positions
+}
+
+// offsetPos returns the position of the first token at or after the offset,
+// skipping the separators before it.
+func offsetPos(data []byte, offset int) token.Pos {
+	for offset < len(data) && strings.IndexByte(" \t\r\n,:", data[offset]) >= 0 {
+		offset++
+	}
+
+	pos := token.Pos{Offset: offset, Line: 1, Column: 1}
+	for _, b := range data[:offset] {
+		if b == '\n' {
+			pos.Line++
+			pos.Column = 1
+		} else {
+			pos.Column++
+		}
+	}
+	return pos
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+const (
+	// DefaultHookTimeout is the default time a hook command may run before it
+	// is killed.
+	DefaultHookTimeout = 5 * time.Minute
+
+	// DefaultReadyTimeout is the default time a new child process has to get
+	// ready before it is stopped.
+	DefaultReadyTimeout = 30 * time.Second
+
+	// DefaultReadyInterval is the default time between two ready checks.
+	DefaultReadyInterval = 1 * time.Second
+)
+
+// Strategies to replace the child process when the environment changes.
+const (
+	// ReplaceStopFirst stops the current child before starting the new one.
+	ReplaceStopFirst = "stop_first"
+
+	// ReplaceStartFirst starts the new child next to the current one, and
+	// stops the current one once the new one is ready.
+	ReplaceStartFirst = "start_first"
+)
+
+// ExecConfig is the configuration for exec/supervise mode. It extends the
+// exec configuration of consul-template with the options only envconsul has.
+type ExecConfig struct {
+	config.ExecConfig `mapstructure:",squash"`
+
+	// Hooks are the commands run around the start of the child process.
+	Hooks *HooksConfig `mapstructure:"hooks"`
+
+	// ReplaceStrategy is how the child process is replaced when the
+	// environment changes, ReplaceStopFirst or ReplaceStartFirst.
+	ReplaceStrategy *string `mapstructure:"replace_strategy"`
+
+	// Ready is the check that a new child process is ready, for the
+	// ReplaceStartFirst strategy.
+	Ready *ReadyConfig `mapstructure:"ready"`
+
+	// User is the name or uid of the user the child process runs as, while
+	// envconsul keeps its own credentials.
+	User *string `mapstructure:"user"`
+
+	// Group is the name or gid of the group the child process runs as,
+	// defaulting to the primary group of User.
+	Group *string `mapstructure:"group"`
+
+	// Groups are the supplementary groups of the child process, defaulting to
+	// the groups User is a member of.
+	Groups []string `mapstructure:"groups"`
+
+	// Umask is the file mode creation mask of the child process, in octal.
+	Umask *string `mapstructure:"umask"`
+
+	// WorkingDir is the working directory of the child process.
+	WorkingDir *string `mapstructure:"working_dir"`
+
+	// NoNewPrivs keeps the child process and its own children from gaining
+	// privileges through setuid binaries or file capabilities. Linux only.
+	NoNewPrivs *bool `mapstructure:"no_new_privs"`
+
+	// Limits are the resource limits of the child process. Linux only.
+	Limits *LimitsConfig `mapstructure:"limits"`
+
+	// Stdout and Stderr are where the output of the child process goes.
+	Stdout *OutputConfig `mapstructure:"stdout"`
+	Stderr *OutputConfig `mapstructure:"stderr"`
+}
+
+func DefaultExecConfig() *ExecConfig {
+	return &ExecConfig{
+		ExecConfig: *config.DefaultExecConfig(),
+		Hooks:      DefaultHooksConfig(),
+		Ready:      DefaultReadyConfig(),
+		Limits:     DefaultLimitsConfig(),
+		Stdout:     DefaultOutputConfig(),
+		Stderr:     DefaultOutputConfig(),
+	}
+}
+
+func (c *ExecConfig) Copy() *ExecConfig {
+	if c == nil {
+		return nil
+	}
+
+	o := &ExecConfig{
+		ExecConfig:      *c.ExecConfig.Copy(),
+		Hooks:           c.Hooks.Copy(),
+		ReplaceStrategy: c.ReplaceStrategy,
+		Ready:           c.Ready.Copy(),
+		User:            c.User,
+		Group:           c.Group,
+		Umask:           c.Umask,
+		WorkingDir:      c.WorkingDir,
+		NoNewPrivs:      c.NoNewPrivs,
+		Limits:          c.Limits.Copy(),
+		Stdout:          c.Stdout.Copy(),
+		Stderr:          c.Stderr.Copy(),
+	}
+
+	if c.Groups != nil {
+		o.Groups = append([]string{}, c.Groups...)
+	}
+
+	return o
+}
+
+func (c *ExecConfig) Merge(o *ExecConfig) *ExecConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	r.ExecConfig = *r.ExecConfig.Merge(&o.ExecConfig)
+
+	if o.Hooks != nil {
+		r.Hooks = r.Hooks.Merge(o.Hooks)
+	}
+
+	if o.ReplaceStrategy != nil {
+		r.ReplaceStrategy = o.ReplaceStrategy
+	}
+
+	if o.Ready != nil {
+		r.Ready = r.Ready.Merge(o.Ready)
+	}
+
+	if o.User != nil {
+		r.User = o.User
+	}
+
+	if o.Group != nil {
+		r.Group = o.Group
+	}
+
+	if o.Groups != nil {
+		r.Groups = append([]string{}, o.Groups...)
+	}
+
+	if o.Umask != nil {
+		r.Umask = o.Umask
+	}
+
+	if o.WorkingDir != nil {
+		r.WorkingDir = o.WorkingDir
+	}
+
+	if o.NoNewPrivs != nil {
+		r.NoNewPrivs = o.NoNewPrivs
+	}
+
+	if o.Limits != nil {
+		r.Limits = r.Limits.Merge(o.Limits)
+	}
+
+	if o.Stdout != nil {
+		r.Stdout = r.Stdout.Merge(o.Stdout)
+	}
+
+	if o.Stderr != nil {
+		r.Stderr = r.Stderr.Merge(o.Stderr)
+	}
+
+	return r
+}
+
+func (c *ExecConfig) Finalize() {
+	c.ExecConfig.Finalize()
+
+	if c.Hooks == nil {
+		c.Hooks = DefaultHooksConfig()
+	}
+	c.Hooks.Finalize()
+
+	if c.ReplaceStrategy == nil {
+		c.ReplaceStrategy = config.String(ReplaceStopFirst)
+	}
+
+	if c.Ready == nil {
+		c.Ready = DefaultReadyConfig()
+	}
+	c.Ready.Finalize()
+
+	if c.User == nil {
+		c.User = config.String("")
+	}
+
+	if c.Group == nil {
+		c.Group = config.String("")
+	}
+
+	if c.Groups == nil {
+		c.Groups = []string{}
+	}
+
+	if c.Umask == nil {
+		c.Umask = config.String("")
+	}
+
+	if c.WorkingDir == nil {
+		c.WorkingDir = config.String("")
+	}
+
+	if c.NoNewPrivs == nil {
+		c.NoNewPrivs = config.Bool(false)
+	}
+
+	if c.Limits == nil {
+		c.Limits = DefaultLimitsConfig()
+	}
+	c.Limits.Finalize()
+
+	if c.Stdout == nil {
+		c.Stdout = DefaultOutputConfig()
+	}
+	if c.Stdout.Tag == nil {
+		c.Stdout.Tag = config.String("stdout")
+	}
+	c.Stdout.Finalize()
+
+	if c.Stderr == nil {
+		c.Stderr = DefaultOutputConfig()
+	}
+	if c.Stderr.Tag == nil {
+		c.Stderr.Tag = config.String("stderr")
+	}
+	c.Stderr.Finalize()
+}
+
+func (c *ExecConfig) GoString() string {
+	if c == nil {
+		return "(*ExecConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&ExecConfig{"+
+		"ExecConfig:%s, "+
+		"Hooks:%s, "+
+		"ReplaceStrategy:%s, "+
+		"Ready:%s, "+
+		"User:%s, "+
+		"Group:%s, "+
+		"Groups:%v, "+
+		"Umask:%s, "+
+		"WorkingDir:%s, "+
+		"NoNewPrivs:%s, "+
+		"Limits:%s, "+
+		"Stdout:%s, "+
+		"Stderr:%s"+
+		"}",
+		c.ExecConfig.GoString(),
+		c.Hooks.GoString(),
+		config.StringGoString(c.ReplaceStrategy),
+		c.Ready.GoString(),
+		config.StringGoString(c.User),
+		config.StringGoString(c.Group),
+		c.Groups,
+		config.StringGoString(c.Umask),
+		config.StringGoString(c.WorkingDir),
+		config.BoolGoString(c.NoNewPrivs),
+		c.Limits.GoString(),
+		c.Stdout.GoString(),
+		c.Stderr.GoString(),
+	)
+}
+
+// HooksConfig is the configuration of the commands run with the environment
+// of the child process, around its start. The commands get the difference
+// from the previous environment in the ENVCONSUL_ENV_* variables.
+type HooksConfig struct {
+	// PreStart runs before the child is started or restarted. If it fails, the
+	// child is not restarted and the previous child keeps running.
+	PreStart *string `mapstructure:"pre_start"`
+
+	// PostStart runs after the child was started or restarted.
+	PostStart *string `mapstructure:"post_start"`
+
+	// OnChange runs after the child was restarted because the environment
+	// changed, but not on the first start.
+	OnChange *string `mapstructure:"on_change"`
+
+	// PreStop runs before the child is stopped, with its environment.
+	PreStop *string `mapstructure:"pre_stop"`
+
+	// Timeout is the time a hook command may run before it is killed.
+	Timeout *time.Duration `mapstructure:"timeout"`
+}
+
+func DefaultHooksConfig() *HooksConfig {
+	return &HooksConfig{}
+}
+
+func (c *HooksConfig) Copy() *HooksConfig {
+	if c == nil {
+		return nil
+	}
+
+	return &HooksConfig{
+		PreStart:  c.PreStart,
+		PostStart: c.PostStart,
+		OnChange:  c.OnChange,
+		PreStop:   c.PreStop,
+		Timeout:   c.Timeout,
+	}
+}
+
+func (c *HooksConfig) Merge(o *HooksConfig) *HooksConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.PreStart != nil {
+		r.PreStart = o.PreStart
+	}
+
+	if o.PostStart != nil {
+		r.PostStart = o.PostStart
+	}
+
+	if o.OnChange != nil {
+		r.OnChange = o.OnChange
+	}
+
+	if o.PreStop != nil {
+		r.PreStop = o.PreStop
+	}
+
+	if o.Timeout != nil {
+		r.Timeout = o.Timeout
+	}
+
+	return r
+}
+
+func (c *HooksConfig) Finalize() {
+	if c.PreStart == nil {
+		c.PreStart = config.String("")
+	}
+
+	if c.PostStart == nil {
+		c.PostStart = config.String("")
+	}
+
+	if c.OnChange == nil {
+		c.OnChange = config.String("")
+	}
+
+	if c.PreStop == nil {
+		c.PreStop = config.String("")
+	}
+
+	if c.Timeout == nil {
+		c.Timeout = config.TimeDuration(DefaultHookTimeout)
+	}
+}
+
+func (c *HooksConfig) GoString() string {
+	if c == nil {
+		return "(*HooksConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&HooksConfig{"+
+		"PreStart:%s, "+
+		"PostStart:%s, "+
+		"OnChange:%s, "+
+		"PreStop:%s, "+
+		"Timeout:%s"+
+		"}",
+		config.StringGoString(c.PreStart),
+		config.StringGoString(c.PostStart),
+		config.StringGoString(c.OnChange),
+		config.StringGoString(c.PreStop),
+		config.TimeDurationGoString(c.Timeout),
+	)
+}
+
+// ReadyConfig is the configuration of the check that a new child process is
+// ready to take over from the current one. All the checks given must pass.
+type ReadyConfig struct {
+	// TCP is an address the child accepts connections on once ready.
+	TCP *string `mapstructure:"tcp"`
+
+	// HTTP is a URL that responds with a 2xx status once the child is ready.
+	HTTP *string `mapstructure:"http"`
+
+	// Command is a command that exits successfully once the child is ready.
+	// It gets the environment of the child and its pid in ENVCONSUL_CHILD_PID.
+	Command *string `mapstructure:"command"`
+
+	// File is a file the child creates once ready. It is removed before a new
+	// child is started.
+	File *string `mapstructure:"file"`
+
+	// Timeout is the time the child has to get ready before it is stopped.
+	Timeout *time.Duration `mapstructure:"timeout"`
+
+	// Interval is the time between two checks.
+	Interval *time.Duration `mapstructure:"interval"`
+}
+
+func DefaultReadyConfig() *ReadyConfig {
+	return &ReadyConfig{}
+}
+
+func (c *ReadyConfig) Copy() *ReadyConfig {
+	if c == nil {
+		return nil
+	}
+
+	return &ReadyConfig{
+		TCP:      c.TCP,
+		HTTP:     c.HTTP,
+		Command:  c.Command,
+		File:     c.File,
+		Timeout:  c.Timeout,
+		Interval: c.Interval,
+	}
+}
+
+func (c *ReadyConfig) Merge(o *ReadyConfig) *ReadyConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.TCP != nil {
+		r.TCP = o.TCP
+	}
+
+	if o.HTTP != nil {
+		r.HTTP = o.HTTP
+	}
+
+	if o.Command != nil {
+		r.Command = o.Command
+	}
+
+	if o.File != nil {
+		r.File = o.File
+	}
+
+	if o.Timeout != nil {
+		r.Timeout = o.Timeout
+	}
+
+	if o.Interval != nil {
+		r.Interval = o.Interval
+	}
+
+	return r
+}
+
+func (c *ReadyConfig) Finalize() {
+	if c.TCP == nil {
+		c.TCP = config.String("")
+	}
+
+	if c.HTTP == nil {
+		c.HTTP = config.String("")
+	}
+
+	if c.Command == nil {
+		c.Command = config.String("")
+	}
+
+	if c.File == nil {
+		c.File = config.String("")
+	}
+
+	if c.Timeout == nil {
+		c.Timeout = config.TimeDuration(DefaultReadyTimeout)
+	}
+
+	if c.Interval == nil {
+		c.Interval = config.TimeDuration(DefaultReadyInterval)
+	}
+}
+
+// Empty reports whether no check is configured.
+func (c *ReadyConfig) Empty() bool {
+	return !config.StringPresent(c.TCP) && !config.StringPresent(c.HTTP) &&
+		!config.StringPresent(c.Command) && !config.StringPresent(c.File)
+}
+
+func (c *ReadyConfig) GoString() string {
+	if c == nil {
+		return "(*ReadyConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&ReadyConfig{"+
+		"TCP:%s, "+
+		"HTTP:%s, "+
+		"Command:%s, "+
+		"File:%s, "+
+		"Timeout:%s, "+
+		"Interval:%s"+
+		"}",
+		config.StringGoString(c.TCP),
+		config.StringGoString(c.HTTP),
+		config.StringGoString(c.Command),
+		config.StringGoString(c.File),
+		config.TimeDurationGoString(c.Timeout),
+		config.TimeDurationGoString(c.Interval),
+	)
+}
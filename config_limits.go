@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+// DefaultCgroupPath is the default cgroup of the child process, relative to
+// the cgroup of envconsul.
+const DefaultCgroupPath = "child"
+
+// LimitsConfig is the configuration of the resource limits of the child
+// process. Limits are only applied on Linux.
+type LimitsConfig struct {
+	// NoFile, NProc, Core and Memlock are the rlimits of the child process, as
+	// a value for both the soft and hard limits or as "soft:hard". Values are
+	// numbers, with a K, M, G or T suffix for core and memlock, or
+	// "unlimited".
+	NoFile  *string `mapstructure:"nofile"`
+	NProc   *string `mapstructure:"nproc"`
+	Core    *string `mapstructure:"core"`
+	Memlock *string `mapstructure:"memlock"`
+
+	// Cgroup is the cgroup v2 the child process is placed in.
+	Cgroup *CgroupConfig `mapstructure:"cgroup"`
+}
+
+func DefaultLimitsConfig() *LimitsConfig {
+	return &LimitsConfig{
+		Cgroup: DefaultCgroupConfig(),
+	}
+}
+
+func (c *LimitsConfig) Copy() *LimitsConfig {
+	if c == nil {
+		return nil
+	}
+
+	return &LimitsConfig{
+		NoFile:  c.NoFile,
+		NProc:   c.NProc,
+		Core:    c.Core,
+		Memlock: c.Memlock,
+		Cgroup:  c.Cgroup.Copy(),
+	}
+}
+
+func (c *LimitsConfig) Merge(o *LimitsConfig) *LimitsConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.NoFile != nil {
+		r.NoFile = o.NoFile
+	}
+
+	if o.NProc != nil {
+		r.NProc = o.NProc
+	}
+
+	if o.Core != nil {
+		r.Core = o.Core
+	}
+
+	if o.Memlock != nil {
+		r.Memlock = o.Memlock
+	}
+
+	if o.Cgroup != nil {
+		r.Cgroup = r.Cgroup.Merge(o.Cgroup)
+	}
+
+	return r
+}
+
+func (c *LimitsConfig) Finalize() {
+	if c.NoFile == nil {
+		c.NoFile = config.String("")
+	}
+
+	if c.NProc == nil {
+		c.NProc = config.String("")
+	}
+
+	if c.Core == nil {
+		c.Core = config.String("")
+	}
+
+	if c.Memlock == nil {
+		c.Memlock = config.String("")
+	}
+
+	if c.Cgroup == nil {
+		c.Cgroup = DefaultCgroupConfig()
+	}
+	c.Cgroup.Finalize()
+}
+
+// rlimits returns the configured rlimits by name, leaving out unset ones.
+func (c *LimitsConfig) rlimits() map[string]string {
+	limits := make(map[string]string)
+	for name, v := range map[string]*string{
+		"nofile":  c.NoFile,
+		"nproc":   c.NProc,
+		"core":    c.Core,
+		"memlock": c.Memlock,
+	} {
+		if config.StringPresent(v) {
+			limits[name] = config.StringVal(v)
+		}
+	}
+	return limits
+}
+
+// Empty reports whether no limit is configured.
+func (c *LimitsConfig) Empty() bool {
+	return len(c.rlimits()) == 0 && !config.BoolVal(c.Cgroup.Enabled)
+}
+
+func (c *LimitsConfig) GoString() string {
+	if c == nil {
+		return "(*LimitsConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&LimitsConfig{"+
+		"NoFile:%s, "+
+		"NProc:%s, "+
+		"Core:%s, "+
+		"Memlock:%s, "+
+		"Cgroup:%s"+
+		"}",
+		config.StringGoString(c.NoFile),
+		config.StringGoString(c.NProc),
+		config.StringGoString(c.Core),
+		config.StringGoString(c.Memlock),
+		c.Cgroup.GoString(),
+	)
+}
+
+// CgroupConfig is the configuration of the cgroup v2 the child process is
+// placed in. The values of the limits are written as is to the files of the
+// same name in the cgroup.
+type CgroupConfig struct {
+	// Enabled places the child process in its own cgroup. It defaults to true
+	// when a path or a limit is given.
+	Enabled *bool `mapstructure:"enabled"`
+
+	// Path is the cgroup of the child process, relative to the cgroup of
+	// envconsul, or to the root of the cgroup hierarchy when absolute.
+	Path *string `mapstructure:"path"`
+
+	// MemoryMax is the memory.max of the cgroup, like "512M" or "max".
+	MemoryMax *string `mapstructure:"memory_max"`
+
+	// CPUMax is the cpu.max of the cgroup, like "50000 100000" for half a CPU.
+	CPUMax *string `mapstructure:"cpu_max"`
+
+	// PidsMax is the pids.max of the cgroup, like "100" or "max".
+	PidsMax *string `mapstructure:"pids_max"`
+}
+
+func DefaultCgroupConfig() *CgroupConfig {
+	return &CgroupConfig{}
+}
+
+func (c *CgroupConfig) Copy() *CgroupConfig {
+	if c == nil {
+		return nil
+	}
+
+	return &CgroupConfig{
+		Enabled:   c.Enabled,
+		Path:      c.Path,
+		MemoryMax: c.MemoryMax,
+		CPUMax:    c.CPUMax,
+		PidsMax:   c.PidsMax,
+	}
+}
+
+func (c *CgroupConfig) Merge(o *CgroupConfig) *CgroupConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.Enabled != nil {
+		r.Enabled = o.Enabled
+	}
+
+	if o.Path != nil {
+		r.Path = o.Path
+	}
+
+	if o.MemoryMax != nil {
+		r.MemoryMax = o.MemoryMax
+	}
+
+	if o.CPUMax != nil {
+		r.CPUMax = o.CPUMax
+	}
+
+	if o.PidsMax != nil {
+		r.PidsMax = o.PidsMax
+	}
+
+	return r
+}
+
+func (c *CgroupConfig) Finalize() {
+	if c.Enabled == nil {
+		c.Enabled = config.Bool(config.StringPresent(c.Path) ||
+			config.StringPresent(c.MemoryMax) || config.StringPresent(c.CPUMax) ||
+			config.StringPresent(c.PidsMax))
+	}
+
+	if c.Path == nil || config.StringVal(c.Path) == "" {
+		c.Path = config.String(DefaultCgroupPath)
+	}
+
+	if c.MemoryMax == nil {
+		c.MemoryMax = config.String("")
+	}
+
+	if c.CPUMax == nil {
+		c.CPUMax = config.String("")
+	}
+
+	if c.PidsMax == nil {
+		c.PidsMax = config.String("")
+	}
+}
+
+func (c *CgroupConfig) GoString() string {
+	if c == nil {
+		return "(*CgroupConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&CgroupConfig{"+
+		"Enabled:%s, "+
+		"Path:%s, "+
+		"MemoryMax:%s, "+
+		"CPUMax:%s, "+
+		"PidsMax:%s"+
+		"}",
+		config.BoolGoString(c.Enabled),
+		config.StringGoString(c.Path),
+		config.StringGoString(c.MemoryMax),
+		config.StringGoString(c.CPUMax),
+		config.StringGoString(c.PidsMax),
+	)
+}
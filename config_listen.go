@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+// ListenConfig is the configuration of a socket envconsul listens on and
+// passes to the child process, following the systemd socket activation
+// convention.
+type ListenConfig struct {
+	// Network is "tcp", "tcp4", "tcp6" or "unix", defaulting to "tcp".
+	Network *string `mapstructure:"network"`
+
+	// Address is the address to listen on, like ":8080" or the path of a Unix
+	// socket.
+	Address *string `mapstructure:"address"`
+
+	// Name is the name of the socket for the child, in LISTEN_FDNAMES.
+	Name *string `mapstructure:"name"`
+}
+
+func DefaultListenConfig() *ListenConfig {
+	return &ListenConfig{}
+}
+
+func (l *ListenConfig) Copy() *ListenConfig {
+	if l == nil {
+		return nil
+	}
+	return &ListenConfig{
+		Network: l.Network,
+		Address: l.Address,
+		Name:    l.Name,
+	}
+}
+
+func (l *ListenConfig) Merge(o *ListenConfig) *ListenConfig {
+	if l == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return l.Copy()
+	}
+
+	r := l.Copy()
+
+	if o.Network != nil {
+		r.Network = o.Network
+	}
+
+	if o.Address != nil {
+		r.Address = o.Address
+	}
+
+	if o.Name != nil {
+		r.Name = o.Name
+	}
+
+	return r
+}
+
+func (l *ListenConfig) Finalize() {
+	if l.Network == nil {
+		l.Network = config.String("tcp")
+	}
+
+	if l.Address == nil {
+		l.Address = config.String("")
+	}
+
+	if l.Name == nil {
+		l.Name = config.String("")
+	}
+}
+
+func (l *ListenConfig) GoString() string {
+	if l == nil {
+		return "(*ListenConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&ListenConfig{"+
+		"Network:%s, "+
+		"Address:%s, "+
+		"Name:%s"+
+		"}",
+		config.StringGoString(l.Network),
+		config.StringGoString(l.Address),
+		config.StringGoString(l.Name),
+	)
+}
+
+type ListenConfigs []*ListenConfig
+
+func DefaultListenConfigs() *ListenConfigs {
+	return &ListenConfigs{}
+}
+
+func (l *ListenConfigs) Copy() *ListenConfigs {
+	if l == nil {
+		return nil
+	}
+
+	o := make(ListenConfigs, len(*l))
+	for i, t := range *l {
+		o[i] = t.Copy()
+	}
+	return &o
+}
+
+func (l *ListenConfigs) Merge(o *ListenConfigs) *ListenConfigs {
+	if l == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return l.Copy()
+	}
+
+	r := l.Copy()
+
+	*r = append(*r, *o...)
+
+	return r
+}
+
+func (l *ListenConfigs) Finalize() {
+	for _, t := range *l {
+		t.Finalize()
+	}
+}
+
+func (l *ListenConfigs) GoString() string {
+	if l == nil {
+		return "(*ListenConfigs)(nil)"
+	}
+
+	ls := make([]string, len(*l))
+	for i, t := range *l {
+		ls[i] = t.GoString()
+	}
+
+	return "{" + strings.Join(ls, ", ") + "}"
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+// MetaConfig is the configuration for a source that holds the list of
+// additional prefixes and secrets to watch. The source is either a Consul key
+// or a Vault secret, with "prefixes" and "secrets" lists of paths.
+type MetaConfig struct {
+	// ConsulKey is the Consul key holding the lists, as HCL or JSON.
+	ConsulKey *string `mapstructure:"consul_key"`
+
+	// VaultSecret is the Vault secret holding the lists.
+	VaultSecret *string `mapstructure:"vault_secret"`
+
+	// Format and NoPrefix are applied to every listed prefix and secret, just
+	// like PrefixConfig.Format and PrefixConfig.NoPrefix.
+	Format   *string `mapstructure:"format"`
+	NoPrefix *bool   `mapstructure:"no_prefix"`
+}
+
+func DefaultMetaConfig() *MetaConfig {
+	return &MetaConfig{}
+}
+
+func (c *MetaConfig) Copy() *MetaConfig {
+	if c == nil {
+		return nil
+	}
+
+	return &MetaConfig{
+		ConsulKey:   c.ConsulKey,
+		VaultSecret: c.VaultSecret,
+		Format:      c.Format,
+		NoPrefix:    c.NoPrefix,
+	}
+}
+
+func (c *MetaConfig) Merge(o *MetaConfig) *MetaConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.ConsulKey != nil {
+		r.ConsulKey = o.ConsulKey
+	}
+
+	if o.VaultSecret != nil {
+		r.VaultSecret = o.VaultSecret
+	}
+
+	if o.Format != nil {
+		r.Format = o.Format
+	}
+
+	if o.NoPrefix != nil {
+		r.NoPrefix = o.NoPrefix
+	}
+
+	return r
+}
+
+func (c *MetaConfig) Finalize() {
+	if c.ConsulKey == nil {
+		c.ConsulKey = config.String("")
+	}
+
+	if c.VaultSecret == nil {
+		c.VaultSecret = config.String("")
+	}
+
+	if c.Format == nil {
+		c.Format = config.String("")
+	}
+
+	// NoPrefix stays unset so the listed prefixes and secrets keep their
+	// differing defaults, see PrefixConfig.Finalize.
+}
+
+// prefixConfig returns the PrefixConfig for a path listed by this source.
+func (c *MetaConfig) prefixConfig(path string) *PrefixConfig {
+	return &PrefixConfig{
+		Format:   c.Format,
+		NoPrefix: c.NoPrefix,
+		Path:     config.String(path),
+	}
+}
+
+func (c *MetaConfig) GoString() string {
+	if c == nil {
+		return "(*MetaConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&MetaConfig{"+
+		"ConsulKey:%s, "+
+		"VaultSecret:%s, "+
+		"Format:%s, "+
+		"NoPrefix:%s"+
+		"}",
+		config.StringGoString(c.ConsulKey),
+		config.StringGoString(c.VaultSecret),
+		config.StringGoString(c.Format),
+		config.BoolGoString(c.NoPrefix),
+	)
+}
+
+type MetaConfigs []*MetaConfig
+
+func DefaultMetaConfigs() *MetaConfigs {
+	return &MetaConfigs{}
+}
+
+func (c *MetaConfigs) Copy() *MetaConfigs {
+	if c == nil {
+		return nil
+	}
+
+	o := make(MetaConfigs, len(*c))
+	for i, t := range *c {
+		o[i] = t.Copy()
+	}
+	return &o
+}
+
+func (c *MetaConfigs) Merge(o *MetaConfigs) *MetaConfigs {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	*r = append(*r, *o...)
+
+	return r
+}
+
+func (c *MetaConfigs) Finalize() {
+	if c == nil {
+		*c = *DefaultMetaConfigs()
+	}
+
+	for _, t := range *c {
+		t.Finalize()
+	}
+}
+
+func (c *MetaConfigs) GoString() string {
+	if c == nil {
+		return "(*MetaConfigs)(nil)"
+	}
+
+	s := make([]string, len(*c))
+	for i, t := range *c {
+		s[i] = t.GoString()
+	}
+
+	return "{" + strings.Join(s, ", ") + "}"
+}
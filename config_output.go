@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+// Formats of the output of the child process.
+const (
+	// OutputFormatRaw passes the output through unchanged.
+	OutputFormatRaw = "raw"
+
+	// OutputFormatPrefix prefixes each line with a timestamp and the tag.
+	OutputFormatPrefix = "prefix"
+
+	// OutputFormatJSON wraps each line in a JSON object with a timestamp, the
+	// tag and the stream.
+	OutputFormatJSON = "json"
+)
+
+// DefaultOutputMaxFiles is the default number of rotated files kept.
+const DefaultOutputMaxFiles = 5
+
+// OutputConfig is the configuration of the stdout or stderr of the child
+// process.
+type OutputConfig struct {
+	// Format is OutputFormatRaw, OutputFormatPrefix or OutputFormatJSON.
+	Format *string `mapstructure:"format"`
+
+	// Tag identifies the child process in prefixed and JSON lines, and in
+	// syslog. It defaults to the name of the stream.
+	Tag *string `mapstructure:"tag"`
+
+	// File is the path of a file to write the output to, instead of the
+	// stream of envconsul.
+	File *string `mapstructure:"file"`
+
+	// MaxSize is the size after which File is rotated, with a K, M, G or T
+	// suffix. Files are not rotated without it.
+	MaxSize *string `mapstructure:"max_size"`
+
+	// MaxFiles is the number of rotated files kept, as File.1, File.2 and so
+	// on.
+	MaxFiles *int `mapstructure:"max_files"`
+
+	// Syslog also sends the lines to syslog, with the facility of the syslog
+	// configuration.
+	Syslog *bool `mapstructure:"syslog"`
+}
+
+func DefaultOutputConfig() *OutputConfig {
+	return &OutputConfig{}
+}
+
+func (c *OutputConfig) Copy() *OutputConfig {
+	if c == nil {
+		return nil
+	}
+
+	return &OutputConfig{
+		Format:   c.Format,
+		Tag:      c.Tag,
+		File:     c.File,
+		MaxSize:  c.MaxSize,
+		MaxFiles: c.MaxFiles,
+		Syslog:   c.Syslog,
+	}
+}
+
+func (c *OutputConfig) Merge(o *OutputConfig) *OutputConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.Format != nil {
+		r.Format = o.Format
+	}
+
+	if o.Tag != nil {
+		r.Tag = o.Tag
+	}
+
+	if o.File != nil {
+		r.File = o.File
+	}
+
+	if o.MaxSize != nil {
+		r.MaxSize = o.MaxSize
+	}
+
+	if o.MaxFiles != nil {
+		r.MaxFiles = o.MaxFiles
+	}
+
+	if o.Syslog != nil {
+		r.Syslog = o.Syslog
+	}
+
+	return r
+}
+
+func (c *OutputConfig) Finalize() {
+	if c.Format == nil {
+		c.Format = config.String(OutputFormatRaw)
+	}
+
+	if c.Tag == nil {
+		c.Tag = config.String("")
+	}
+
+	if c.File == nil {
+		c.File = config.String("")
+	}
+
+	if c.MaxSize == nil {
+		c.MaxSize = config.String("")
+	}
+
+	if c.MaxFiles == nil {
+		c.MaxFiles = config.Int(DefaultOutputMaxFiles)
+	}
+
+	if c.Syslog == nil {
+		c.Syslog = config.Bool(false)
+	}
+}
+
+// PassThrough reports whether the output is passed through unchanged to the
+// stream of envconsul.
+func (c *OutputConfig) PassThrough() bool {
+	return config.StringVal(c.Format) == OutputFormatRaw &&
+		!config.StringPresent(c.File) && !config.BoolVal(c.Syslog)
+}
+
+func (c *OutputConfig) GoString() string {
+	if c == nil {
+		return "(*OutputConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&OutputConfig{"+
+		"Format:%s, "+
+		"Tag:%s, "+
+		"File:%s, "+
+		"MaxSize:%s, "+
+		"MaxFiles:%s, "+
+		"Syslog:%s"+
+		"}",
+		config.StringGoString(c.Format),
+		config.StringGoString(c.Tag),
+		config.StringGoString(c.File),
+		config.StringGoString(c.MaxSize),
+		config.IntGoString(c.MaxFiles),
+		config.BoolGoString(c.Syslog),
+	)
+}
@@ -44,6 +44,71 @@ func (f *KeyFormats) Copy() *KeyFormats {
 	return &r
 }
 
+// RenameConfig wraps a rule for renaming keys in a prefix or secret.
+//
+// Pattern is a regular expression matched against the key name
+// Replacement is the new key name, which may reference capture groups from
+// Pattern using the $1 or ${name} syntax
+type RenameConfig struct {
+	Pattern     *string `mapstructure:"pattern"`
+	Replacement *string `mapstructure:"replacement"`
+}
+
+func (c *RenameConfig) Copy() *RenameConfig {
+	if c == nil {
+		return nil
+	}
+
+	r := RenameConfig{}
+	r.Pattern = c.Pattern
+	r.Replacement = c.Replacement
+
+	return &r
+}
+
+func (c *RenameConfig) GoString() string {
+	if c == nil {
+		return "(*RenameConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&RenameConfig{"+
+		"Pattern:%s, "+
+		"Replacement:%s"+
+		"}",
+		config.StringGoString(c.Pattern),
+		config.StringGoString(c.Replacement),
+	)
+}
+
+// RenameConfigs holds an ordered list of rename rules.
+type RenameConfigs []*RenameConfig
+
+func (c *RenameConfigs) Copy() *RenameConfigs {
+	if c == nil {
+		return nil
+	}
+
+	r := RenameConfigs{}
+	for _, v := range *c {
+		r = append(r, v.Copy())
+	}
+
+	return &r
+}
+
+func (c *RenameConfigs) GoString() string {
+	if c == nil {
+		return "(*RenameConfigs)(nil)"
+	}
+
+	s := make([]string, len(*c))
+	for i, t := range *c {
+		s[i] = t.GoString()
+	}
+
+	return "{" + strings.Join(s, ", ") + "}"
+}
+
 // PrefixConfig is a wrapper around some common options for Consul and Vault
 // prefixes.
 type PrefixConfig struct {
@@ -51,6 +116,32 @@ type PrefixConfig struct {
 	NoPrefix *bool       `mapstructure:"no_prefix"`
 	Path     *string     `mapstructure:"path"`
 	Keys     *KeyFormats `mapstructure:"key"`
+
+	// Include and Exclude are lists of patterns matched against the original
+	// key names. Patterns are globs, unless wrapped in slashes ("/^DB_/") in
+	// which case they are regular expressions. Exclude takes precedence.
+	Include []string `mapstructure:"include"`
+	Exclude []string `mapstructure:"exclude"`
+
+	// Rename is the list of rename rules, the first matching rule wins.
+	Rename *RenameConfigs `mapstructure:"rename"`
+
+	// Version pins a Vault KV v2 secret to the given version instead of the
+	// latest one.
+	Version *int `mapstructure:"version"`
+
+	// ExportMetadata exports the version, creation time and custom metadata of
+	// a Vault KV v2 secret alongside its data.
+	ExportMetadata *bool `mapstructure:"export_metadata"`
+
+	// ErrorOnDeleted refuses to (re)start the child when a Vault KV v2 secret
+	// is deleted or destroyed, instead of dropping all of its keys.
+	ErrorOnDeleted *bool `mapstructure:"error_on_deleted"`
+
+	// Recursive lists the Vault path and imports every secret found under it,
+	// following sub-folders. Secrets are added and removed as they appear and
+	// disappear.
+	Recursive *bool `mapstructure:"recursive"`
 }
 
 func ParsePrefixConfig(s string) (*PrefixConfig, error) {
@@ -81,6 +172,26 @@ func (c *PrefixConfig) Copy() *PrefixConfig {
 		o.Keys = c.Keys.Copy()
 	}
 
+	if c.Include != nil {
+		o.Include = append([]string{}, c.Include...)
+	}
+
+	if c.Exclude != nil {
+		o.Exclude = append([]string{}, c.Exclude...)
+	}
+
+	if c.Rename != nil {
+		o.Rename = c.Rename.Copy()
+	}
+
+	o.Version = c.Version
+
+	o.ExportMetadata = c.ExportMetadata
+
+	o.ErrorOnDeleted = c.ErrorOnDeleted
+
+	o.Recursive = c.Recursive
+
 	return &o
 }
 
@@ -114,6 +225,34 @@ func (c *PrefixConfig) Merge(o *PrefixConfig) *PrefixConfig {
 		r.Keys = o.Keys.Copy()
 	}
 
+	if o.Include != nil {
+		r.Include = append([]string{}, o.Include...)
+	}
+
+	if o.Exclude != nil {
+		r.Exclude = append([]string{}, o.Exclude...)
+	}
+
+	if o.Rename != nil {
+		r.Rename = o.Rename.Copy()
+	}
+
+	if o.Version != nil {
+		r.Version = o.Version
+	}
+
+	if o.ExportMetadata != nil {
+		r.ExportMetadata = o.ExportMetadata
+	}
+
+	if o.ErrorOnDeleted != nil {
+		r.ErrorOnDeleted = o.ErrorOnDeleted
+	}
+
+	if o.Recursive != nil {
+		r.Recursive = o.Recursive
+	}
+
 	return r
 }
 
@@ -130,6 +269,34 @@ func (c *PrefixConfig) Finalize() {
 	if c.Path == nil {
 		c.Path = config.String("")
 	}
+
+	if c.Include == nil {
+		c.Include = []string{}
+	}
+
+	if c.Exclude == nil {
+		c.Exclude = []string{}
+	}
+
+	if c.Rename == nil {
+		c.Rename = &RenameConfigs{}
+	}
+
+	if c.Version == nil {
+		c.Version = config.Int(0)
+	}
+
+	if c.ExportMetadata == nil {
+		c.ExportMetadata = config.Bool(false)
+	}
+
+	if c.ErrorOnDeleted == nil {
+		c.ErrorOnDeleted = config.Bool(false)
+	}
+
+	if c.Recursive == nil {
+		c.Recursive = config.Bool(false)
+	}
 }
 
 func (c *PrefixConfig) GoString() string {
@@ -140,11 +307,25 @@ func (c *PrefixConfig) GoString() string {
 	return fmt.Sprintf("&PrefixConfig{"+
 		"Format:%s, "+
 		"NoPrefix:%s, "+
-		"Path:%s"+
+		"Path:%s, "+
+		"Include:%v, "+
+		"Exclude:%v, "+
+		"Rename:%s, "+
+		"Version:%s, "+
+		"ExportMetadata:%s, "+
+		"ErrorOnDeleted:%s, "+
+		"Recursive:%s"+
 		"}",
 		config.StringGoString(c.Format),
 		config.BoolGoString(c.NoPrefix),
 		config.StringGoString(c.Path),
+		c.Include,
+		c.Exclude,
+		c.Rename.GoString(),
+		config.IntGoString(c.Version),
+		config.BoolGoString(c.ExportMetadata),
+		config.BoolGoString(c.ErrorOnDeleted),
+		config.BoolGoString(c.Recursive),
 	)
 }
 
@@ -191,16 +372,15 @@ func (c *PrefixConfigs) Finalize() {
 	}
 
 	// entries without a path are invalid and ignored
-	confs := *c
-	i := 0
-	for _, t := range confs {
+	confs := (*c)[:0]
+	for _, t := range *c {
 		if config.StringVal(t.Path) == "" {
-			confs = append(confs[:i], confs[i+1:]...)
 			continue
 		}
 		t.Finalize()
-		i++
+		confs = append(confs, t)
 	}
+	*c = confs
 }
 
 func (c *PrefixConfigs) GoString() string {
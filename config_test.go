@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -144,9 +146,9 @@ func TestParse(t *testing.T) {
 			"splay_top_level",
 			`splay = "5s"`,
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					Splay: config.TimeDuration(5 * time.Second),
-				},
+				}},
 			},
 			false,
 		},
@@ -154,9 +156,9 @@ func TestParse(t *testing.T) {
 			"timeout_top_level",
 			`timeout = "10s"`,
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					KillTimeout: config.TimeDuration(10 * time.Second),
-				},
+				}},
 			},
 			false,
 		},
@@ -173,6 +175,20 @@ func TestParse(t *testing.T) {
 		// End Depreations
 		// TODO remove in 0.8.0
 
+		{
+			"config_watch",
+			`config_watch {
+				enabled  = true
+				debounce = "5s"
+			}`,
+			&Config{
+				ConfigWatch: &ConfigWatchConfig{
+					Enabled:  config.Bool(true),
+					Debounce: config.TimeDuration(5 * time.Second),
+				},
+			},
+			false,
+		},
 		{
 			"consul_address",
 			`consul {
@@ -441,7 +457,7 @@ func TestParse(t *testing.T) {
 			"exec",
 			`exec {}`,
 			&Config{
-				Exec: &config.ExecConfig{},
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{}},
 			},
 			false,
 		},
@@ -451,9 +467,9 @@ func TestParse(t *testing.T) {
 				command = "command"
 			}`,
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					Command: []string{"command"},
-				},
+				}},
 			},
 			false,
 		},
@@ -463,9 +479,9 @@ func TestParse(t *testing.T) {
 				enabled = true
 			 }`,
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					Enabled: config.Bool(true),
-				},
+				}},
 			},
 			false,
 		},
@@ -475,9 +491,9 @@ func TestParse(t *testing.T) {
 				env {}
 			 }`,
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					Env: &config.EnvConfig{},
-				},
+				}},
 			},
 			false,
 		},
@@ -489,11 +505,11 @@ func TestParse(t *testing.T) {
 				}
 			 }`,
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					Env: &config.EnvConfig{
 						Denylist: []string{"a", "b"},
 					},
-				},
+				}},
 			},
 			false,
 		},
@@ -505,11 +521,11 @@ func TestParse(t *testing.T) {
 				}
 			 }`,
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					Env: &config.EnvConfig{
 						DenylistDeprecated: []string{"a", "b"},
 					},
-				},
+				}},
 			},
 			false,
 		},
@@ -521,11 +537,11 @@ func TestParse(t *testing.T) {
 				}
 			}`,
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					Env: &config.EnvConfig{
 						Custom: []string{"a=b", "c=d"},
 					},
-				},
+				}},
 			},
 			false,
 		},
@@ -537,11 +553,11 @@ func TestParse(t *testing.T) {
 				}
 			 }`,
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					Env: &config.EnvConfig{
 						Pristine: config.Bool(true),
 					},
-				},
+				}},
 			},
 			false,
 		},
@@ -553,11 +569,11 @@ func TestParse(t *testing.T) {
 				}
 			 }`,
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					Env: &config.EnvConfig{
 						Allowlist: []string{"a", "b"},
 					},
-				},
+				}},
 			},
 			false,
 		},
@@ -569,11 +585,11 @@ func TestParse(t *testing.T) {
 				}
 			 }`,
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					Env: &config.EnvConfig{
 						AllowlistDeprecated: []string{"a", "b"},
 					},
-				},
+				}},
 			},
 			false,
 		},
@@ -583,9 +599,9 @@ func TestParse(t *testing.T) {
 				kill_signal = "SIGUSR1"
 			 }`,
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					KillSignal: config.Signal(syscall.SIGUSR1),
-				},
+				}},
 			},
 			false,
 		},
@@ -595,9 +611,9 @@ func TestParse(t *testing.T) {
 				kill_timeout = "30s"
 			 }`,
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					KillTimeout: config.TimeDuration(30 * time.Second),
-				},
+				}},
 			},
 			false,
 		},
@@ -607,9 +623,9 @@ func TestParse(t *testing.T) {
 				reload_signal = "SIGUSR1"
 			 }`,
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					ReloadSignal: config.Signal(syscall.SIGUSR1),
-				},
+				}},
 			},
 			false,
 		},
@@ -619,9 +635,9 @@ func TestParse(t *testing.T) {
 				splay = "30s"
 			 }`,
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					Splay: config.TimeDuration(30 * time.Second),
-				},
+				}},
 			},
 			false,
 		},
@@ -631,9 +647,17 @@ func TestParse(t *testing.T) {
 				timeout = "30s"
 			 }`,
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					Timeout: config.TimeDuration(30 * time.Second),
-				},
+				}},
+			},
+			false,
+		},
+		{
+			"init",
+			`init = true`,
+			&Config{
+				Init: config.Bool(true),
 			},
 			false,
 		},
@@ -645,6 +669,214 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"log_file",
+			`log_file = "/var/log/envconsul.log"`,
+			&Config{
+				LogFile: config.String("/var/log/envconsul.log"),
+			},
+			false,
+		},
+		{
+			"audit",
+			`audit {
+				path = "/var/log/envconsul-audit.log"
+				hmac_key = "s3cret"
+			}`,
+			&Config{
+				Audit: &AuditConfig{
+					Path:    config.String("/var/log/envconsul-audit.log"),
+					HMACKey: config.String("s3cret"),
+				},
+			},
+			false,
+		},
+		{
+			"exec_hooks",
+			`exec {
+				hooks {
+					pre_start = "./migrate"
+					post_start = "./warm-cache"
+					on_change = "./notify"
+					pre_stop = "./drain"
+					timeout = "10m"
+				}
+			}`,
+			&Config{
+				Exec: &ExecConfig{
+					Hooks: &HooksConfig{
+						PreStart:  config.String("./migrate"),
+						PostStart: config.String("./warm-cache"),
+						OnChange:  config.String("./notify"),
+						PreStop:   config.String("./drain"),
+						Timeout:   config.TimeDuration(10 * time.Minute),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"exec_replace_strategy",
+			`exec {
+				replace_strategy = "start_first"
+				ready {
+					tcp = "127.0.0.1:8080"
+					http = "http://127.0.0.1:8080/health"
+					command = "./check"
+					file = "/run/app.ready"
+					timeout = "1m"
+					interval = "2s"
+				}
+			}`,
+			&Config{
+				Exec: &ExecConfig{
+					ReplaceStrategy: config.String("start_first"),
+					Ready: &ReadyConfig{
+						TCP:      config.String("127.0.0.1:8080"),
+						HTTP:     config.String("http://127.0.0.1:8080/health"),
+						Command:  config.String("./check"),
+						File:     config.String("/run/app.ready"),
+						Timeout:  config.TimeDuration(1 * time.Minute),
+						Interval: config.TimeDuration(2 * time.Second),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"exec_user",
+			`exec {
+				user = "app"
+				group = "app"
+				groups = ["vault", "1001"]
+				umask = "027"
+				working_dir = "/srv/app"
+				no_new_privs = true
+			}`,
+			&Config{
+				Exec: &ExecConfig{
+					User:       config.String("app"),
+					Group:      config.String("app"),
+					Groups:     []string{"vault", "1001"},
+					Umask:      config.String("027"),
+					WorkingDir: config.String("/srv/app"),
+					NoNewPrivs: config.Bool(true),
+				},
+			},
+			false,
+		},
+		{
+			"exec_limits",
+			`exec {
+				limits {
+					nofile = 65536
+					nproc = "512:1024"
+					core = "unlimited"
+					memlock = "64M"
+					cgroup {
+						path = "app"
+						memory_max = "512M"
+						cpu_max = "50000 100000"
+						pids_max = 100
+					}
+				}
+			}`,
+			&Config{
+				Exec: &ExecConfig{
+					Limits: &LimitsConfig{
+						NoFile:  config.String("65536"),
+						NProc:   config.String("512:1024"),
+						Core:    config.String("unlimited"),
+						Memlock: config.String("64M"),
+						Cgroup: &CgroupConfig{
+							Path:      config.String("app"),
+							MemoryMax: config.String("512M"),
+							CPUMax:    config.String("50000 100000"),
+							PidsMax:   config.String("100"),
+						},
+					},
+				},
+			},
+			false,
+		},
+		{
+			"exec_output",
+			`exec {
+				stdout {
+					format = "json"
+					tag = "web"
+				}
+				stderr {
+					file = "/var/log/web.err"
+					max_size = 1048576
+					max_files = 3
+					syslog = true
+				}
+			}`,
+			&Config{
+				Exec: &ExecConfig{
+					Stdout: &OutputConfig{
+						Format: config.String("json"),
+						Tag:    config.String("web"),
+					},
+					Stderr: &OutputConfig{
+						File:     config.String("/var/log/web.err"),
+						MaxSize:  config.String("1048576"),
+						MaxFiles: config.Int(3),
+						Syslog:   config.Bool(true),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"listen",
+			`listen {
+				address = ":8080"
+				name = "http"
+			}
+			listen {
+				network = "unix"
+				address = "/run/app.sock"
+			}`,
+			&Config{
+				Listeners: &ListenConfigs{
+					&ListenConfig{
+						Address: config.String(":8080"),
+						Name:    config.String("http"),
+					},
+					&ListenConfig{
+						Network: config.String("unix"),
+						Address: config.String("/run/app.sock"),
+					},
+				},
+			},
+			false,
+		},
+		{
+			"log_env_values",
+			`log_env_values = true`,
+			&Config{
+				LogEnvValues: config.Bool(true),
+			},
+			false,
+		},
+		{
+			"log_format",
+			`log_format = "json"`,
+			&Config{
+				LogFormat: config.String("json"),
+			},
+			false,
+		},
+		{
+			"log_reopen_signal",
+			`log_reopen_signal = "SIGUSR2"`,
+			&Config{
+				LogReopenSignal: config.Signal(syscall.SIGUSR2),
+			},
+			false,
+		},
 		{
 			"log_level",
 			`log_level = "WARN"`,
@@ -661,6 +893,30 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"meta",
+			`meta {
+				consul_key = "deploy/web"
+				format     = "web_{{ key }}"
+				no_prefix  = true
+			}
+			meta {
+				vault_secret = "secret/deploy/web"
+			}`,
+			&Config{
+				Meta: &MetaConfigs{
+					&MetaConfig{
+						ConsulKey: config.String("deploy/web"),
+						Format:    config.String("web_{{ key }}"),
+						NoPrefix:  config.Bool(true),
+					},
+					&MetaConfig{
+						VaultSecret: config.String("secret/deploy/web"),
+					},
+				},
+			},
+			false,
+		},
 		{
 			"pid_file",
 			`pid_file = "/var/pid"`,
@@ -669,6 +925,48 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"profile",
+			`upcase = true
+			profile "dev" {
+				upcase = false
+				consul {
+					address = "127.0.0.1:8500"
+				}
+			}
+			profile "prod" {
+				prefix {
+					path = "prod"
+				}
+			}`,
+			&Config{
+				Upcase: config.Bool(true),
+				Profiles: map[string]*Config{
+					"dev": {
+						Upcase: config.Bool(false),
+						Consul: &config.ConsulConfig{
+							Address: config.String("127.0.0.1:8500"),
+						},
+					},
+					"prod": {
+						Prefixes: &PrefixConfigs{
+							&PrefixConfig{
+								Path: config.String("prod"),
+							},
+						},
+					},
+				},
+			},
+			false,
+		},
+		{
+			"profile_nested",
+			`profile "dev" {
+				profile "other" {}
+			}`,
+			nil,
+			true,
+		},
 		{
 			"prefix",
 			`prefix {}`,
@@ -747,6 +1045,52 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"prefix_include_exclude",
+			`prefix {
+				include = ["DB_*", "/^CACHE_/"]
+				exclude = ["DB_PASSWORD"]
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Include: []string{"DB_*", "/^CACHE_/"},
+						Exclude: []string{"DB_PASSWORD"},
+					},
+				},
+			},
+			false,
+		},
+		{
+			"prefix_rename",
+			`prefix {
+				rename {
+					pattern     = "^DB_(.*)$"
+					replacement = "DATABASE_$1"
+				}
+				rename {
+					pattern     = "^CACHE_"
+					replacement = "REDIS_"
+				}
+			}`,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Rename: &RenameConfigs{
+							&RenameConfig{
+								Pattern:     config.String("^DB_(.*)$"),
+								Replacement: config.String("DATABASE_$1"),
+							},
+							&RenameConfig{
+								Pattern:     config.String("^CACHE_"),
+								Replacement: config.String("REDIS_"),
+							},
+						},
+					},
+				},
+			},
+			false,
+		},
 		{
 			"pristine",
 			`pristine = true`,
@@ -835,6 +1179,26 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"secret_version",
+			`secret {
+				path             = "secret/data/foo"
+				version          = 3
+				export_metadata  = true
+				error_on_deleted = true
+			}`,
+			&Config{
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{
+						Path:           config.String("secret/data/foo"),
+						Version:        config.Int(3),
+						ExportMetadata: config.Bool(true),
+						ErrorOnDeleted: config.Bool(true),
+					},
+				},
+			},
+			false,
+		},
 		{
 			"service",
 			`service {
@@ -885,6 +1249,14 @@ func TestParse(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"status_file",
+			`status_file = "/run/envconsul/status.json"`,
+			&Config{
+				StatusFile: config.String("/run/envconsul/status.json"),
+			},
+			false,
+		},
 		{
 			"syslog",
 			`syslog {}`,
@@ -1353,6 +1725,326 @@ func TestParse(t *testing.T) {
 	}
 }
 
+func TestParse_errors(t *testing.T) {
+	cases := []struct {
+		name   string
+		format string
+		i      string
+		err    string
+	}{
+		{
+			"syntax",
+			FormatHCL,
+			"consul {\n  address = \n}",
+			"3:2: object expected closing RBRACE got: EOF",
+		},
+		{
+			"unknown_key",
+			FormatHCL,
+			"upcase = true\nkill_sgnal = \"SIGTERM\"",
+			`2:1: unknown key "kill_sgnal", did you mean "kill_signal"?`,
+		},
+		{
+			"unknown_nested_key",
+			FormatHCL,
+			"prefix {\n  path = \"foo\"\n}\nprefix {\n  fromat = \"x\"\n}",
+			`5:3: unknown key "fromat" in prefix, did you mean "format"?`,
+		},
+		{
+			"unknown_key_no_suggestion",
+			FormatHCL,
+			`bogus = 1`,
+			`1:1: unknown key "bogus"`,
+		},
+		{
+			"invalid_type",
+			FormatHCL,
+			"upcase = true\nprefix {\n  path = \"foo\"\n}\nprefix {\n  no_prefix = \"nope\"\n}",
+			"6:3: 'prefix[1].no_prefix' expected type 'bool', got unconvertible type 'string', value: 'nope'",
+		},
+		{
+			"invalid_type_profile",
+			FormatHCL,
+			"profile \"dev\" {\n  upcase = \"nope\"\n}",
+			`2:3: profile "dev": 'upcase' expected type 'bool', got unconvertible type 'string', value: 'nope'`,
+		},
+		{
+			"json_unknown_key",
+			FormatJSON,
+			"{\n  \"consul\": {\n    \"adress\": \"x\"\n  }\n}",
+			`3:5: unknown key "adress" in consul, did you mean "address"?`,
+		},
+		{
+			"json_invalid_type",
+			FormatJSON,
+			"{\n  \"prefix\": [\n    {\"path\": \"foo\"},\n    {\"no_prefix\": \"nope\"}\n  ]\n}",
+			"4:6: 'prefix[1].no_prefix' expected type 'bool', got unconvertible type 'string', value: 'nope'",
+		},
+		{
+			"yaml_syntax",
+			FormatYAML,
+			"consul:\n  address: [\n",
+			"2: did not find expected node content",
+		},
+		{
+			"yaml_unknown_key",
+			FormatYAML,
+			"consul:\n  adress: x\n",
+			`unknown key "adress" in consul, did you mean "address"?`,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			_, err := ParseFormat(tc.i, tc.format)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if act := err.Error(); act != tc.err {
+				t.Errorf("\nexp: %#v\nact: %#v", tc.err, act)
+			}
+		})
+	}
+
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.hcl")
+		if err := ioutil.WriteFile(path, []byte("\n  wiat = \"5s\""), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := FromFile(path)
+		if _, ok := err.(*ParseError); !ok {
+			t.Fatalf("expected a ParseError, got %#v", err)
+		}
+		exp := path + `:2:3: unknown key "wiat", did you mean "wait"?`
+		if act := err.Error(); act != exp {
+			t.Errorf("\nexp: %#v\nact: %#v", exp, act)
+		}
+	})
+}
+
+func TestParseFormat(t *testing.T) {
+	hclConfig := `
+		consul {
+			address = "1.2.3.4"
+			retry {
+				attempts = 5
+			}
+		}
+		exec {
+			command = "env"
+			env {
+				allowlist = ["DB_*"]
+			}
+		}
+		kill_signal = "SIGUSR1"
+		prefix {
+			path = "app/web"
+			key {
+				name = "host"
+			}
+		}
+		prefix {
+			path = "app/db"
+		}
+		secret {
+			path    = "secret/web"
+			version = 2
+		}
+		upcase = true
+	`
+
+	jsonConfig := `{
+		"consul": {
+			"address": "1.2.3.4",
+			"retry": {
+				"attempts": 5
+			}
+		},
+		"exec": {
+			"command": "env",
+			"env": {
+				"allowlist": ["DB_*"]
+			}
+		},
+		"kill_signal": "SIGUSR1",
+		"prefix": [
+			{"path": "app/web", "key": [{"name": "host"}]},
+			{"path": "app/db"}
+		],
+		"secret": {
+			"path": "secret/web",
+			"version": 2
+		},
+		"upcase": true
+	}`
+
+	yamlConfig := `
+consul:
+  address: 1.2.3.4
+  retry:
+    attempts: 5
+exec:
+  command: env
+  env:
+    allowlist: ["DB_*"]
+kill_signal: SIGUSR1
+prefix:
+  - path: app/web
+    key:
+      - name: host
+  - path: app/db
+secret:
+  path: secret/web
+  version: 2
+upcase: true
+`
+
+	expected, err := ParseFormat(hclConfig, FormatHCL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		format string
+		i      string
+	}{
+		{"json", FormatJSON, jsonConfig},
+		{"yaml", FormatYAML, yamlConfig},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			c, err := ParseFormat(tc.i, tc.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(expected, c) {
+				t.Errorf("\nexp: %#v\nact: %#v", expected, c)
+			}
+		})
+	}
+
+	t.Run("yaml_unknown_key", func(t *testing.T) {
+		if _, err := ParseFormat("not_a_valid_key: hello", FormatYAML); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	t.Run("yaml_empty", func(t *testing.T) {
+		c, err := ParseFormat("", FormatYAML)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(&Config{}, c) {
+			t.Errorf("\nexp: %#v\nact: %#v", &Config{}, c)
+		}
+	})
+}
+
+func TestEncodeConfig(t *testing.T) {
+	legacy := `
+		auth {
+			enabled  = true
+			username = "user"
+			password = "pass"
+		}
+		retry = "10s"
+		splay = "5s"
+		timeout = "20s"
+		token = "abcd1234"
+		kill_signal = "SIGTERM"
+		wait = "5s:10s"
+		exec {
+			command = "env"
+			env {
+				allowlist = ["DB_*"]
+			}
+		}
+		prefix {
+			path   = "app/web"
+			format = "APP_{{ key }}"
+			key {
+				name   = "host"
+				format = "HOST"
+			}
+		}
+		prefix {
+			path = "app/db"
+		}
+		secret {
+			path    = "secret/web"
+			version = 2
+			rename {
+				pattern     = "^db_(.*)"
+				replacement = "DATABASE_$1"
+			}
+		}
+		vault {
+			lease_renewal_threshold = 0.5
+		}
+		profile "dev" {
+			upcase = true
+			token  = "dev1234"
+		}
+		profile "prod" {
+			prefix {
+				path = "app/prod"
+			}
+		}
+	`
+
+	expected, err := Parse(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{FormatHCL, FormatJSON, FormatYAML} {
+		t.Run(format, func(t *testing.T) {
+			b, err := EncodeConfig(expected, format, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c, err := ParseFormat(string(b), format)
+			if err != nil {
+				t.Fatalf("%s\n%s", err, b)
+			}
+
+			if !reflect.DeepEqual(expected, c) {
+				t.Errorf("\nexp: %#v\nact: %#v\nencoded:\n%s", expected, c, b)
+			}
+
+			// The migrated config has none of the deprecated keys
+			for key := range deprecatedKeys {
+				if !strings.Contains(key, ".") && strings.Contains(string(b), "\n"+key+" ") {
+					t.Errorf("deprecated key %q in:\n%s", key, b)
+				}
+			}
+		})
+	}
+
+	t.Run("redact", func(t *testing.T) {
+		c := TestConfig(expected)
+		c.Vault.Token = config.String("s.vaulttoken")
+
+		b, err := EncodeConfig(c, FormatHCL, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, secret := range []string{"pass", "abcd1234", "dev1234", "s.vaulttoken"} {
+			if strings.Contains(string(b), `"`+secret+`"`) {
+				t.Errorf("secret %q not redacted in:\n%s", secret, b)
+			}
+		}
+		if !strings.Contains(string(b), `token = "<redacted>"`) {
+			t.Errorf("expected redacted token in:\n%s", b)
+		}
+	})
+}
+
 func TestConfig_Merge(t *testing.T) {
 	cases := []struct {
 		name string
@@ -1405,18 +2097,38 @@ func TestConfig_Merge(t *testing.T) {
 		{
 			"exec",
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					Command: []string{"command"},
-				},
+				}},
 			},
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					Command: []string{"command-diff"},
-				},
+				}},
 			},
 			&Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					Command: []string{"command-diff"},
+				}},
+			},
+		},
+		{
+			"exec_groups",
+			&Config{
+				Exec: &ExecConfig{
+					User:   config.String("app"),
+					Groups: []string{"vault"},
+				},
+			},
+			&Config{
+				Exec: &ExecConfig{
+					Groups: []string{"consul"},
+				},
+			},
+			&Config{
+				Exec: &ExecConfig{
+					User:   config.String("app"),
+					Groups: []string{"consul"},
 				},
 			},
 		},
@@ -1558,6 +2270,18 @@ func TestConfig_Merge(t *testing.T) {
 				},
 			},
 		},
+		{
+			"status_file",
+			&Config{
+				StatusFile: config.String("status_file"),
+			},
+			&Config{
+				StatusFile: config.String("status_file-diff"),
+			},
+			&Config{
+				StatusFile: config.String("status_file-diff"),
+			},
+		},
 		{
 			"syslog",
 			&Config{
@@ -1682,6 +2406,40 @@ func TestFromPath(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	typedDir, err := ioutil.TempDir(os.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(typedDir)
+	for name, contents := range map[string]string{
+		"consul.hcl":      `consul { address = "1.2.3.4" }`,
+		"token.json":      `{"consul": {"token": "token"}}`,
+		"pid.yaml":        `pid_file: /var/run/envconsul.pid`,
+		".consul.hcl.swp": `not a config file`,
+		"README.md":       `# not a config file`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(typedDir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A Kubernetes ConfigMap mount, every file is loaded once
+	configMapDir := t.TempDir()
+	dataDir := filepath.Join(configMapDir, "..2022_01_01_00_00_00.1")
+	if err := os.Mkdir(dataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	d = []byte(`prefix { path = "foo" }`)
+	if err := ioutil.WriteFile(filepath.Join(dataDir, "prefix.hcl"), d, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Base(dataDir), filepath.Join(configMapDir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("..data/prefix.hcl", filepath.Join(configMapDir, "prefix.hcl")); err != nil {
+		t.Fatal(err)
+	}
+
 	cases := []struct {
 		name string
 		path string
@@ -1717,6 +2475,30 @@ func TestFromPath(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"config_dir_formats",
+			typedDir,
+			&Config{
+				Consul: &config.ConsulConfig{
+					Address: config.String("1.2.3.4"),
+					Token:   config.String("token"),
+				},
+				PidFile: config.String("/var/run/envconsul.pid"),
+			},
+			false,
+		},
+		{
+			"config_map",
+			configMapDir,
+			&Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						Path: config.String("foo"),
+					},
+				},
+			},
+			false,
+		},
 	}
 
 	for i, tc := range cases {
@@ -1732,6 +2514,119 @@ func TestFromPath(t *testing.T) {
 	}
 }
 
+func TestConfigFiles(t *testing.T) {
+	root := t.TempDir()
+
+	write := func(path, contents string) {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	symlink := func(target, path string) {
+		if err := os.Symlink(target, filepath.Join(root, path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Files are loaded in lexical order, editor and backup files are skipped
+	write("ordered/b.hcl", "")
+	write("ordered/a.json", "{}")
+	write("ordered/c/a.yaml", "")
+	write("ordered/c.hcl", "")
+	write("ordered/d", "")
+	write("ordered/.a.hcl.swp", "")
+	write("ordered/a.hcl~", "")
+	write("ordered/#a.hcl#", "")
+
+	// A Kubernetes ConfigMap mount: the keys are symlinks through the
+	// "..data" symlink to a hidden timestamped directory
+	write("configmap/..2022_01_01_00_00_00.1/consul.hcl", "")
+	write("configmap/..2022_01_01_00_00_00.1/vault.hcl", "")
+	symlink("..2022_01_01_00_00_00.1", "configmap/..data")
+	symlink("..data/consul.hcl", "configmap/consul.hcl")
+	symlink("..data/vault.hcl", "configmap/vault.hcl")
+
+	// Symlinked directories are followed, loops are not
+	write("linked/target/a.hcl", "")
+	symlink("target", "linked/z")
+	symlink("..", "linked/target/loop")
+
+	cases := []struct {
+		name string
+		path string
+		exp  []string
+		err  bool
+	}{
+		{
+			"ordered",
+			"ordered",
+			[]string{"ordered/a.json", "ordered/b.hcl", "ordered/c/a.yaml", "ordered/c.hcl", "ordered/d"},
+			false,
+		},
+		{
+			"configmap",
+			"configmap",
+			[]string{"configmap/consul.hcl", "configmap/vault.hcl"},
+			false,
+		},
+		{
+			"symlinks",
+			"linked",
+			[]string{"linked/target/a.hcl", "linked/z/a.hcl"},
+			false,
+		},
+		{
+			"glob",
+			"*/*.hcl",
+			[]string{"configmap/consul.hcl", "configmap/vault.hcl", "ordered/b.hcl", "ordered/c.hcl"},
+			false,
+		},
+		{
+			"glob_dirs",
+			"ordered/c*",
+			[]string{"ordered/c/a.yaml", "ordered/c.hcl"},
+			false,
+		},
+		{
+			"glob_no_match",
+			"*/*.toml",
+			nil,
+			true,
+		},
+		{
+			"missing",
+			"missing.hcl",
+			nil,
+			true,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			files, err := configFiles(filepath.Join(root, tc.path))
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+
+			var act []string
+			for _, file := range files {
+				rel, err := filepath.Rel(root, file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				act = append(act, filepath.ToSlash(rel))
+			}
+			if !reflect.DeepEqual(tc.exp, act) {
+				t.Errorf("\nexp: %#v\nact: %#v", tc.exp, act)
+			}
+		})
+	}
+}
+
 func TestDefaultConfig(t *testing.T) {
 	cases := []struct {
 		env string
@@ -2003,3 +2898,138 @@ func TestFinalize(t *testing.T) {
 		})
 	}
 }
+
+func TestPrefixConfigs_Finalize(t *testing.T) {
+	c := &PrefixConfigs{
+		&PrefixConfig{Path: config.String("")},
+		&PrefixConfig{Path: config.String("foo")},
+		&PrefixConfig{},
+		&PrefixConfig{Path: config.String("bar")},
+	}
+	c.Finalize()
+
+	// Blocks without a path are dropped, not left unfinalized
+	if len(*c) != 2 {
+		t.Fatalf("expected 2 prefixes, got %#v", c)
+	}
+	for i, exp := range []string{"foo", "bar"} {
+		p := (*c)[i]
+		if act := config.StringVal(p.Path); act != exp {
+			t.Errorf("expected prefix %q, got %q", exp, act)
+		}
+		if p.Format == nil {
+			t.Errorf("expected prefix %q to be finalized", exp)
+		}
+	}
+}
+
+func TestInterpolateEnv(t *testing.T) {
+	t.Setenv("ENVCONSUL_TEST_ADDR", "1.2.3.4:8500")
+	t.Setenv("ENVCONSUL_TEST_EMPTY", "")
+	os.Unsetenv("ENVCONSUL_TEST_MISSING")
+
+	t.Run("strings", func(t *testing.T) {
+		cases := []struct {
+			name string
+			s    string
+			e    string
+			err  bool
+		}{
+			{"plain", "foo", "foo", false},
+			{"braces", "${ENVCONSUL_TEST_ADDR}", "1.2.3.4:8500", false},
+			{"embedded", "http://${ENVCONSUL_TEST_ADDR}/v1", "http://1.2.3.4:8500/v1", false},
+			{"default_unset", "${ENVCONSUL_TEST_MISSING:-foo}", "foo", false},
+			{"default_empty", "${ENVCONSUL_TEST_EMPTY:-foo}", "foo", false},
+			{"dash_default_empty", "${ENVCONSUL_TEST_EMPTY-foo}", "", false},
+			{"dash_default_unset", "${ENVCONSUL_TEST_MISSING-foo}", "foo", false},
+			{"set_with_default", "${ENVCONSUL_TEST_ADDR:-foo}", "1.2.3.4:8500", false},
+			{"missing", "${ENVCONSUL_TEST_MISSING}", "", true},
+			{"escape", "$${ENVCONSUL_TEST_ADDR}", "${ENVCONSUL_TEST_ADDR}", false},
+			{"dollars", "pa$$word", "pa$$word", false},
+			{"template", `{{ env "ENVCONSUL_TEST_ADDR" }}`, "1.2.3.4:8500", false},
+			{"template_default", `{{ env "ENVCONSUL_TEST_MISSING" "foo" }}`, "foo", false},
+			{"template_missing", `{{ env "ENVCONSUL_TEST_MISSING" }}`, "", true},
+			{"other_template", `{{ key }}_{{ env "ENVCONSUL_TEST_EMPTY" }}`, "{{ key }}_", false},
+		}
+
+		for i, tc := range cases {
+			t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+				s, err := expandEnvRefs(tc.s)
+				if (err != nil) != tc.err {
+					t.Fatal(err)
+				}
+				if !tc.err && s != tc.e {
+					t.Errorf("\nexp: %q\nact: %q", tc.e, s)
+				}
+			})
+		}
+	})
+
+	t.Run("config", func(t *testing.T) {
+		c, err := Parse(`
+			consul {
+				address = "${ENVCONSUL_TEST_ADDR}"
+			}
+			exec {
+				command = "echo $${HOME}"
+			}
+			prefix {
+				path   = "app/${ENVCONSUL_TEST_MISSING:-web}"
+				format = "{{ key }}"
+			}
+			service {
+				query = "{{ env \"ENVCONSUL_TEST_MISSING\" \"web\" }}"
+			}
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		address := c.Consul.Address
+
+		if err := interpolateEnv(c); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := &Config{
+			Consul: &config.ConsulConfig{
+				Address: config.String("1.2.3.4:8500"),
+			},
+			Exec: &ExecConfig{ExecConfig: config.ExecConfig{
+				Command: []string{"echo ${HOME}"},
+			}},
+			Prefixes: &PrefixConfigs{
+				&PrefixConfig{
+					Path:   config.String("app/web"),
+					Format: config.String("{{ key }}"),
+				},
+			},
+			Services: &ServiceConfigs{
+				&ServiceConfig{
+					Query: config.String("web"),
+				},
+			},
+		}
+		if !reflect.DeepEqual(expected, c) {
+			t.Errorf("\nexp: %#v\nact: %#v", expected, c)
+		}
+
+		// The parsed strings are replaced, not changed
+		if *address != "${ENVCONSUL_TEST_ADDR}" {
+			t.Errorf("expected the original string to be kept, got %q", *address)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		c := Must(`vault { address = "${ENVCONSUL_TEST_MISSING}" }`)
+		err := interpolateEnv(c)
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if !strings.Contains(err.Error(), "vault.address") {
+			t.Errorf("expected error naming vault.address, got %v", err)
+		}
+		if !strings.Contains(err.Error(), "$${ENVCONSUL_TEST_MISSING}") {
+			t.Errorf("expected error suggesting the escape, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+// DefaultConfigWatchDebounce is the default time to wait for configuration
+// files to stop changing before reloading.
+const DefaultConfigWatchDebounce = 1 * time.Second
+
+// ConfigWatchConfig is the configuration for reloading automatically when the
+// configuration files change.
+type ConfigWatchConfig struct {
+	// Enabled turns watching the -config paths on.
+	Enabled *bool `mapstructure:"enabled"`
+
+	// Debounce is the time to wait after the last change before reloading, so
+	// that files written in several steps are loaded once.
+	Debounce *time.Duration `mapstructure:"debounce"`
+}
+
+func DefaultConfigWatchConfig() *ConfigWatchConfig {
+	return &ConfigWatchConfig{}
+}
+
+func (c *ConfigWatchConfig) Copy() *ConfigWatchConfig {
+	if c == nil {
+		return nil
+	}
+
+	return &ConfigWatchConfig{
+		Enabled:  c.Enabled,
+		Debounce: c.Debounce,
+	}
+}
+
+func (c *ConfigWatchConfig) Merge(o *ConfigWatchConfig) *ConfigWatchConfig {
+	if c == nil {
+		if o == nil {
+			return nil
+		}
+		return o.Copy()
+	}
+
+	if o == nil {
+		return c.Copy()
+	}
+
+	r := c.Copy()
+
+	if o.Enabled != nil {
+		r.Enabled = o.Enabled
+	}
+
+	if o.Debounce != nil {
+		r.Debounce = o.Debounce
+	}
+
+	return r
+}
+
+func (c *ConfigWatchConfig) Finalize() {
+	if c.Debounce == nil {
+		c.Debounce = config.TimeDuration(DefaultConfigWatchDebounce)
+	}
+
+	if c.Enabled == nil {
+		c.Enabled = config.Bool(false)
+	}
+}
+
+func (c *ConfigWatchConfig) GoString() string {
+	if c == nil {
+		return "(*ConfigWatchConfig)(nil)"
+	}
+
+	return fmt.Sprintf("&ConfigWatchConfig{"+
+		"Enabled:%s, "+
+		"Debounce:%s"+
+		"}",
+		config.BoolGoString(c.Enabled),
+		config.TimeDurationGoString(c.Debounce),
+	)
+}
+
+// configSnapshot returns a digest of the names and contents of the
+// configuration files at the given paths. Watchers report any change in the
+// watched directories, comparing snapshots tells if a config file changed.
+func configSnapshot(paths []string) (string, error) {
+	h := sha256.New()
+	for _, path := range paths {
+		files, err := configFiles(path)
+		if err != nil {
+			return "", err
+		}
+		for _, file := range files {
+			f, err := os.Open(file)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(h, "%s\x00", file)
+			_, err = io.Copy(h, f)
+			f.Close()
+			if err != nil {
+				return "", err
+			}
+			h.Write([]byte{0})
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,149 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// configWatchMask are the inotify events that may change a configuration file,
+// including the symlink swaps of Kubernetes ConfigMap mounts.
+const configWatchMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// configWatcher reports changes to the configuration files at the given paths
+// on its channel, using inotify. Files are watched through their directory,
+// so that files replaced by editors or renames are noticed, and directories
+// are watched recursively. Events are coalesced and may be reported for
+// unrelated files in the watched directories.
+type configWatcher struct {
+	ch chan struct{}
+
+	paths    []string
+	fd       int
+	file     *os.File
+	stopOnce sync.Once
+}
+
+func newConfigWatcher(paths []string) (*configWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	// A non-blocking file is read through the runtime poller, so closing it
+	// stops the read loop. Calling Fd() would make it blocking again, so the
+	// descriptor is kept for adding watches.
+	w := &configWatcher{
+		ch:    make(chan struct{}, 1),
+		paths: paths,
+		fd:    fd,
+		file:  os.NewFile(uintptr(fd), "inotify"),
+	}
+	if err := w.addWatches(); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// addWatches watches the directory of every file path and every directory
+// below the directory paths. Glob patterns are watched through their matches
+// and the directory of the pattern. Adding a watch again is a no-op, so it is
+// called after every event to pick up new directories and matches.
+func (w *configWatcher) addWatches() error {
+	for _, path := range w.paths {
+		if _, err := os.Stat(path); os.IsNotExist(err) && hasGlobMeta(path) {
+			if dir := filepath.Dir(path); !hasGlobMeta(dir) {
+				if err := w.addWatch(dir); err != nil {
+					return err
+				}
+			}
+
+			matches, _ := filepath.Glob(path)
+			for _, match := range matches {
+				if err := w.addPathWatches(match); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if err := w.addPathWatches(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *configWatcher) addPathWatches(path string) error {
+	stat, err := os.Stat(path)
+	if err != nil || !stat.IsDir() {
+		// Missing paths are watched through their directory, to notice when
+		// they are created
+		return w.addWatch(filepath.Dir(path))
+	}
+
+	if err := w.addWatch(path); err != nil {
+		return err
+	}
+	return walkConfigDir(path, func(p string, info os.FileInfo) error {
+		if !info.IsDir() {
+			return nil
+		}
+		return w.addWatch(p)
+	})
+}
+
+func (w *configWatcher) addWatch(dir string) error {
+	if _, err := syscall.InotifyAddWatch(w.fd, dir, configWatchMask); err != nil {
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	return nil
+}
+
+func (w *configWatcher) run() {
+	logger := namedLogger("watch")
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			logger.Trace("stopped watching configuration files", "error", err)
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				logger.Debug("inotify queue overflow")
+			}
+		}
+
+		if err := w.addWatches(); err != nil {
+			logger.Warn("failed watching configuration files", "error", err)
+		}
+
+		select {
+		case w.ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Stop stops watching. The channel is not closed.
+func (w *configWatcher) Stop() {
+	w.stopOnce.Do(func() {
+		w.file.Close()
+	})
+}
@@ -0,0 +1,67 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// configWatchPollInterval is how often the configuration files are checked
+// for changes on platforms without inotify.
+const configWatchPollInterval = 1 * time.Second
+
+// configWatcher reports possible changes to the configuration files on its
+// channel. Without inotify it polls the snapshot of the files, and reports
+// when it differs from the previous one.
+type configWatcher struct {
+	ch chan struct{}
+
+	paths    []string
+	snapshot string
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+func newConfigWatcher(paths []string) (*configWatcher, error) {
+	w := &configWatcher{
+		ch:     make(chan struct{}, 1),
+		paths:  paths,
+		stopCh: make(chan struct{}),
+	}
+	// Files that cannot be read yet are reported once they can
+	w.snapshot, _ = configSnapshot(paths)
+	go w.run()
+	return w, nil
+}
+
+func (w *configWatcher) run() {
+	ticker := time.NewTicker(configWatchPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			snapshot, err := configSnapshot(w.paths)
+			if err != nil || snapshot == w.snapshot {
+				continue
+			}
+			w.snapshot = snapshot
+			select {
+			case w.ch <- struct{}{}:
+			default:
+			}
+		case <-w.stopCh:
+			return
+		}
+	}
+}
+
+// Stop stops watching. The channel is not closed.
+func (w *configWatcher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stopCh)
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// EnvDiff is the key-level difference between the previous and the new
+// environment of the child process.
+type EnvDiff struct {
+	// Time is when the environment changed.
+	Time time.Time `json:"time"`
+
+	// Added, Changed and Removed are the sorted names of the keys.
+	Added   []string `json:"added"`
+	Changed []string `json:"changed"`
+	Removed []string `json:"removed"`
+}
+
+// diffEnv returns the difference of the keys from old to env.
+func diffEnv(old, env map[string]string) *EnvDiff {
+	d := &EnvDiff{
+		Time:    time.Now().UTC(),
+		Added:   []string{},
+		Changed: []string{},
+		Removed: []string{},
+	}
+	for k, v := range env {
+		ov, ok := old[k]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, k)
+		case ov != v:
+			d.Changed = append(d.Changed, k)
+		}
+	}
+	for k := range old {
+		if _, ok := env[k]; !ok {
+			d.Removed = append(d.Removed, k)
+		}
+	}
+
+	sort.Strings(d.Added)
+	sort.Strings(d.Changed)
+	sort.Strings(d.Removed)
+	return d
+}
+
+// Copy returns a deep copy of the diff.
+func (d *EnvDiff) Copy() *EnvDiff {
+	if d == nil {
+		return nil
+	}
+	return &EnvDiff{
+		Time:    d.Time,
+		Added:   append([]string{}, d.Added...),
+		Changed: append([]string{}, d.Changed...),
+		Removed: append([]string{}, d.Removed...),
+	}
+}
+
+// String returns a summary of the diff, like "added: A, B; removed: C".
+func (d *EnvDiff) String() string {
+	var parts []string
+	for _, p := range []struct {
+		name string
+		keys []string
+	}{
+		{"added", d.Added},
+		{"changed", d.Changed},
+		{"removed", d.Removed},
+	} {
+		if len(p.keys) > 0 {
+			parts = append(parts, p.name+": "+strings.Join(p.keys, ", "))
+		}
+	}
+	if len(parts) == 0 {
+		return "no changes"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Env returns the diff as environment variables for hook commands, with the
+// names of the keys separated by commas.
+func (d *EnvDiff) Env() []string {
+	return []string{
+		"ENVCONSUL_ENV_ADDED=" + strings.Join(d.Added, ","),
+		"ENVCONSUL_ENV_CHANGED=" + strings.Join(d.Changed, ","),
+		"ENVCONSUL_ENV_REMOVED=" + strings.Join(d.Removed, ","),
+		"ENVCONSUL_ENV_DIFF=" + d.String(),
+	}
+}
+
+// logValues returns the new values of the added and changed keys, and the
+// previous values of the changed and removed keys, for logging.
+func (d *EnvDiff) logValues(old, env map[string]string) (values, oldValues map[string]string) {
+	values = make(map[string]string, len(d.Added)+len(d.Changed))
+	oldValues = make(map[string]string, len(d.Changed)+len(d.Removed))
+	for _, k := range append(append([]string{}, d.Added...), d.Changed...) {
+		values[k] = env[k]
+	}
+	for _, k := range append(append([]string{}, d.Changed...), d.Removed...) {
+		oldValues[k] = old[k]
+	}
+	return values, oldValues
+}
@@ -0,0 +1,50 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// rlimitResources maps the names of the rlimits to their resources.
+var rlimitResources = map[string]int{
+	"core":    unix.RLIMIT_CORE,
+	"memlock": unix.RLIMIT_MEMLOCK,
+	"nofile":  unix.RLIMIT_NOFILE,
+	"nproc":   unix.RLIMIT_NPROC,
+}
+
+// setNoNewPrivs sets the no_new_privs flag of the calling thread, which is
+// inherited by the command it executes and all its children.
+func setNoNewPrivs() error {
+	return unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+}
+
+// applyLimits moves the shim to the cgroup of the child process and sets its
+// rlimits, which are kept across the exec.
+func applyLimits(s *execShim) error {
+	if s.Cgroup != "" {
+		procs := filepath.Join(s.Cgroup, "cgroup.procs")
+		if err := ioutil.WriteFile(procs, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+			return fmt.Errorf("joining cgroup: %s", err)
+		}
+	}
+
+	for _, l := range s.Rlimits {
+		resource, ok := rlimitResources[l.Name]
+		if !ok {
+			return fmt.Errorf("unknown rlimit %q", l.Name)
+		}
+		if err := unix.Setrlimit(resource, &unix.Rlimit{Cur: l.Cur, Max: l.Max}); err != nil {
+			return fmt.Errorf("setting rlimit %s: %s", l.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import (
+	"fmt"
+)
+
+// setNoNewPrivs fails, as no_new_privs only exists on Linux.
+func setNoNewPrivs() error {
+	return fmt.Errorf("only supported on linux")
+}
+
+// applyLimits does nothing, as the limits are only applied on Linux.
+func applyLimits(s *execShim) error {
+	return nil
+}
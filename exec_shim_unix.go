@@ -0,0 +1,212 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// execShimEnv is the environment variable that makes envconsul run as the exec
+// shim of the child process, with the execShim settings as JSON.
+const execShimEnv = "ENVCONSUL_EXEC_SHIM"
+
+// execShim holds the settings the exec shim applies to its own process before
+// it executes the command of the child, which cannot be set through the
+// consul-template child package. The shim keeps the pid of the child, so it
+// can also set LISTEN_PID.
+type execShim struct {
+	// ListenFDs are the descriptors of the listeners inherited from envconsul,
+	// moved to 3 and up for the command, and ListenNames their names.
+	ListenFDs   []int    `json:"listen_fds,omitempty"`
+	ListenNames []string `json:"listen_names,omitempty"`
+
+	// Credential is the user and groups to switch to, if any.
+	Credential *execCredential `json:"credential,omitempty"`
+
+	// Umask is the file mode creation mask to set, if any.
+	Umask *int `json:"umask,omitempty"`
+
+	// Dir is the directory to change to, after switching users.
+	Dir string `json:"dir,omitempty"`
+
+	// NoNewPrivs sets the no_new_privs flag, kept across the exec.
+	NoNewPrivs bool `json:"no_new_privs,omitempty"`
+
+	// Cgroup is the directory of the cgroup to join and Rlimits the resource
+	// limits to set, on Linux.
+	Cgroup  string       `json:"cgroup,omitempty"`
+	Rlimits []execRlimit `json:"rlimits,omitempty"`
+
+	// Foreground makes the process group of the child the foreground one of
+	// the terminal on stdin, as the child runs in its own group in init mode.
+	Foreground bool `json:"foreground,omitempty"`
+}
+
+// wrap returns the command, arguments and environment to run the command in
+// args through the shim.
+func (s *execShim) wrap(args, env []string) (string, []string, []string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("exec shim: %s", err)
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("exec shim: %s", err)
+	}
+	return exe, args, append(append([]string{}, env...), execShimEnv+"="+string(b)), nil
+}
+
+// setInheritable sets whether the descriptor is inherited by the processes
+// started by envconsul.
+func setInheritable(fd int, inheritable bool) error {
+	flags := 0
+	if !inheritable {
+		flags = unix.FD_CLOEXEC
+	}
+	_, err := unix.FcntlInt(uintptr(fd), unix.F_SETFD, flags)
+	return err
+}
+
+// isTerminal reports whether the file is a terminal.
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetWinsize(int(f.Fd()), unix.TIOCGWINSZ)
+	return err == nil
+}
+
+// takeTerminal makes the process group of the shim the foreground process
+// group of the terminal on stdin. SIGTTOU is ignored meanwhile, as a process
+// outside of the foreground group is stopped when changing it otherwise.
+func takeTerminal() error {
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+	return unix.IoctlSetPointerInt(0, unix.TIOCSPGRP, syscall.Getpgrp())
+}
+
+// runExecShim applies the settings to the current process and executes the
+// command in args, which keeps the pid. It only returns on errors.
+func runExecShim(settings string, args []string) int {
+	if err := execWithShim(settings, args); err != nil {
+		fmt.Fprintf(os.Stderr, "envconsul exec shim: %s\n", err)
+	}
+	return 127
+}
+
+func execWithShim(settings string, args []string) error {
+	var s execShim
+	if err := json.Unmarshal([]byte(settings), &s); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("missing command")
+	}
+
+	// no_new_privs is set on the thread, which must be the one executing the
+	// command
+	runtime.LockOSThread()
+
+	var env []string
+	for _, kv := range os.Environ() {
+		switch strings.SplitN(kv, "=", 2)[0] {
+		case execShimEnv, "LISTEN_FDS", "LISTEN_PID", "LISTEN_FDNAMES":
+			continue
+		}
+		env = append(env, kv)
+	}
+
+	if len(s.ListenFDs) > 0 {
+		if err := moveListenFDs(s.ListenFDs); err != nil {
+			return err
+		}
+		env = append(env,
+			"LISTEN_FDS="+strconv.Itoa(len(s.ListenFDs)),
+			"LISTEN_PID="+strconv.Itoa(os.Getpid()),
+			"LISTEN_FDNAMES="+strings.Join(s.ListenNames, ":"))
+	}
+
+	// A child reading from the terminal outside of the foreground process
+	// group would be stopped
+	if s.Foreground {
+		if err := takeTerminal(); err != nil {
+			return fmt.Errorf("taking the terminal: %s", err)
+		}
+	}
+
+	// Limits go first, while the shim still has the privileges to raise them
+	// and to join the cgroup
+	if err := applyLimits(&s); err != nil {
+		return err
+	}
+
+	// These apply to all the threads of the process
+	if c := s.Credential; c != nil {
+		groups := make([]int, len(c.Groups))
+		for i, g := range c.Groups {
+			groups[i] = int(g)
+		}
+		if err := syscall.Setgroups(groups); err != nil {
+			return fmt.Errorf("setgroups: %s", err)
+		}
+		if err := syscall.Setgid(int(c.GID)); err != nil {
+			return fmt.Errorf("setgid: %s", err)
+		}
+		if err := syscall.Setuid(int(c.UID)); err != nil {
+			return fmt.Errorf("setuid: %s", err)
+		}
+	}
+	if s.Umask != nil {
+		syscall.Umask(*s.Umask)
+	}
+	if s.Dir != "" {
+		if err := os.Chdir(s.Dir); err != nil {
+			return err
+		}
+	}
+	if s.NoNewPrivs {
+		if err := setNoNewPrivs(); err != nil {
+			return fmt.Errorf("no_new_privs: %s", err)
+		}
+	}
+
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(path, args, env)
+}
+
+// moveListenFDs moves the descriptors to 3 and up, in order, without closing
+// any of them on the way.
+func moveListenFDs(fds []int) error {
+	const first = 3
+
+	// Duplicate every descriptor above the target range first, as a target
+	// may be the source of another one
+	tmp := make([]int, len(fds))
+	for i, fd := range fds {
+		nfd, err := unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, first+len(fds))
+		if err != nil {
+			return err
+		}
+		tmp[i] = nfd
+	}
+
+	// Dup2 clears the close-on-exec flag of the target
+	for i, fd := range tmp {
+		if err := unix.Dup2(fd, first+i); err != nil {
+			return err
+		}
+		unix.Close(fd)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// execShimEnv is the environment variable that makes envconsul run as the exec
+// shim of the child process. The shim is not supported on Windows.
+const execShimEnv = "ENVCONSUL_EXEC_SHIM"
+
+// execShim holds the settings the exec shim applies before it executes the
+// command of the child. See exec_shim_unix.go.
+type execShim struct {
+	ListenFDs   []int           `json:"listen_fds,omitempty"`
+	ListenNames []string        `json:"listen_names,omitempty"`
+	Credential  *execCredential `json:"credential,omitempty"`
+	Umask       *int            `json:"umask,omitempty"`
+	Dir         string          `json:"dir,omitempty"`
+	NoNewPrivs  bool            `json:"no_new_privs,omitempty"`
+	Cgroup      string          `json:"cgroup,omitempty"`
+	Rlimits     []execRlimit    `json:"rlimits,omitempty"`
+	Foreground  bool            `json:"foreground,omitempty"`
+}
+
+func (s *execShim) wrap(args, env []string) (string, []string, []string, error) {
+	return "", nil, nil, fmt.Errorf("exec shim: not supported on windows")
+}
+
+func isTerminal(f *os.File) bool {
+	return false
+}
+
+func setInheritable(fd int, inheritable bool) error {
+	return nil
+}
+
+func runExecShim(settings string, args []string) int {
+	fmt.Fprintln(os.Stderr, "envconsul exec shim: not supported on windows")
+	return 127
+}
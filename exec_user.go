@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// execCredential is the user and groups the exec shim switches to before it
+// executes the command of the child process.
+type execCredential struct {
+	UID    uint32   `json:"uid"`
+	GID    uint32   `json:"gid"`
+	Groups []uint32 `json:"groups"`
+}
+
+// lookupCredential resolves the user, group and supplementary groups of the
+// child process, given by name or id. The group defaults to the primary group
+// of the user, and the supplementary groups to the groups the user is a member
+// of. Without a user, the child keeps the uid of envconsul and only gets the
+// given groups.
+func lookupCredential(name, group string, groups []string) (*execCredential, error) {
+	c := &execCredential{}
+
+	var u *user.User
+	if name != "" {
+		var err error
+		if u, err = lookupUser(name); err != nil {
+			return nil, err
+		}
+		if u != nil {
+			uid, err := parseID(u.Uid)
+			if err != nil {
+				return nil, fmt.Errorf("exec user %q: %s", name, err)
+			}
+			gid, err := parseID(u.Gid)
+			if err != nil {
+				return nil, fmt.Errorf("exec user %q: %s", name, err)
+			}
+			c.UID, c.GID = uid, gid
+		} else if group == "" {
+			return nil, fmt.Errorf("exec user %q does not exist, "+
+				"exec group is required for a uid without a user", name)
+		} else {
+			c.UID, _ = parseID(name)
+		}
+	} else {
+		c.UID, c.GID = uint32(os.Getuid()), uint32(os.Getgid())
+	}
+
+	if group != "" {
+		gid, err := lookupGroup(group)
+		if err != nil {
+			return nil, err
+		}
+		c.GID = gid
+	}
+
+	switch {
+	case len(groups) > 0:
+		for _, g := range groups {
+			gid, err := lookupGroup(g)
+			if err != nil {
+				return nil, err
+			}
+			c.Groups = append(c.Groups, gid)
+		}
+	case u != nil:
+		ids, err := u.GroupIds()
+		if err != nil {
+			return nil, fmt.Errorf("exec user %q: listing groups: %s", name, err)
+		}
+		for _, id := range ids {
+			gid, err := parseID(id)
+			if err != nil {
+				return nil, fmt.Errorf("exec user %q: %s", name, err)
+			}
+			c.Groups = append(c.Groups, gid)
+		}
+	default:
+		// Never keep the supplementary groups of envconsul
+		c.Groups = []uint32{c.GID}
+	}
+
+	return c, nil
+}
+
+// lookupUser looks up a user by name or uid. A uid of a user that does not
+// exist gives a nil user, as long as it is a valid id.
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if err == nil {
+		return u, nil
+	}
+	if _, perr := parseID(name); perr != nil {
+		return nil, fmt.Errorf("exec user %q: %s", name, err)
+	}
+
+	u, err = user.LookupId(name)
+	if _, ok := err.(user.UnknownUserIdError); ok {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("exec user %q: %s", name, err)
+	}
+	return u, nil
+}
+
+// lookupGroup looks up a group by name or gid. Any valid gid is accepted,
+// even if the group does not exist.
+func lookupGroup(name string) (uint32, error) {
+	if gid, err := parseID(name); err == nil {
+		return gid, nil
+	}
+
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("exec group %q: %s", name, err)
+	}
+	gid, err := parseID(g.Gid)
+	if err != nil {
+		return 0, fmt.Errorf("exec group %q: %s", name, err)
+	}
+	return gid, nil
+}
+
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid id %q", s)
+	}
+	return uint32(id), nil
+}
+
+// parseUmask parses an octal file mode creation mask, like "027".
+func parseUmask(s string) (int, error) {
+	umask, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || umask > 0777 {
+		return 0, fmt.Errorf("invalid exec umask %q, expected an octal mode like \"027\"", s)
+	}
+	return int(umask), nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+
+	"github.com/hashicorp/consul-template/child"
+	"github.com/hashicorp/consul-template/config"
+	"github.com/pkg/errors"
+)
+
+// Names of the hooks, as in the configuration.
+const (
+	hookPreStart  = "pre_start"
+	hookPostStart = "post_start"
+	hookOnChange  = "on_change"
+	hookPreStop   = "pre_stop"
+)
+
+// hookCommand returns the configured command of the named hook.
+func (r *Runner) hookCommand(name string) string {
+	hooks := r.config.Exec.Hooks
+	switch name {
+	case hookPreStart:
+		return config.StringVal(hooks.PreStart)
+	case hookPostStart:
+		return config.StringVal(hooks.PostStart)
+	case hookOnChange:
+		return config.StringVal(hooks.OnChange)
+	case hookPreStop:
+		return config.StringVal(hooks.PreStop)
+	}
+	return ""
+}
+
+// runHook runs the command of the named hook, if configured, and waits for it
+// to finish. The command gets the environment of the child process, and the
+// difference from the previous environment as ENVCONSUL_ENV_* variables. Its
+// output goes to the output of the child. The command is killed when ctx is
+// done.
+func (r *Runner) runHook(ctx context.Context, name string, env []string, diff *EnvDiff) error {
+	command := r.hookCommand(name)
+	if command == "" {
+		return nil
+	}
+
+	if timeout := config.TimeDurationVal(r.config.Exec.Hooks.Timeout); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	env = append([]string{}, env...)
+	if diff != nil {
+		env = append(env, diff.Env()...)
+	}
+	cmd, err := r.commandContext(ctx, command, env)
+	if err != nil {
+		return errors.Wrapf(err, "%s hook", name)
+	}
+	cmd.Stdout = r.outStream
+	cmd.Stderr = r.errStream
+
+	logger := namedLogger("runner")
+	logger.Info("running hook", "event", "hook_started", "hook", name)
+	if err := runCommand(cmd); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return errors.Wrapf(err, "%s hook", name)
+	}
+	logger.Debug("hook finished", "hook", name)
+	return nil
+}
+
+// commandContext returns the command to run a hook or the ready command with
+// the given environment. It runs through the exec shim, as the user and with
+// the limits of the child process.
+func (r *Runner) commandContext(ctx context.Context, command string, env []string) (*exec.Cmd, error) {
+	args, _, err := child.CommandPrep([]string{command})
+	if err != nil {
+		return nil, err
+	}
+
+	shim, err := r.commandShim()
+	if err != nil {
+		return nil, err
+	}
+	name, cargs := args[0], args[1:]
+	if shim != nil {
+		if name, cargs, env, err = shim.wrap(args, env); err != nil {
+			return nil, err
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, name, cargs...)
+	cmd.Env = env
+	return cmd, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+// keyMatcher matches key names against a glob or a regular expression.
+type keyMatcher struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+// newKeyMatcher compiles the given pattern. Patterns wrapped in slashes are
+// regular expressions, everything else is a glob.
+func newKeyMatcher(pattern string) (*keyMatcher, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") &&
+		strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key pattern %q: %s", pattern, err)
+		}
+		return &keyMatcher{re: re}, nil
+	}
+
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid key pattern %q: %s", pattern, err)
+	}
+	return &keyMatcher{glob: pattern}, nil
+}
+
+func (m *keyMatcher) match(key string) bool {
+	if m.re != nil {
+		return m.re.MatchString(key)
+	}
+	matched, _ := filepath.Match(m.glob, key)
+	return matched
+}
+
+// renameRule is a compiled RenameConfig.
+type renameRule struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// keyRules are the compiled include, exclude and rename rules of a
+// PrefixConfig. A nil *keyRules keeps every key as-is.
+type keyRules struct {
+	include []*keyMatcher
+	exclude []*keyMatcher
+	rename  []*renameRule
+}
+
+// newKeyRules compiles the filter and rename rules of the given PrefixConfig.
+// It returns nil if the config has no rules.
+func newKeyRules(c *PrefixConfig) (*keyRules, error) {
+	var r keyRules
+
+	for _, p := range c.Include {
+		m, err := newKeyMatcher(p)
+		if err != nil {
+			return nil, err
+		}
+		r.include = append(r.include, m)
+	}
+
+	for _, p := range c.Exclude {
+		m, err := newKeyMatcher(p)
+		if err != nil {
+			return nil, err
+		}
+		r.exclude = append(r.exclude, m)
+	}
+
+	if c.Rename != nil {
+		for _, rc := range *c.Rename {
+			// The empty pattern matches between every character
+			if !config.StringPresent(rc.Pattern) {
+				return nil, fmt.Errorf("rename requires a pattern")
+			}
+			re, err := regexp.Compile(config.StringVal(rc.Pattern))
+			if err != nil {
+				return nil, fmt.Errorf("invalid rename pattern %q: %s",
+					config.StringVal(rc.Pattern), err)
+			}
+			r.rename = append(r.rename, &renameRule{
+				re:          re,
+				replacement: config.StringVal(rc.Replacement),
+			})
+		}
+	}
+
+	if len(r.include) == 0 && len(r.exclude) == 0 && len(r.rename) == 0 {
+		return nil, nil
+	}
+	return &r, nil
+}
+
+// allowed reports whether the key passes the include and exclude filters.
+// Exclude takes precedence over include.
+func (r *keyRules) allowed(key string) bool {
+	if r == nil {
+		return true
+	}
+
+	if len(r.include) > 0 && !anyKeyMatch(key, r.include) {
+		return false
+	}
+	return !anyKeyMatch(key, r.exclude)
+}
+
+// renamed returns the key rewritten by the first matching rename rule, or the
+// key unchanged if no rule matches. Only the matched part of the key is
+// replaced, so anchor the pattern to rewrite the whole name.
+func (r *keyRules) renamed(key string) string {
+	if r == nil {
+		return key
+	}
+
+	for _, rule := range r.rename {
+		if rule.re.MatchString(key) {
+			return rule.re.ReplaceAllString(key, rule.replacement)
+		}
+	}
+	return key
+}
+
+func anyKeyMatch(key string, matchers []*keyMatcher) bool {
+	for _, m := range matchers {
+		if m.match(key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hashicorp/consul-template/config"
+	"github.com/pkg/errors"
+)
+
+// rlimInfinity is the value of an unlimited rlimit.
+const rlimInfinity = ^uint64(0)
+
+// execRlimit is a resource limit the exec shim sets before it executes the
+// command of the child process.
+type execRlimit struct {
+	Name string `json:"name"`
+	Cur  uint64 `json:"cur"`
+	Max  uint64 `json:"max"`
+}
+
+// parseRlimits parses the configured rlimits, sorted by name.
+func parseRlimits(c *LimitsConfig) ([]execRlimit, error) {
+	var limits []execRlimit
+	for name, value := range c.rlimits() {
+		l, err := parseRlimit(name, value)
+		if err != nil {
+			return nil, err
+		}
+		limits = append(limits, l)
+	}
+	sort.Slice(limits, func(i, j int) bool { return limits[i].Name < limits[j].Name })
+	return limits, nil
+}
+
+// parseRlimit parses a limit given as a value for both the soft and hard
+// limits, or as "soft:hard".
+func parseRlimit(name, value string) (execRlimit, error) {
+	soft, hard := value, value
+	if i := strings.IndexByte(value, ':'); i >= 0 {
+		soft, hard = value[:i], value[i+1:]
+	}
+
+	// Sizes may have a unit
+	size := name == "core" || name == "memlock"
+	cur, err := parseRlimitValue(soft, size)
+	if err != nil {
+		return execRlimit{}, fmt.Errorf("invalid exec limits %s %q: %s", name, value, err)
+	}
+	max, err := parseRlimitValue(hard, size)
+	if err != nil {
+		return execRlimit{}, fmt.Errorf("invalid exec limits %s %q: %s", name, value, err)
+	}
+	if cur > max {
+		return execRlimit{}, fmt.Errorf("invalid exec limits %s %q: "+
+			"the soft limit is above the hard limit", name, value)
+	}
+	return execRlimit{Name: name, Cur: cur, Max: max}, nil
+}
+
+func parseRlimitValue(s string, size bool) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if s == "unlimited" || s == "infinity" {
+		return rlimInfinity, nil
+	}
+
+	var v uint64
+	var err error
+	if size {
+		v, err = parseSize(s)
+	} else {
+		v, err = strconv.ParseUint(s, 10, 64)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("expected a number or \"unlimited\"")
+	}
+	return v, nil
+}
+
+// parseSize parses a size in bytes, with an optional K, M, G or T suffix.
+func parseSize(size string) (uint64, error) {
+	s, unit := size, uint64(1)
+	if s != "" {
+		switch strings.ToUpper(s[len(s)-1:]) {
+		case "K":
+			unit = 1 << 10
+		case "M":
+			unit = 1 << 20
+		case "G":
+			unit = 1 << 30
+		case "T":
+			unit = 1 << 40
+		}
+		if unit > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || v > ^uint64(0)/unit {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return v * unit, nil
+}
+
+// cgroupRoot is the mount point of the cgroup v2 hierarchy, and
+// procSelfCgroup the file giving the cgroup of envconsul.
+var (
+	cgroupRoot     = "/sys/fs/cgroup"
+	procSelfCgroup = "/proc/self/cgroup"
+)
+
+// cgroupLeaf is the cgroup envconsul moves itself to, under the cgroup it
+// started in, when child cgroups cannot get controllers while it has
+// processes.
+const cgroupLeaf = "envconsul"
+
+// cgroupBase is the cgroup envconsul started in. It is only read once, as
+// envconsul may move itself to cgroupLeaf.
+var cgroupBase struct {
+	sync.Once
+	path string
+	err  error
+}
+
+// cgroupControllers maps the cgroup files the limits are written to, to the
+// controllers providing them.
+var cgroupControllers = []struct {
+	file, controller string
+	value            func(*CgroupConfig) *string
+}{
+	{"cpu.max", "cpu", func(c *CgroupConfig) *string { return c.CPUMax }},
+	{"memory.max", "memory", func(c *CgroupConfig) *string { return c.MemoryMax }},
+	{"pids.max", "pids", func(c *CgroupConfig) *string { return c.PidsMax }},
+}
+
+// setupCgroup creates the cgroup of the child process, enabling the
+// controllers of the configured limits along the way, writes the limits and
+// returns the directory of the cgroup.
+func setupCgroup(c *CgroupConfig) (string, error) {
+	cgroupBase.Do(func() {
+		cgroupBase.path, cgroupBase.err = readCgroup()
+	})
+	if cgroupBase.err != nil {
+		return "", cgroupBase.err
+	}
+
+	start, target := cgroupBase.path, config.StringVal(c.Path)
+	if path.IsAbs(target) {
+		start = "/"
+	}
+	target = path.Join(start, target)
+	if target == start || !strings.HasPrefix(target, strings.TrimSuffix(start, "/")+"/") {
+		return "", fmt.Errorf("cgroup: path %q is not below %q", config.StringVal(c.Path), start)
+	}
+	rel := strings.TrimPrefix(target[len(start):], "/")
+
+	var controllers []string
+	for _, cc := range cgroupControllers {
+		if config.StringPresent(cc.value(c)) {
+			controllers = append(controllers, cc.controller)
+		}
+	}
+
+	dir := start
+	for _, name := range strings.Split(rel, "/") {
+		if len(controllers) > 0 {
+			if err := enableControllers(dir, controllers); err != nil {
+				return "", err
+			}
+		}
+		dir = path.Join(dir, name)
+		if err := os.Mkdir(filepath.Join(cgroupRoot, dir), 0755); err != nil && !os.IsExist(err) {
+			return "", fmt.Errorf("cgroup: %s", err)
+		}
+	}
+
+	for _, cc := range cgroupControllers {
+		if v := cc.value(c); config.StringPresent(v) {
+			if err := writeCgroupFile(dir, cc.file, config.StringVal(v)); err != nil {
+				return "", err
+			}
+		}
+	}
+	return filepath.Join(cgroupRoot, dir), nil
+}
+
+// enableControllers enables the controllers for the children of the cgroup.
+// Only cgroups without processes may do so, which is why envconsul moves
+// itself out of the cgroup it started in, as when it runs as PID 1.
+func enableControllers(dir string, controllers []string) error {
+	value := "+" + strings.Join(controllers, " +")
+	err := writeCgroupFile(dir, "cgroup.subtree_control", value)
+	if errors.Is(err, syscall.EBUSY) && dir == cgroupBase.path {
+		leaf := path.Join(dir, cgroupLeaf)
+		if err := os.Mkdir(filepath.Join(cgroupRoot, leaf), 0755); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("cgroup: %s", err)
+		}
+		if err := writeCgroupFile(leaf, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+			return err
+		}
+		namedLogger("runner").Info("moved envconsul to its own cgroup", "cgroup", leaf)
+		err = writeCgroupFile(dir, "cgroup.subtree_control", value)
+	}
+	return err
+}
+
+func writeCgroupFile(dir, file, value string) error {
+	if err := ioutil.WriteFile(filepath.Join(cgroupRoot, dir, file), []byte(value), 0644); err != nil {
+		return errors.Wrapf(err, "cgroup: writing %q to %s", value, path.Join(dir, file))
+	}
+	return nil
+}
+
+// readCgroup returns the cgroup v2 of envconsul.
+func readCgroup() (string, error) {
+	b, err := ioutil.ReadFile(procSelfCgroup)
+	if err != nil {
+		return "", fmt.Errorf("cgroup: %s", err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return path.Clean(strings.TrimPrefix(line, "0::")), nil
+		}
+	}
+	return "", fmt.Errorf("cgroup: not running on the cgroup v2 hierarchy")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/hashicorp/consul-template/config"
+)
+
+// listener is a socket envconsul listens on and passes to the child process.
+// It stays open across restarts of the child, so that connections are queued
+// rather than refused while the new child starts.
+type listener struct {
+	net.Listener
+
+	// file is a duplicate of the socket, passed to the child as fd.
+	file *os.File
+	fd   int
+
+	// name is the name of the socket in LISTEN_FDNAMES.
+	name string
+}
+
+// openListeners opens the configured listeners, closing those already opened
+// if one fails.
+func openListeners(configs *ListenConfigs) ([]*listener, error) {
+	var ls []*listener
+	for _, c := range *configs {
+		l, err := openListener(c)
+		if err != nil {
+			closeListeners(ls)
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+func openListener(c *ListenConfig) (*listener, error) {
+	network, address := config.StringVal(c.Network), config.StringVal(c.Address)
+
+	// Remove the socket left by a previous run that did not clean up, but no
+	// other kind of file
+	if network == "unix" {
+		if fi, err := os.Lstat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+
+	nl, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("listen: %s", err)
+	}
+
+	var f *os.File
+	switch typed := nl.(type) {
+	case *net.TCPListener:
+		f, err = typed.File()
+	case *net.UnixListener:
+		f, err = typed.File()
+	default:
+		err = fmt.Errorf("unsupported network %q", network)
+	}
+	if err != nil {
+		nl.Close()
+		return nil, fmt.Errorf("listen %s: %s", address, err)
+	}
+
+	name := config.StringVal(c.Name)
+	if name == "" {
+		name = "unknown"
+	}
+
+	namedLogger("runner").Info("listening", "network", network, "address", nl.Addr())
+	return &listener{Listener: nl, file: f, fd: int(f.Fd()), name: name}, nil
+}
+
+// closeListeners closes the listeners, removing the files of Unix sockets.
+func closeListeners(ls []*listener) {
+	for _, l := range ls {
+		l.file.Close()
+		l.Close()
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// logWriter is the output of all the loggers. It stays the same across
+// reloads while the writer behind it is swapped, so that the loggers created
+// before a reload write to the new destination instead of a closed file.
+type logWriter struct {
+	sync.Mutex
+
+	w io.Writer
+}
+
+func (l *logWriter) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.w == nil {
+		return len(p), nil
+	}
+	return l.w.Write(p)
+}
+
+// Swap replaces the writer. No write to the previous one is in progress once
+// it returns, so it can be closed.
+func (l *logWriter) Swap(w io.Writer) {
+	l.Lock()
+	defer l.Unlock()
+	l.w = w
+}
+
+// logFile is a log destination that can be reopened, so that logs are written
+// to a new file once logrotate moved the current one away.
+type logFile struct {
+	sync.Mutex
+
+	path string
+	file *os.File
+}
+
+func openLogFile(path string) (*logFile, error) {
+	l := &logFile{path: path}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.file == nil {
+		return 0, os.ErrClosed
+	}
+	return l.file.Write(p)
+}
+
+// Reopen closes the current file and opens the path again, creating it if it
+// was moved away.
+func (l *logFile) Reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = f
+	return nil
+}
+
+func (l *logFile) Close() error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
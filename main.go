@@ -13,6 +13,11 @@ func init() {
 }
 
 func main() {
+	// Run as the exec shim of a child process, see execShim
+	if settings, ok := os.LookupEnv(execShimEnv); ok {
+		os.Exit(runExecShim(settings, os.Args[1:]))
+	}
+
 	cli := NewCLI(os.Stdout, os.Stderr)
 	os.Exit(cli.Run(os.Args))
 }
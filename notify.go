@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// notifier sends state notifications to systemd with the sd_notify protocol,
+// when Envconsul runs as a Type=notify service. A nil notifier sends nothing.
+type notifier struct {
+	// addr is the datagram socket given by systemd in NOTIFY_SOCKET.
+	addr *net.UnixAddr
+
+	// watchdog is the interval to send WATCHDOG=1 at, or zero if the watchdog
+	// is not enabled for the service.
+	watchdog time.Duration
+
+	// readyOnce sends READY=1 when the first child process starts.
+	readyOnce sync.Once
+}
+
+// newNotifier returns a notifier for the socket in NOTIFY_SOCKET, or nil if it
+// is not set. The variables systemd sets for the notifications are removed
+// from the environment, so that the child process does not inherit them.
+func newNotifier() *notifier {
+	path := os.Getenv("NOTIFY_SOCKET")
+	usec, pid := os.Getenv("WATCHDOG_USEC"), os.Getenv("WATCHDOG_PID")
+	for _, name := range []string{"NOTIFY_SOCKET", "WATCHDOG_USEC", "WATCHDOG_PID"} {
+		os.Unsetenv(name)
+	}
+	if path == "" {
+		return nil
+	}
+
+	n := &notifier{addr: &net.UnixAddr{Name: path, Net: "unixgram"}}
+
+	// The watchdog is pinged at half its timeout, unless it was enabled for
+	// another process
+	if usec != "" && (pid == "" || pid == strconv.Itoa(os.Getpid())) {
+		v, err := strconv.ParseInt(usec, 10, 64)
+		if err != nil || v <= 0 {
+			namedLogger("cli").Warn("ignoring invalid WATCHDOG_USEC", "value", usec)
+		} else {
+			n.watchdog = time.Duration(v) * time.Microsecond / 2
+		}
+	}
+	return n
+}
+
+// notify sends the given state assignments, like "READY=1", in a single
+// message. Failures are logged.
+func (n *notifier) notify(state ...string) {
+	if n == nil {
+		return
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, n.addr)
+	if err != nil {
+		namedLogger("cli").Warn("failed notifying systemd", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(strings.Join(state, "\n"))); err != nil {
+		namedLogger("cli").Warn("failed notifying systemd", "error", err)
+	}
+}
+
+// running reports the given status of the child process that started, along
+// with READY=1 the first time a child process starts.
+func (n *notifier) running(status string) {
+	if n == nil {
+		return
+	}
+
+	state := []string{"STATUS=" + status}
+	n.readyOnce.Do(func() {
+		state = append([]string{"READY=1"}, state...)
+	})
+	n.notify(state...)
+}
+
+// watchdogInterval returns the interval to send WATCHDOG=1 at, or zero if the
+// watchdog is not enabled.
+func (n *notifier) watchdogInterval() time.Duration {
+	if n == nil {
+		return 0
+	}
+	return n.watchdog
+}
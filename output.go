@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul-template/config"
+	gsyslog "github.com/hashicorp/go-syslog"
+)
+
+// outputTimeFormat is the format of the timestamps of prefixed and JSON lines.
+const outputTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// maxOutputLine is the length after which a line of the child process is split.
+const maxOutputLine = 64 * 1024
+
+// childOutput is where a stream of the child processes goes when it is not
+// passed through unchanged: the stream of envconsul or a file, and syslog. It
+// is shared by the successive child processes, each writing to it through its
+// own pipe so that their lines are not mixed.
+type childOutput struct {
+	sync.Mutex
+
+	format, tag, stream string
+
+	out    io.Writer
+	file   *rotatingFile
+	syslog gsyslog.Syslogger
+}
+
+// outputLine is a line of the child process in the JSON format.
+type outputLine struct {
+	Timestamp string `json:"@timestamp"`
+	Tag       string `json:"tag"`
+	Stream    string `json:"stream"`
+	Message   string `json:"@message"`
+}
+
+// newChildOutput opens the output of the stream of the child processes, named
+// "stdout" or "stderr", which goes to w unless it goes to a file.
+func newChildOutput(c *OutputConfig, stream string, w io.Writer, sc *config.SyslogConfig) (*childOutput, error) {
+	o := &childOutput{
+		format: config.StringVal(c.Format),
+		tag:    config.StringVal(c.Tag),
+		stream: stream,
+		out:    w,
+	}
+
+	if path := config.StringVal(c.File); path != "" {
+		var maxSize uint64
+		if config.StringPresent(c.MaxSize) {
+			var err error
+			if maxSize, err = parseSize(config.StringVal(c.MaxSize)); err != nil {
+				return nil, fmt.Errorf("exec %s max_size: %s", stream, err)
+			}
+		}
+		f, err := openRotatingFile(path, int64(maxSize), config.IntVal(c.MaxFiles))
+		if err != nil {
+			return nil, fmt.Errorf("exec %s: %s", stream, err)
+		}
+		o.file, o.out = f, f
+	}
+
+	if config.BoolVal(c.Syslog) {
+		priority := gsyslog.LOG_INFO
+		if stream == "stderr" {
+			priority = gsyslog.LOG_ERR
+		}
+		l, err := gsyslog.NewLogger(priority, config.StringVal(sc.Facility), o.tag)
+		if err != nil {
+			o.Close()
+			return nil, fmt.Errorf("exec %s: setting up syslog: %s", stream, err)
+		}
+		o.syslog = l
+	}
+
+	return o, nil
+}
+
+// pipe returns the write end of a pipe to pass to a child process. What the
+// child writes to it goes to the output, until the child and the processes it
+// started exit. The caller closes it once the child started.
+func (o *childOutput) pipe() (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("exec %s: %s", o.stream, err)
+	}
+	go o.copyLines(r)
+	return w, nil
+}
+
+func (o *childOutput) copyLines(r io.ReadCloser) {
+	defer r.Close()
+
+	br := bufio.NewReaderSize(r, maxOutputLine)
+	for {
+		// Lines longer than the buffer are split, the last one may not end
+		// with a newline
+		line, err := br.ReadSlice('\n')
+		if len(line) > 0 {
+			o.writeLine(line, time.Now())
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return
+		}
+	}
+}
+
+// writeLine writes a line of the child process. Errors are ignored, as the
+// child would get them on its next write otherwise.
+func (o *childOutput) writeLine(line []byte, now time.Time) {
+	o.Lock()
+	defer o.Unlock()
+
+	msg := strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r")
+	switch o.format {
+	case OutputFormatPrefix:
+		fmt.Fprintf(o.out, "%s [%s] %s\n", now.Format(outputTimeFormat), o.tag, msg)
+	case OutputFormatJSON:
+		b, _ := json.Marshal(&outputLine{
+			Timestamp: now.Format(outputTimeFormat),
+			Tag:       o.tag,
+			Stream:    o.stream,
+			Message:   msg,
+		})
+		o.out.Write(append(b, '\n'))
+	default:
+		o.out.Write(line)
+	}
+
+	if o.syslog != nil {
+		o.syslog.Write([]byte(msg))
+	}
+}
+
+// Close closes the file and syslog of the output. What child processes still
+// running write afterwards is dropped.
+func (o *childOutput) Close() error {
+	o.Lock()
+	defer o.Unlock()
+
+	var err error
+	if o.file != nil {
+		err = o.file.Close()
+		o.file, o.out = nil, ioutil.Discard
+	}
+	if o.syslog != nil {
+		o.syslog.Close()
+		o.syslog = nil
+	}
+	return err
+}
+
+// rotatingFile is a file that is rotated once it grows over maxSize, keeping
+// maxFiles rotated files as path.1, path.2 and so on.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil && f.file == nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file to path.1, after moving path.1 to path.2 and so on,
+// and opens a new file. The oldest file is dropped. If the file cannot be
+// moved, writing goes on to the same file.
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+
+	var err error
+	if f.maxFiles > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxFiles))
+		for i := f.maxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		err = os.Rename(f.path, f.path+".1")
+	} else {
+		err = os.Remove(f.path)
+	}
+
+	if oerr := f.open(); oerr != nil {
+		return oerr
+	}
+	return err
+}
+
+func (f *rotatingFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/consul-template/child"
+	"github.com/hashicorp/consul-template/config"
+	"github.com/pkg/errors"
+)
+
+// waitReady waits until the ready checks of the new child process pass, or
+// fails when the ready timeout expires, the child exits first or the runner is
+// stopped.
+func (r *Runner) waitReady(c *child.Child, env []string) error {
+	ready := r.config.Exec.Ready
+	timeout := config.TimeDurationVal(ready.Timeout)
+
+	ctx, cancel := context.WithTimeout(r.ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(config.TimeDurationVal(ready.Interval))
+	defer ticker.Stop()
+
+	// The loop of Start cannot ping the systemd watchdog while it waits here
+	var watchdogCh <-chan time.Time
+	if interval := r.notifier.watchdogInterval(); interval > 0 {
+		watchdog := time.NewTicker(interval)
+		defer watchdog.Stop()
+		watchdogCh = watchdog.C
+	}
+
+	for {
+		err := r.checkReady(ctx, c, env)
+		if err == nil {
+			return nil
+		}
+
+	WAIT:
+		for {
+			select {
+			case code := <-c.ExitCh():
+				return fmt.Errorf("child exited with code %d before getting ready", code)
+			case <-ctx.Done():
+				if r.ctx.Err() != nil {
+					return errors.New("stopped before the child got ready")
+				}
+				return fmt.Errorf("child not ready after %s: %s", timeout, err)
+			case <-watchdogCh:
+				r.notifier.notify("WATCHDOG=1")
+			case <-ticker.C:
+				break WAIT
+			}
+		}
+	}
+}
+
+// checkReady runs every configured ready check once.
+func (r *Runner) checkReady(ctx context.Context, c *child.Child, env []string) error {
+	ready := r.config.Exec.Ready
+
+	if addr := config.StringVal(ready.TCP); addr != "" {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+
+	if url := config.StringVal(ready.HTTP); url != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("%s responded with %s", url, resp.Status)
+		}
+	}
+
+	if command := config.StringVal(ready.Command); command != "" {
+		cmd, err := r.commandContext(ctx, command, append(append([]string{}, env...),
+			"ENVCONSUL_CHILD_PID="+strconv.Itoa(c.Pid())))
+		if err != nil {
+			return errors.Wrap(err, "ready command")
+		}
+		cmd.Stdout = r.outStream
+		cmd.Stderr = r.errStream
+		if err := runCommand(cmd); err != nil {
+			return errors.Wrap(err, "ready command")
+		}
+	}
+
+	if path := config.StringVal(ready.File); path != "" {
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeReadyFile removes the ready file left by the current child, so that
+// it does not count for the next one.
+func (r *Runner) removeReadyFile() error {
+	path := config.StringVal(r.config.Exec.Ready.File)
+	if path == "" {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os/exec"
+	"sync"
+)
+
+// ownProcesses are the processes envconsul started and waits for itself, by
+// pid with their start time, which the reaper leaves to the code waiting for
+// them. The lock is held while a process starts and while reaping, so that a
+// process exiting right away is not reaped before it is added.
+var ownProcesses = struct {
+	sync.Mutex
+	pids map[int]uint64
+}{pids: make(map[int]uint64)}
+
+// trackProcess starts a process with start, which returns its pid, and adds
+// it to the processes the reaper leaves alone.
+func trackProcess(start func() (int, error)) error {
+	ownProcesses.Lock()
+	defer ownProcesses.Unlock()
+
+	pid, err := start()
+	if err != nil {
+		return err
+	}
+	if t, ok := processStartTime(pid); ok {
+		ownProcesses.pids[pid] = t
+	}
+	return nil
+}
+
+// runCommand runs the command like cmd.Run, leaving it alone from the reaper.
+func runCommand(cmd *exec.Cmd) error {
+	err := trackProcess(func() (int, error) {
+		if err := cmd.Start(); err != nil {
+			return 0, err
+		}
+		return cmd.Process.Pid, nil
+	})
+	if err != nil {
+		return err
+	}
+	return cmd.Wait()
+}
+
+// forgetProcesses forgets the processes of ownProcesses that are gone. It
+// must be called with the lock held.
+func forgetProcesses() {
+	for pid, t := range ownProcesses.pids {
+		if t2, ok := processStartTime(pid); !ok || t2 != t {
+			delete(ownProcesses.pids, pid)
+		}
+	}
+}
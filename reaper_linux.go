@@ -0,0 +1,108 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// startReaper makes envconsul the parent of the processes orphaned below it,
+// which it already is as PID 1, so that reapZombies can wait for them.
+func startReaper() error {
+	if os.Getpid() == 1 {
+		return nil
+	}
+	if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("becoming a subreaper: %s", err)
+	}
+	return nil
+}
+
+// reapZombies waits for the exited children of envconsul that it did not
+// start itself, typically orphaned processes of the child.
+func reapZombies() {
+	ownProcesses.Lock()
+	defer ownProcesses.Unlock()
+
+	forgetProcesses()
+
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		namedLogger("cli").Error("listing processes", "error", err)
+		return
+	}
+
+	self := os.Getpid()
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		stat, ok := readProcStat(pid)
+		if !ok || stat.ppid != self || stat.state != "Z" {
+			continue
+		}
+		if t, ok := ownProcesses.pids[pid]; ok && t == stat.startTime {
+			continue
+		}
+
+		var status unix.WaitStatus
+		if _, err := unix.Wait4(pid, &status, unix.WNOHANG, nil); err != nil {
+			continue
+		}
+		namedLogger("cli").Debug("reaped orphaned process", "pid", pid,
+			"exit_code", status.ExitStatus())
+	}
+}
+
+// processStartTime returns the start time of the process, which tells apart
+// processes with the same pid.
+func processStartTime(pid int) (uint64, bool) {
+	stat, ok := readProcStat(pid)
+	return stat.startTime, ok
+}
+
+type procStat struct {
+	state     string
+	ppid      int
+	startTime uint64
+}
+
+// readProcStat reads the state, parent pid and start time of the process from
+// /proc/<pid>/stat.
+func readProcStat(pid int) (procStat, bool) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return procStat{}, false
+	}
+
+	// The command name may contain spaces and parentheses, the fields start
+	// after its last parenthesis
+	s := string(b)
+	i := strings.LastIndexByte(s, ')')
+	if i < 0 {
+		return procStat{}, false
+	}
+	fields := strings.Fields(s[i+1:])
+	if len(fields) < 20 {
+		return procStat{}, false
+	}
+
+	// Fields 3, 4 and 22 of proc(5)
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return procStat{}, false
+	}
+	startTime, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return procStat{}, false
+	}
+	return procStat{state: fields[0], ppid: ppid, startTime: startTime}, true
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReapZombies(t *testing.T) {
+	waitZombie := func(pid int) {
+		t.Helper()
+		for i := 0; ; i++ {
+			if stat, ok := readProcStat(pid); ok && stat.state == "Z" {
+				return
+			}
+			if i == 500 {
+				t.Fatalf("process %d did not exit", pid)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// A process envconsul does not wait for itself is reaped
+	orphan, err := syscall.ForkExec("/bin/sh", []string{"sh", "-c", "exit 0"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitZombie(orphan)
+
+	// A process envconsul waits for is left alone
+	var own *exec.Cmd
+	err = trackProcess(func() (int, error) {
+		own = exec.Command("/bin/sh", "-c", "exit 0")
+		if err := own.Start(); err != nil {
+			return 0, err
+		}
+		return own.Process.Pid, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitZombie(own.Process.Pid)
+
+	reapZombies()
+
+	if _, ok := readProcStat(orphan); ok {
+		t.Errorf("expected process %d to be reaped", orphan)
+	}
+	if err := own.Wait(); err != nil {
+		t.Errorf("expected waiting for the own process to succeed, got %s", err)
+	}
+}
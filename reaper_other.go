@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+)
+
+// startReaper fails, as reaping orphaned processes is only supported on Linux.
+func startReaper() error {
+	return fmt.Errorf("reaping orphaned processes is only supported on linux")
+}
+
+func reapZombies() {}
+
+func processStartTime(pid int) (uint64, bool) {
+	return 0, false
+}
@@ -2,14 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,12 +23,18 @@ import (
 	"github.com/hashicorp/consul-template/config"
 	dep "github.com/hashicorp/consul-template/dependency"
 	"github.com/hashicorp/consul-template/watch"
+	"github.com/hashicorp/hcl"
+	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
 )
 
 // InvalidRegexp is a regexp for invalid characters in keys
 var InvalidRegexp = regexp.MustCompile(`[^a-zA-Z0-9_]`)
 
+// ErrSecretDeleted is returned when a Vault KV v2 secret configured with
+// error_on_deleted has no data because it was deleted or destroyed.
+var ErrSecretDeleted = errors.New("secret was deleted or destroyed")
+
 // Runner executes a given child process with configuration
 type Runner struct {
 	// ErrCh and DoneCh are channels where errors and finish notifications occur.
@@ -39,9 +49,30 @@ type Runner struct {
 	// in exec mode.
 	child *child.Child
 
+	// childEnv is the environment the child process was started with, for the
+	// pre_stop hook.
+	childEnv []string
+
+	// listeners are the sockets passed to the child process, opened when the
+	// first child starts.
+	listeners []*listener
+
+	// stdout and stderr are the outputs of the child process, opened when the
+	// first child starts, unless they are passed through unchanged.
+	stdout, stderr *childOutput
+
 	// childLock is the internal lock around the child process.
 	childLock sync.RWMutex
 
+	// cgroup is the cgroup the child process, the hooks and the ready command
+	// join, set up by the first of them under cgroupLock.
+	cgroup     string
+	cgroupLock sync.Mutex
+
+	// terminating is set by Terminate, under runLock so that Run does not start
+	// a child after it.
+	terminating bool
+
 	// config is the Config that created this Runner. It is used internally to
 	// construct other objects and pass data.
 	config *Config
@@ -52,6 +83,22 @@ type Runner struct {
 
 	configServiceMap map[string]*ServiceConfig
 
+	// configMetaMap is a map of a meta source dependency's hashcode back to
+	// the config that created it.
+	configMetaMap map[string]*MetaConfig
+
+	// keyRulesMap is a map of a dependency's hashcode back to the compiled key
+	// filter and rename rules of the config prefix that created it.
+	keyRulesMap map[string]*keyRules
+
+	// children is a map of a recursive secret or meta source dependency's
+	// hashcode to the dependencies currently listed by it.
+	children map[string][]dep.Dependency
+
+	// subpathMap is a map of a dependency's hashcode to its path relative to
+	// the recursive secret it was found under.
+	subpathMap map[string]string
+
 	// data is the latest representation of the data from Consul.
 	data map[string]interface{}
 
@@ -61,9 +108,39 @@ type Runner struct {
 	// dependenciesLock is a lock around touching the dependencies map.
 	dependenciesLock sync.Mutex
 
+	// runLock serialises the changes Run makes to the child process with
+	// Stop, Terminate and Inherit. It guards env, sources, audit, listeners,
+	// the outputs and terminating, and is taken before dependenciesLock, which
+	// Run only holds while compiling the environment.
+	runLock sync.Mutex
+
+	// ctx is cancelled by Stop, Terminate and Inherit, to interrupt the hooks
+	// and the ready checks run by Run.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// detachCh is closed by Inherit to end the loop of Start without stopping
+	// the child, and loopLock is held by Start until its loop ended.
+	detachCh chan struct{}
+	loopLock sync.Mutex
+
 	// env is the last compiled environment.
 	env map[string]string
 
+	// diff is the difference of env from the environment before, guarded by
+	// diffLock so it can be read while Run is compiling the next one.
+	diff     *EnvDiff
+	diffLock sync.RWMutex
+
+	// audit is the audit log of the changes to env, if enabled, and sources
+	// maps the keys of the environment being compiled to their dependency.
+	audit   *auditLog
+	sources map[string]string
+
+	// notifier sends the state of the runner to systemd, if Envconsul runs as
+	// a Type=notify service.
+	notifier *notifier
+
 	// once indicates the runner should get data exactly one time and then stop.
 	once bool
 
@@ -99,13 +176,19 @@ func NewRunner(config *Config, once bool) (*Runner, error) {
 		data:             make(map[string]interface{}),
 		configPrefixMap:  make(map[string]*PrefixConfig),
 		configServiceMap: make(map[string]*ServiceConfig),
+		configMetaMap:    make(map[string]*MetaConfig),
+		keyRulesMap:      make(map[string]*keyRules),
+		children:         make(map[string][]dep.Dependency),
+		subpathMap:       make(map[string]string),
 		inStream:         os.Stdin,
 		outStream:        os.Stdout,
 		errStream:        os.Stderr,
 		ErrCh:            make(chan error),
 		DoneCh:           make(chan struct{}),
 		ExitCh:           make(chan int, 1),
+		detachCh:         make(chan struct{}),
 	}
+	runner.ctx, runner.cancel = context.WithCancel(context.Background())
 
 	// Create the clientset
 	clients, err := newClientSet(config)
@@ -133,18 +216,38 @@ func (r *Runner) Start() {
 	logger := namedLogger("runner")
 	logger.Info("starting")
 
+	r.loopLock.Lock()
+	defer r.loopLock.Unlock()
+
 	// Create the pid before doing anything.
 	if err := r.storePid(); err != nil {
-		r.ErrCh <- err
+		r.reportErr(err)
 		return
 	}
+	if err := r.storeStatus(); err != nil {
+		logger.Warn("could not write status file", "error", err)
+	}
 
 	// Add each dependency to the watcher
 	for _, d := range r.dependencies {
 		r.watcher.Add(d)
 	}
 
+	// Watch the child inherited from a previous runner, if any
 	var exitCh <-chan int
+	if r.child != nil {
+		exitCh = r.child.ExitCh()
+	}
+
+	// Ping the systemd watchdog for as long as this loop keeps running. Errors
+	// of the watchers do not stop the pings: the child keeps running with the
+	// last environment, which restarting Envconsul would not improve.
+	var watchdogCh <-chan time.Time
+	if interval := r.notifier.watchdogInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		watchdogCh = ticker.C
+	}
 
 	for {
 		select {
@@ -178,6 +281,12 @@ func (r *Runner) Start() {
 			logger.Info("quiescence maxTimer fired")
 			r.minTimer, r.maxTimer = nil, nil
 		case err := <-r.watcher.ErrCh():
+			// A deleted secret is handled like new data, compiling the
+			// environment without it
+			if r.receiveDeletedSecret(err) {
+				break
+			}
+
 			// Intentionally do not send the error back up to the runner.
 			// Eventually, once Consul API implements errwrap and multierror,
 			// we can check the "type" of error and conditionally alert back.
@@ -187,28 +296,37 @@ func (r *Runner) Start() {
 			// }
 			logger.Error("watcher reported error:", err)
 			if r.once {
-				r.ErrCh <- err
+				r.reportErr(err)
 				return
 			}
 		case err := <-r.vaultTokenWatcher.ErrCh():
 			// follow same pattern as primary watcher
 			logger.Error("vault watcher reported error:", err)
 			if r.once {
-				r.ErrCh <- err
+				r.reportErr(err)
 				return
 			}
 		case code := <-exitCh:
+			logger.Info("child exited", "event", "child_exited", "exit_code", code)
+			// The channel is closed after the exit code
+			exitCh = nil
 			r.ExitCh <- code
+		case <-watchdogCh:
+			r.notifier.notify("WATCHDOG=1")
+			continue
 		case <-r.DoneCh:
 			logger.Info("received finish")
 			return
+		case <-r.detachCh:
+			logger.Info("handing over to the new runner")
+			return
 		}
 
 		// If we got this far, that means we got new data or one of the timers
 		// fired, so attempt to re-process the environment.
 		nexitCh, err := r.Run()
 		if err != nil {
-			r.ErrCh <- err
+			r.reportErr(err)
 			return
 		}
 
@@ -222,6 +340,14 @@ func (r *Runner) Start() {
 	}
 }
 
+// reportErr sends err on ErrCh, unless Inherit ends the loop of Start first.
+func (r *Runner) reportErr(err error) {
+	select {
+	case r.ErrCh <- err:
+	case <-r.detachCh:
+	}
+}
+
 // Stop halts the execution of this runner and its subprocesses.
 func (r *Runner) Stop() {
 	r.stopLock.Lock()
@@ -233,27 +359,240 @@ func (r *Runner) Stop() {
 
 	logger := namedLogger("runner")
 	logger.Info("stopping")
+	r.cancel()
 	r.stopWatchers()
+
+	r.runLock.Lock()
+	defer r.runLock.Unlock()
+
+	// Terminate already ran the pre_stop hook
+	r.childLock.RLock()
+	running, childEnv := r.child != nil, r.childEnv
+	r.childLock.RUnlock()
+	if running && !r.terminating {
+		err := r.runHook(context.Background(), hookPreStop, childEnv, r.LastDiff())
+		if err != nil {
+			logger.Error("hook failed", "error", err)
+		}
+	}
 	r.stopChild()
 
+	if r.audit != nil {
+		r.audit.Close()
+		r.audit = nil
+	}
+	closeListeners(r.listeners)
+	r.listeners = nil
+	r.closeOutputs()
+
 	if err := r.deletePid(); err != nil {
 		logger.Warn(fmt.Sprintf("could not remove pid at %#v: %s",
 			r.config.PidFile, err))
 	}
+	if err := r.deleteStatus(); err != nil {
+		logger.Warn("could not remove status file", "error", err)
+	}
 
 	r.stopped = true
 
 	close(r.DoneCh)
 }
 
+// Terminate starts stopping the runner the way a container runtime expects:
+// no new child is started anymore, the pre_stop hook runs and the child gets
+// the exec kill signal, to its whole process group in init mode. The exit of
+// the child is then reported on ExitCh as usual, unless it has to be killed
+// with Kill. It returns false if there is no child to wait for, in which case
+// the runner can be stopped right away.
+func (r *Runner) Terminate() bool {
+	logger := namedLogger("runner")
+	logger.Info("terminating")
+
+	r.cancel()
+	r.runLock.Lock()
+	r.terminating = true
+	r.runLock.Unlock()
+	r.stopWatchers()
+
+	r.childLock.RLock()
+	c, childEnv := r.child, r.childEnv
+	r.childLock.RUnlock()
+	if c == nil || c.Pid() == 0 {
+		return false
+	}
+
+	if err := r.runHook(context.Background(), hookPreStop, childEnv, r.LastDiff()); err != nil {
+		logger.Error("hook failed", "error", err)
+	}
+	sig := config.SignalVal(r.config.Exec.KillSignal)
+	logger.Info("stopping child process", "event", "child_stopping",
+		"pid", c.Pid(), "signal", sig)
+	if err := c.Signal(sig); err != nil {
+		logger.Error("failed signaling child process", "error", err)
+	}
+	return true
+}
+
+// Kill kills the child process, and its whole process group in init mode,
+// when it did not exit within the kill timeout after Terminate.
+func (r *Runner) Kill() {
+	r.childLock.RLock()
+	defer r.childLock.RUnlock()
+
+	if r.child != nil {
+		namedLogger("runner").Warn("killing child process", "pid", r.child.Pid())
+		r.child.Signal(os.Kill)
+	}
+}
+
+// Inherit takes over the child process of the given runner, which is stopped
+// without killing its child. The child keeps running until the environment
+// compiled by this runner differs from the one it was started with, or right
+// away if the exec settings changed. It must be called once, before Start.
+func (r *Runner) Inherit(old *Runner) {
+	// End the loop of the old runner first, so that it neither changes the
+	// child anymore nor reports its exit
+	old.stopWatchers()
+	old.cancel()
+	close(old.detachCh)
+	old.loopLock.Lock()
+	defer old.loopLock.Unlock()
+
+	// Wait for a running Run of the old runner to finish
+	old.runLock.Lock()
+	old.childLock.Lock()
+	child, childEnv := old.child, old.childEnv
+	old.child = nil
+	old.childLock.Unlock()
+
+	// Keep appending to the same audit log, so that the HMAC chain continues
+	// from the last record of the old runner
+	env, audit := old.env, old.audit
+	old.audit = nil
+	// Keep the sockets open for the child to keep accepting connections
+	if reflect.DeepEqual(old.config.Listeners, r.config.Listeners) {
+		r.listeners, old.listeners = old.listeners, nil
+	}
+	// Keep writing to the same files
+	if reflect.DeepEqual(old.config.Syslog, r.config.Syslog) {
+		if reflect.DeepEqual(old.config.Exec.Stdout, r.config.Exec.Stdout) {
+			r.stdout, old.stdout = old.stdout, nil
+		}
+		if reflect.DeepEqual(old.config.Exec.Stderr, r.config.Exec.Stderr) {
+			r.stderr, old.stderr = old.stderr, nil
+		}
+	}
+	old.runLock.Unlock()
+
+	// A child that exited before the loop ended is reported by this runner
+	select {
+	case code := <-old.ExitCh:
+		r.ExitCh <- code
+		child = nil
+	default:
+	}
+
+	old.Stop()
+
+	r.setDiff(old.LastDiff())
+
+	if audit != nil {
+		if r.audit != nil && reflect.DeepEqual(old.config.Audit, r.config.Audit) {
+			r.audit.Close()
+			r.audit = audit
+		} else {
+			audit.Close()
+		}
+	}
+
+	if child == nil {
+		return
+	}
+
+	r.childLock.Lock()
+	defer r.childLock.Unlock()
+	r.child = child
+	r.childEnv = childEnv
+
+	// Without the environment the child was started with, the first run
+	// restarts it.
+	if sameExecConfig(old.config, r.config) {
+		r.env = env
+	} else {
+		namedLogger("runner").Info("exec settings changed, the child will be restarted")
+	}
+}
+
+// sameExecConfig reports whether the child process settings of the configs,
+// beside the environment compiled from the dependencies, are the same.
+func sameExecConfig(a, b *Config) bool {
+	// Hooks and the replacement settings do not change the child process
+	ae, be := a.Exec.Copy(), b.Exec.Copy()
+	ae.Hooks, be.Hooks = nil, nil
+	ae.ReplaceStrategy, be.ReplaceStrategy = nil, nil
+	ae.Ready, be.Ready = nil, nil
+
+	return reflect.DeepEqual(ae, be) &&
+		config.BoolVal(a.Pristine) == config.BoolVal(b.Pristine)
+}
+
 // Receive accepts data from and maps that data to the prefix.
 func (r *Runner) Receive(d dep.Dependency, data interface{}) {
 	r.dependenciesLock.Lock()
 	defer r.dependenciesLock.Unlock()
-	namedLogger("runner").Debug("receiving dependency", d.String())
+	namedLogger("runner").Debug("receiving dependency", "event", "dependency_data",
+		"dependency", d, "keys", dataKeyCount(data))
 	r.data[d.String()] = data
 }
 
+// receiveDeletedSecret stores err as the data of the Vault secret it reports
+// as missing, if the secret had data before or is configured with
+// error_on_deleted, and returns whether it did. consul-template does not
+// return a deleted or destroyed KV v2 secret, it fails reading it with "no
+// secret exists at" once its retries are exhausted, and stops watching it.
+func (r *Runner) receiveDeletedSecret(err error) bool {
+	r.dependenciesLock.Lock()
+	defer r.dependenciesLock.Unlock()
+
+	for key, cp := range r.configPrefixMap {
+		if !strings.HasPrefix(key, "vault.read(") ||
+			!strings.HasPrefix(err.Error(), key+": no secret exists at ") {
+			continue
+		}
+		if _, ok := r.data[key]; !ok && !config.BoolVal(cp.ErrorOnDeleted) {
+			return false
+		}
+		namedLogger("runner").Warn("secret was deleted or destroyed, it is no longer watched",
+			"dependency", key, "error", err)
+		r.data[key] = err
+		return true
+	}
+	return false
+}
+
+// dataKeyCount returns the number of keys in the data of a dependency, for
+// logging.
+func dataKeyCount(data interface{}) int {
+	switch typed := data.(type) {
+	case []*dep.KeyPair:
+		return len(typed)
+	case []*dep.CatalogService:
+		return len(typed)
+	case []string:
+		return len(typed)
+	case *dep.Secret:
+		if typed == nil {
+			return 0
+		}
+		// KV v2 secrets nest the keys next to their metadata
+		if kv, ok := typed.Data["data"].(map[string]interface{}); ok && typed.Data["metadata"] != nil {
+			return len(kv)
+		}
+		return len(typed.Data)
+	}
+	return 0
+}
+
 // Signal sends a signal to the child process, if it exists. Any errors that
 // occur are returned.
 func (r *Runner) Signal(s os.Signal) error {
@@ -265,13 +604,171 @@ func (r *Runner) Signal(s os.Signal) error {
 	return r.child.Signal(s)
 }
 
+// reportStatus tells systemd and the status file that a new child process is
+// running.
+func (r *Runner) reportStatus() {
+	r.notifier.running(r.status())
+	if err := r.storeStatus(); err != nil {
+		namedLogger("runner").Warn("could not write status file", "error", err)
+	}
+}
+
+// status describes the state of the child process for systemd, with the last
+// change of its environment so that the reason of a restart can be seen.
+func (r *Runner) status() string {
+	r.childLock.RLock()
+	defer r.childLock.RUnlock()
+
+	if r.child == nil {
+		return "Waiting for data"
+	}
+	s := fmt.Sprintf("Running child process (pid %d)", r.child.Pid())
+	if d := r.LastDiff(); d != nil {
+		s += fmt.Sprintf(", environment changed at %s (%s)", d.Time.Format(time.RFC3339), d)
+	}
+	return s
+}
+
+// LastDiff returns the difference of the environment of the child process from
+// the one before, for the last change, or nil if it did not change yet.
+func (r *Runner) LastDiff() *EnvDiff {
+	r.diffLock.RLock()
+	defer r.diffLock.RUnlock()
+	return r.diff.Copy()
+}
+
+func (r *Runner) setDiff(d *EnvDiff) {
+	r.diffLock.Lock()
+	defer r.diffLock.Unlock()
+	r.diff = d
+}
+
 // Run executes and manages the child process with the correct environment. The
 // current environment is also copied into the child process environment.
 func (r *Runner) Run() (<-chan int, error) {
 	logger := namedLogger("runner")
 	logger.Info("running")
 
+	// Hooks run without dependenciesLock, so that a slow hook only holds up
+	// Stop and Terminate until they cancel it.
+	r.runLock.Lock()
+	defer r.runLock.Unlock()
+	if r.terminating || r.ctx.Err() != nil {
+		return nil, nil
+	}
+
+	env, ok, err := r.compileEnv()
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	// Print the final environment
+	logger.Trace("Environment:")
+	for k, v := range env {
+		logger.Trace(fmt.Sprintf("%s=%q", k, v))
+	}
+
+	// If the resulting map is the same, do not do anything. We use a length
+	// check first to get a small performance increase if something has changed
+	// so we don't immediately delegate to reflect which is slow.
+	if len(r.env) == len(env) && reflect.DeepEqual(r.env, env) {
+		logger.Info("environment was the same")
+		return nil, nil
+	}
+
+	old := r.env
+	diff := diffEnv(old, env)
+
+	fields := []interface{}{"event", "env_changed", "keys", len(env),
+		"added", diff.Added, "changed", diff.Changed, "removed", diff.Removed}
+	if config.BoolVal(r.config.LogEnvValues) {
+		values, oldValues := diff.logValues(old, env)
+		fields = append(fields, "values", values, "old_values", oldValues)
+	}
+	logger.Info("environment changed", fields...)
+
+	// Create a new environment
+	newEnv := make(map[string]string)
+
+	// If we are not pristine, copy over all values in the current env.
+	if !config.BoolVal(r.config.Pristine) {
+		for _, v := range os.Environ() {
+			list := strings.SplitN(v, "=", 2)
+			newEnv[list[0]] = list[1]
+		}
+	}
+
+	// Add our custom values, overwriting any existing ones.
+	for k, v := range env {
+		newEnv[k] = v
+	}
+
+	filteredEnv := r.applyConfigEnv(newEnv)
+
+	// Prepare the final environment. Note that it's CRUCIAL for us to
+	// initialize this slice to an empty one vs. a nil one, since that's
+	// how the child process class decides whether to pull in the parent's
+	// environment or not, and we control that via -pristine.
+	cmdEnv := make([]string, 0)
+	for k, v := range filteredEnv {
+		cmdEnv = append(cmdEnv, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	// A failing pre_start hook keeps the current child running with the
+	// previous environment, and the hook runs again on the next change.
+	if err := r.runHook(r.ctx, hookPreStart, cmdEnv, diff); err != nil {
+		// Stop or Terminate interrupted the hook
+		if r.ctx.Err() != nil {
+			return nil, nil
+		}
+		r.recordAudit(diff, env, auditChildBlocked, 0, err)
+		if r.child == nil || r.once {
+			return nil, err
+		}
+		logger.Error("keeping the current child", "error", err)
+		return nil, nil
+	}
+
+	if r.child != nil && config.StringVal(r.config.Exec.ReplaceStrategy) == ReplaceStartFirst {
+		return r.replaceChild(env, cmdEnv, diff)
+	}
+
+	// Update the environment
+	r.env = env
+	r.setDiff(diff)
+
+	action := auditChildStart
+	if r.child != nil {
+		action = auditChildRestart
+		if err := r.runHook(r.ctx, hookPreStop, r.childEnv, diff); err != nil {
+			logger.Error("hook failed", "error", err)
+		}
+		logger.Info("stopping existing child process", "event", "child_stopping",
+			"pid", r.child.Pid())
+		r.stopChild()
+	}
+
+	child, err := r.spawnChild(cmdEnv)
+	if err != nil {
+		r.recordAudit(diff, env, auditChildFailed, 0, err)
+		return nil, err
+	}
+	r.setChild(child, cmdEnv)
+	r.recordAudit(diff, env, action, child.Pid(), nil)
+	r.reportStatus()
+	r.runStartHooks(cmdEnv, diff, action != auditChildStart)
+
+	return child.ExitCh(), nil
+}
+
+// compileEnv compiles the environment from the data of every dependency. It
+// returns false if any dependency has no data yet, or if a secret was deleted
+// and the current child keeps running with the previous environment.
+func (r *Runner) compileEnv() (map[string]string, bool, error) {
+	logger := namedLogger("runner")
+
 	env := make(map[string]string)
+	r.sources = make(map[string]string)
 
 	// Iterate over each dependency and pull out its data. If any dependencies do
 	// not have data yet, this function will immediately return because we cannot
@@ -281,112 +778,649 @@ func (r *Runner) Run() (<-chan int, error) {
 	// since order in a map is not deterministic.
 	r.dependenciesLock.Lock()
 	defer r.dependenciesLock.Unlock()
-	for _, d := range r.dependencies {
-		data, ok := r.data[d.String()]
-		if !ok {
-			logger.Info("missing data for", d)
-			return nil, nil
+	ok, err := r.appendDependencies(env, r.dependencies)
+	if errors.Is(err, ErrSecretDeleted) {
+		// Keep the current child, if any, running with the previous
+		// environment until the secret is restored.
+		if r.once {
+			return nil, false, err
+		}
+		logger.Error("refusing to (re)start child", "error", err)
+		r.notifier.notify(fmt.Sprintf("STATUS=Refusing to (re)start child: %s", err))
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	return env, true, nil
+}
+
+// replaceChild starts a new child process next to the current one, and stops
+// the current one once the new one is ready. If the new child does not get
+// ready, it is stopped and the current one keeps running with the previous
+// environment until the next change.
+func (r *Runner) replaceChild(env map[string]string, cmdEnv []string, diff *EnvDiff) (<-chan int, error) {
+	logger := namedLogger("runner")
+
+	if err := r.removeReadyFile(); err != nil {
+		logger.Warn("failed removing ready file", "error", err)
+	}
+
+	c, err := r.spawnChild(cmdEnv)
+	if err != nil {
+		r.recordAudit(diff, env, auditChildFailed, 0, err)
+		logger.Error("keeping the current child", "error", err)
+		return nil, nil
+	}
+	if err := r.waitReady(c, cmdEnv); err != nil {
+		logger.Error("new child did not get ready, keeping the current child",
+			"event", "child_not_ready", "pid", c.Pid(), "error", err)
+		c.Stop()
+		r.recordAudit(diff, env, auditChildFailed, c.Pid(), err)
+		return nil, nil
+	}
+	logger.Info("new child is ready", "event", "child_ready", "pid", c.Pid())
+
+	// Update the environment
+	r.env = env
+	r.setDiff(diff)
+
+	if err := r.runHook(r.ctx, hookPreStop, r.childEnv, diff); err != nil {
+		logger.Error("hook failed", "error", err)
+	}
+	logger.Info("stopping existing child process", "event", "child_stopping",
+		"pid", r.child.Pid())
+	r.stopChild()
+
+	r.setChild(c, cmdEnv)
+	r.recordAudit(diff, env, auditChildReplace, c.Pid(), nil)
+	r.reportStatus()
+	r.runStartHooks(cmdEnv, diff, true)
+
+	return c.ExitCh(), nil
+}
+
+// spawnChild starts a child process running the command with the given
+// environment.
+func (r *Runner) spawnChild(cmdEnv []string) (*child.Child, error) {
+	args, subshell, err := child.CommandPrep(r.config.Exec.Command)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing command")
+	}
+
+	if len(*r.config.Listeners) > 0 && r.listeners == nil {
+		if r.listeners, err = openListeners(r.config.Listeners); err != nil {
+			return nil, err
+		}
+	}
+
+	shim, err := r.execShim()
+	if err != nil {
+		return nil, err
+	}
+	command, cargs, env := args[0], args[1:], cmdEnv
+	if shim != nil {
+		if command, cargs, env, err = shim.wrap(args, cmdEnv); err != nil {
+			return nil, err
+		}
+	}
+
+	stdout, stderr, closePipes, err := r.childStreams()
+	if err != nil {
+		return nil, err
+	}
+	defer closePipes()
+
+	// The sockets are only inherited by the child, not by the hooks
+	for _, l := range r.listeners {
+		if err := setInheritable(l.fd, true); err != nil {
+			return nil, errors.Wrap(err, "passing listener")
+		}
+		defer setInheritable(l.fd, false)
+	}
+
+	c, err := child.New(&child.NewInput{
+		Stdin:        r.inStream,
+		Stdout:       stdout,
+		Stderr:       stderr,
+		Command:      command,
+		Args:         cargs,
+		Env:          env,
+		Timeout:      0, // Allow running indefinitely
+		ReloadSignal: config.SignalVal(r.config.Exec.ReloadSignal),
+		KillSignal:   config.SignalVal(r.config.Exec.KillSignal),
+		KillTimeout:  config.TimeDurationVal(r.config.Exec.KillTimeout),
+		Splay:        config.TimeDurationVal(r.config.Exec.Splay),
+		// Only setpgid for 'sh -c' subshell calls, or to signal the whole
+		// process group in init mode
+		Setpgid: subshell || config.BoolVal(r.config.Init),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "spawning child")
+	}
+	err = trackProcess(func() (int, error) {
+		if err := c.Start(); err != nil {
+			return 0, err
+		}
+		return c.Pid(), nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "starting child")
+	}
+	namedLogger("runner").Info("child started", "event", "child_started", "pid", c.Pid())
+	return c, nil
+}
+
+// childStreams returns the stdout and stderr of a new child process, which are
+// the streams of envconsul when passed through unchanged, or pipes to their
+// output. The returned function closes the pipes, once the child started.
+func (r *Runner) childStreams() (io.Writer, io.Writer, func(), error) {
+	ec := r.config.Exec
+	if r.stdout == nil && !ec.Stdout.PassThrough() {
+		o, err := newChildOutput(ec.Stdout, "stdout", r.outStream, r.config.Syslog)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		r.stdout = o
+	}
+	if r.stderr == nil && !ec.Stderr.PassThrough() {
+		o, err := newChildOutput(ec.Stderr, "stderr", r.errStream, r.config.Syslog)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		r.stderr = o
+	}
+
+	var pipes []*os.File
+	closePipes := func() {
+		for _, p := range pipes {
+			p.Close()
+		}
+	}
+	stream := func(o *childOutput, w io.Writer) (io.Writer, error) {
+		if o == nil {
+			return w, nil
+		}
+		p, err := o.pipe()
+		if err != nil {
+			return nil, err
+		}
+		pipes = append(pipes, p)
+		return p, nil
+	}
+
+	stdout, err := stream(r.stdout, r.outStream)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stderr, err := stream(r.stderr, r.errStream)
+	if err != nil {
+		closePipes()
+		return nil, nil, nil, err
+	}
+	return stdout, stderr, closePipes, nil
+}
+
+// closeOutputs closes the outputs of the child process, if open.
+func (r *Runner) closeOutputs() {
+	for _, o := range []*childOutput{r.stdout, r.stderr} {
+		if o == nil {
+			continue
+		}
+		if err := o.Close(); err != nil {
+			namedLogger("runner").Warn("failed closing child output", "error", err)
+		}
+	}
+	r.stdout, r.stderr = nil, nil
+}
+
+// execShim returns the settings of the exec shim for the child process, or nil
+// if the child does not need the shim.
+func (r *Runner) execShim() (*execShim, error) {
+	shim, err := r.commandShim()
+	if err != nil {
+		return nil, err
+	}
+	if shim == nil {
+		shim = &execShim{}
+	}
+	for _, l := range r.listeners {
+		shim.ListenFDs = append(shim.ListenFDs, l.fd)
+		shim.ListenNames = append(shim.ListenNames, l.name)
+	}
+
+	// The child gets its own process group in init mode, and with it the
+	// terminal if envconsul has one
+	if f, ok := r.inStream.(*os.File); ok && config.BoolVal(r.config.Init) {
+		shim.Foreground = isTerminal(f)
+	}
+
+	if reflect.DeepEqual(shim, &execShim{}) {
+		return nil, nil
+	}
+	return shim, nil
+}
+
+// commandShim returns the settings of the exec shim shared by the child
+// process, the hooks and the ready command, which run as the same user and
+// with the same limits, or nil if none is configured.
+func (r *Runner) commandShim() (*execShim, error) {
+	shim := &execShim{}
+	ec := r.config.Exec
+	if config.StringPresent(ec.User) || config.StringPresent(ec.Group) || len(ec.Groups) > 0 {
+		cred, err := lookupCredential(config.StringVal(ec.User),
+			config.StringVal(ec.Group), ec.Groups)
+		if err != nil {
+			return nil, err
+		}
+		shim.Credential = cred
+	}
+	if config.StringPresent(ec.Umask) {
+		umask, err := parseUmask(config.StringVal(ec.Umask))
+		if err != nil {
+			return nil, err
+		}
+		shim.Umask = &umask
+	}
+	shim.Dir = config.StringVal(ec.WorkingDir)
+	if config.BoolVal(ec.NoNewPrivs) {
+		if runtime.GOOS != "linux" {
+			namedLogger("runner").Warn("exec no_new_privs is only supported on linux, ignoring it")
+		} else {
+			shim.NoNewPrivs = true
+		}
+	}
+
+	if limits := ec.Limits; !limits.Empty() {
+		if runtime.GOOS != "linux" {
+			namedLogger("runner").Warn("exec limits are only supported on linux, ignoring them")
+		} else {
+			rlimits, err := parseRlimits(limits)
+			if err != nil {
+				return nil, err
+			}
+			shim.Rlimits = rlimits
+			if config.BoolVal(limits.Cgroup.Enabled) {
+				if shim.Cgroup, err = r.setupCgroup(); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if reflect.DeepEqual(shim, &execShim{}) {
+		return nil, nil
+	}
+	return shim, nil
+}
+
+// setupCgroup sets up the cgroup of the child process once, and returns its
+// path for the exec shim to join.
+func (r *Runner) setupCgroup() (string, error) {
+	r.cgroupLock.Lock()
+	defer r.cgroupLock.Unlock()
+
+	if r.cgroup == "" {
+		cgroup, err := setupCgroup(r.config.Exec.Limits.Cgroup)
+		if err != nil {
+			return "", err
+		}
+		r.cgroup = cgroup
+	}
+	return r.cgroup, nil
+}
+
+// runStartHooks runs the post_start hook, and the on_change hook when the
+// child was restarted because the environment changed. Failures are logged.
+func (r *Runner) runStartHooks(cmdEnv []string, diff *EnvDiff, restarted bool) {
+	hooks := []string{hookPostStart}
+	if restarted {
+		hooks = append(hooks, hookOnChange)
+	}
+	for _, name := range hooks {
+		if err := r.runHook(r.ctx, name, cmdEnv, diff); err != nil {
+			namedLogger("runner").Error("hook failed", "error", err)
+		}
+	}
+}
+
+// recordAudit writes the change of the environment to env to the audit log,
+// if enabled. Failing to write is logged but does not stop the child from
+// running.
+func (r *Runner) recordAudit(diff *EnvDiff, env map[string]string, action string, pid int, err error) {
+	if r.audit == nil {
+		return
+	}
+	if err := r.audit.Record(diff, env, r.sources, action, pid, err); err != nil {
+		namedLogger("runner").Error("failed writing audit record", "error", err)
+	}
+}
+
+// trackSources records d as the source of the keys that fn sets in env, for
+// the audit log.
+func (r *Runner) trackSources(env map[string]string, d dep.Dependency, fn func()) {
+	if r.audit == nil {
+		fn()
+		return
+	}
+
+	before := make(map[string]string, len(env))
+	for k, v := range env {
+		before[k] = v
+	}
+	fn()
+	for k, v := range env {
+		if bv, ok := before[k]; !ok || bv != v {
+			r.sources[k] = d.String()
+		}
+	}
+}
+
+// appendDependency adds the data of the given dependency to the environment.
+// It returns false if the dependency, or any secret found under a recursive
+// secret, has not received data yet.
+func (r *Runner) appendDependency(env map[string]string, d dep.Dependency) (bool, error) {
+	return r.appendDependencies(env, []dep.Dependency{d})
+}
+
+// appendDependencies adds the data of the given dependencies to the
+// environment in order, all the Consul data first and then all the Vault
+// data. Consul values never overwrite values from Vault that way, including
+// the ones of the prefixes and secrets listed by meta sources; that would
+// expose a security hole since access to consul is typically less controlled
+// than access to vault.
+func (r *Runner) appendDependencies(env map[string]string, deps []dep.Dependency) (bool, error) {
+	for _, vault := range []bool{false, true} {
+		for _, d := range deps {
+			if ok, err := r.appendPhase(env, d, vault); !ok || err != nil {
+				return ok, err
+			}
+		}
+	}
+	return true, nil
+}
+
+// appendPhase adds the data of the given dependency, or of the dependencies
+// listed by it, that comes from Vault or from Consul.
+func (r *Runner) appendPhase(env map[string]string, d dep.Dependency, vault bool) (bool, error) {
+	data, ok := r.data[d.String()]
+	if !ok {
+		namedLogger("runner").Info("missing data for", d)
+		return false, nil
+	}
+
+	// Meta sources are only used for the dependencies they list, which are
+	// updated in the first phase.
+	if mc, ok := r.configMetaMap[d.String()]; ok {
+		children := r.children[d.String()]
+		if !vault {
+			var err error
+			if children, err = r.syncMeta(d, mc, data); err != nil {
+				return false, err
+			}
+		}
+		for _, c := range children {
+			if ok, err := r.appendPhase(env, c, vault); !ok || err != nil {
+				return ok, err
+			}
 		}
+		return true, nil
+	}
+
+	switch d.(type) {
+	case *dep.VaultReadQuery, *dep.VaultListQuery:
+		if !vault {
+			return true, nil
+		}
+	default:
+		if vault {
+			return true, nil
+		}
+	}
 
-		switch typed := d.(type) {
-		case *dep.KVListQuery:
-			r.appendPrefixes(env, typed, data)
-		case *dep.VaultReadQuery:
-			r.appendSecrets(env, typed, data)
-		case *dep.CatalogServiceQuery:
-			r.appendServices(env, typed, data)
-		default:
-			return nil, fmt.Errorf("unknown dependency type %T", typed)
+	switch typed := d.(type) {
+	case *dep.KVListQuery:
+		r.trackSources(env, d, func() { r.appendPrefixes(env, typed, data) })
+	case *dep.VaultReadQuery:
+		var err error
+		r.trackSources(env, d, func() { err = r.appendSecrets(env, typed, data) })
+		if errors.Is(err, ErrSecretDeleted) {
+			return false, err
+		}
+	case *dep.VaultListQuery:
+		children, err := r.syncChildren(typed, data)
+		if err != nil {
+			return false, err
+		}
+		for _, c := range children {
+			if ok, err := r.appendPhase(env, c, vault); !ok || err != nil {
+				return ok, err
+			}
 		}
+	case *dep.CatalogServiceQuery:
+		r.trackSources(env, d, func() { r.appendServices(env, typed, data) })
+	default:
+		return false, fmt.Errorf("unknown dependency type %T", typed)
 	}
 
-	// Print the final environment
-	logger.Trace("Environment:")
-	for k, v := range env {
-		logger.Trace(fmt.Sprintf("%s=%q", k, v))
+	return true, nil
+}
+
+// childDependency is a dependency discovered at runtime, along with the
+// config prefix that applies to it.
+type childDependency struct {
+	dep     dep.Dependency
+	config  *PrefixConfig
+	subpath string
+}
+
+// syncChildren reconciles the dependencies watched for a recursive secret with
+// the latest listing of its path. It returns the current children in listing
+// order.
+func (r *Runner) syncChildren(d *dep.VaultListQuery, data interface{}) ([]dep.Dependency, error) {
+	names, ok := data.([]string)
+	if !ok {
+		return nil, fmt.Errorf("error converting to list %s", d)
 	}
 
-	// If the resulting map is the same, do not do anything. We use a length
-	// check first to get a small performance increase if something has changed
-	// so we don't immediately delegate to reflect which is slow.
-	if len(r.env) == len(env) && reflect.DeepEqual(r.env, env) {
-		logger.Info("environment was the same")
-		return nil, nil
+	cp, ok := r.configPrefixMap[d.String()]
+	if !ok {
+		return nil, fmt.Errorf("missing dependency %s", d)
 	}
 
-	// Update the environment
-	r.env = env
+	root, err := applyPathTemplate(config.StringVal(cp.Path))
+	if err != nil {
+		return nil, err
+	}
 
-	if r.child != nil {
-		logger.Info("stopping existing child process")
-		r.stopChild()
+	wanted := make([]childDependency, 0, len(names))
+	for _, name := range names {
+		p := path.Join(root, strings.TrimSuffix(name, "/"))
+
+		// Entries ending with a slash are folders which are listed in turn.
+		var c dep.Dependency
+		if strings.HasSuffix(name, "/") {
+			c, err = dep.NewVaultListQuery(p)
+		} else {
+			c, err = dep.NewVaultReadQuery(p)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		ccp := cp.Copy()
+		ccp.Path = config.String(p)
+		wanted = append(wanted, childDependency{
+			dep:     c,
+			config:  ccp,
+			subpath: path.Join(r.subpathMap[d.String()], strings.TrimSuffix(name, "/")),
+		})
 	}
 
-	// Create a new environment
-	newEnv := make(map[string]string)
+	return r.reconcileChildren(d, wanted)
+}
 
-	// If we are not pristine, copy over all values in the current env.
-	if !config.BoolVal(r.config.Pristine) {
-		for _, v := range os.Environ() {
-			list := strings.SplitN(v, "=", 2)
-			newEnv[list[0]] = list[1]
+// metaPaths is the content of a meta source.
+type metaPaths struct {
+	Prefixes []string `mapstructure:"prefixes"`
+	Secrets  []string `mapstructure:"secrets"`
+}
+
+// syncMeta reconciles the dependencies watched for a meta source with the
+// latest lists of prefixes and secrets it holds. It returns the current
+// children, prefixes first so that secrets take precedence.
+func (r *Runner) syncMeta(d dep.Dependency, mc *MetaConfig, data interface{}) ([]dep.Dependency, error) {
+	var raw map[string]interface{}
+	switch typed := data.(type) {
+	case nil:
+		// The key or secret does not exist (yet), so there is nothing to add.
+	case string:
+		if err := hcl.Decode(&raw, typed); err != nil {
+			return nil, errors.Wrapf(err, "error decoding %s", d)
 		}
+	case *dep.Secret:
+		raw = typed.Data
+		if isVaultKv2(raw) {
+			raw, _ = raw["data"].(map[string]interface{})
+		}
+	default:
+		return nil, fmt.Errorf("error converting meta source %s", d)
 	}
 
-	// Add our custom values, overwriting any existing ones.
-	for k, v := range r.env {
-		newEnv[k] = v
+	var paths metaPaths
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:       mapstructure.StringToSliceHookFunc(","),
+		WeaklyTypedInput: true,
+		Result:           &paths,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := decoder.Decode(raw); err != nil {
+		return nil, errors.Wrapf(err, "error decoding %s", d)
 	}
 
-	filteredEnv := r.applyConfigEnv(newEnv)
+	var wanted []childDependency
+	for _, p := range paths.Prefixes {
+		if strings.TrimSpace(p) == "" {
+			continue
+		}
+		p, err = applyPathTemplate(strings.TrimSpace(p))
+		if err != nil {
+			return nil, err
+		}
+		c, err := dep.NewKVListQuery(p)
+		if err != nil {
+			return nil, err
+		}
+		wanted = append(wanted, childDependency{dep: c, config: mc.prefixConfig(p)})
+	}
+	for _, p := range paths.Secrets {
+		if strings.TrimSpace(p) == "" {
+			continue
+		}
+		p, err = applyPathTemplate(strings.TrimSpace(p))
+		if err != nil {
+			return nil, err
+		}
+		c, err := dep.NewVaultReadQuery(p)
+		if err != nil {
+			return nil, err
+		}
+		wanted = append(wanted, childDependency{dep: c, config: mc.prefixConfig(p)})
+	}
 
-	// Prepare the final environment. Note that it's CRUCIAL for us to
-	// initialize this slice to an empty one vs. a nil one, since that's
-	// how the child process class decides whether to pull in the parent's
-	// environment or not, and we control that via -pristine.
-	cmdEnv := make([]string, 0)
-	for k, v := range filteredEnv {
-		cmdEnv = append(cmdEnv, fmt.Sprintf("%s=%s", k, v))
+	return r.reconcileChildren(d, wanted)
+}
+
+// reconcileChildren replaces the children of the given dependency with the
+// wanted ones. Children that appeared are added to the watcher and those that
+// disappeared are removed. Dependencies that are already watched elsewhere
+// are skipped. It returns the current children in the given order.
+func (r *Runner) reconcileChildren(parent dep.Dependency, wanted []childDependency) ([]dep.Dependency, error) {
+	logger := namedLogger("runner")
+
+	existing := make(map[string]dep.Dependency)
+	for _, c := range r.children[parent.String()] {
+		existing[c.String()] = c
 	}
 
-	args, subshell, err := child.CommandPrep(r.config.Exec.Command)
-	if err != nil {
-		return nil, errors.Wrap(err, "parsing command")
+	children := make([]dep.Dependency, 0, len(wanted))
+	for _, w := range wanted {
+		if current, ok := existing[w.dep.String()]; ok {
+			delete(existing, w.dep.String())
+			children = append(children, current)
+			continue
+		}
+
+		if _, ok := r.configPrefixMap[w.dep.String()]; ok {
+			logger.Warn("skipping dependency already watched", "dependency", w.dep, "from", parent)
+			continue
+		}
+
+		rules, err := newKeyRules(w.config)
+		if err != nil {
+			return nil, err
+		}
+
+		logger.Info("adding dependency", "event", "dependency_added",
+			"dependency", w.dep, "from", parent)
+		r.configPrefixMap[w.dep.String()] = w.config
+		r.keyRulesMap[w.dep.String()] = rules
+		r.subpathMap[w.dep.String()] = w.subpath
+		if r.watcher != nil {
+			r.watcher.Add(w.dep)
+		}
+		children = append(children, w.dep)
 	}
-	child, err := child.New(&child.NewInput{
-		Stdin:        r.inStream,
-		Stdout:       r.outStream,
-		Stderr:       r.errStream,
-		Command:      args[0],
-		Args:         args[1:],
-		Env:          cmdEnv,
-		Timeout:      0, // Allow running indefinitely
-		ReloadSignal: config.SignalVal(r.config.Exec.ReloadSignal),
-		KillSignal:   config.SignalVal(r.config.Exec.KillSignal),
-		KillTimeout:  config.TimeDurationVal(r.config.Exec.KillTimeout),
-		Splay:        config.TimeDurationVal(r.config.Exec.Splay),
-		Setpgid:      subshell, // only setpgid for 'sh -c' subshell calls
-	})
-	if err != nil {
-		return nil, errors.Wrap(err, "spawning child")
+
+	for _, c := range existing {
+		logger.Info("removing dependency", "event", "dependency_removed",
+			"dependency", c, "from", parent)
+		r.removeDependency(c)
 	}
-	if err := child.Start(); err != nil {
-		return nil, errors.Wrap(err, "starting child")
+
+	r.children[parent.String()] = children
+	return children, nil
+}
+
+// removeDependency stops watching a dependency that was added at runtime,
+// including any children it has, and forgets its data.
+func (r *Runner) removeDependency(d dep.Dependency) {
+	for _, c := range r.children[d.String()] {
+		r.removeDependency(c)
 	}
-	r.child = child
 
-	return child.ExitCh(), nil
+	if r.watcher != nil {
+		r.watcher.Remove(d)
+	}
+	delete(r.children, d.String())
+	delete(r.configPrefixMap, d.String())
+	delete(r.configMetaMap, d.String())
+	delete(r.keyRulesMap, d.String())
+	delete(r.subpathMap, d.String())
+	delete(r.data, d.String())
 }
 
-func applyFormatTemplate(contents, key string) (string, error) {
-	funcs := template.FuncMap{
+// formatTemplateFuncs returns the functions available to prefix and secret
+// format templates.
+func formatTemplateFuncs(key, subpath string) template.FuncMap {
+	return template.FuncMap{
 		"key": func() (string, error) {
 			return key, nil
 		},
+		"subpath": func() (string, error) {
+			return subpath, nil
+		},
 		"replaceKey": replaceKey,
 	}
+}
 
-	tmpl, err := template.New("filter").Funcs(funcs).Parse(contents)
+func applyFormatTemplate(contents, key, subpath string) (string, error) {
+	tmpl, err := template.New("filter").Funcs(formatTemplateFuncs(key, subpath)).Parse(contents)
 	if err != nil {
 		return "", nil
 	}
@@ -433,8 +1467,10 @@ func applyPathTemplate(contents string) (string, error) {
 	return buf.String(), nil
 }
 
-func applyServiceTemplate(contents, service, key string) (string, error) {
-	funcs := template.FuncMap{
+// serviceTemplateFuncs returns the functions available to service format
+// templates.
+func serviceTemplateFuncs(service, key string) template.FuncMap {
+	return template.FuncMap{
 		"service": func() (string, error) {
 			return service, nil
 		},
@@ -442,8 +1478,10 @@ func applyServiceTemplate(contents, service, key string) (string, error) {
 			return key, nil
 		},
 	}
+}
 
-	tmpl, err := template.New("filter").Funcs(funcs).Parse(contents)
+func applyServiceTemplate(contents, service, key string) (string, error) {
+	tmpl, err := template.New("filter").Funcs(serviceTemplateFuncs(service, key)).Parse(contents)
 	if err != nil {
 		return "", nil
 	}
@@ -531,6 +1569,7 @@ func (r *Runner) appendPrefixes(
 	env map[string]string, d *dep.KVListQuery, data interface{},
 ) error {
 	var err error
+	logger := namedLogger("runner")
 
 	typed, ok := data.([]*dep.KeyPair)
 	if !ok {
@@ -539,59 +1578,148 @@ func (r *Runner) appendPrefixes(
 
 	// Get the PrefixConfig so we can get configuration from it.
 	cp := r.configPrefixMap[d.String()]
+	rules := r.keyRulesMap[d.String()]
+	keyFormats := perKeyFormats(cp)
 
 	// For each pair, update the environment hash. Subsequent runs could
 	// overwrite an existing key.
 	for _, pair := range typed {
-		key, value := pair.Key, string(pair.Value)
+		originalKey, value := pair.Key, string(pair.Value)
 
 		// It is not possible to have an environment variable that is blank, but
 		// it is possible to have an environment variable _value_ that is blank.
-		if strings.TrimSpace(key) == "" {
+		if strings.TrimSpace(originalKey) == "" {
 			continue
 		}
 
-		// NoPrefix is nil when not set in config. Default to excluding prefix for Consul keys.
-		if cp.NoPrefix != nil && !config.BoolVal(cp.NoPrefix) {
-			pc, ok := r.configPrefixMap[d.String()]
+		// Apply the include/exclude filters and rename rules on the original key.
+		if !rules.allowed(originalKey) {
+			logger.Debug(fmt.Sprintf("skipping key '%s' since it is filtered out", originalKey))
+			continue
+		}
+
+		keys := []string{rules.renamed(originalKey)}
+		// Check for per-key configuration override on a very early stage
+		// before the `key` is updated with prefix or become uppercase
+		if keyFormats != nil {
+			formats, ok := keyFormats[originalKey]
 			if !ok {
-				return fmt.Errorf("missing dependency %s", d)
+				logger.Debug(fmt.Sprintf("skipping key '%s' since it is not listed in configuration", originalKey))
+				continue
+			}
+			if keys, err = applyKeyFormats(formats, keys[0], ""); err != nil {
+				return err
+			}
+		}
+
+		for _, key := range keys {
+			// NoPrefix is nil when not set in config. Default to excluding prefix for Consul keys.
+			if cp.NoPrefix != nil && !config.BoolVal(cp.NoPrefix) {
+				pc, ok := r.configPrefixMap[d.String()]
+				if !ok {
+					return fmt.Errorf("missing dependency %s", d)
+				}
+
+				// Replace the invalid path chars such as slashes with underscores
+				path := InvalidRegexp.ReplaceAllString(config.StringVal(pc.Path), "_")
+
+				// Prefix the key value with the path value.
+				key = fmt.Sprintf("%s_%s", path, key)
+			}
+
+			// If the user specified a custom format, apply that here.
+			if config.StringPresent(cp.Format) {
+				key, err = applyFormatTemplate(config.StringVal(cp.Format), key, "")
+				if err != nil {
+					return err
+				}
+			}
+
+			if config.BoolVal(r.config.Sanitize) {
+				key = InvalidRegexp.ReplaceAllString(key, "_")
 			}
 
-			// Replace the invalid path chars such as slashes with underscores
-			path := InvalidRegexp.ReplaceAllString(config.StringVal(pc.Path), "_")
+			if config.BoolVal(r.config.Upcase) {
+				key = strings.ToUpper(key)
+			}
 
-			// Prefix the key value with the path value.
-			key = fmt.Sprintf("%s_%s", path, key)
+			if current, ok := env[key]; ok {
+				logger.Debug(fmt.Sprintf("overwriting %s=%q (was %q) from %s", key, value, current, d))
+				env[key] = value
+			} else {
+				logger.Debug(fmt.Sprintf("setting %s=%q from %s", key, value, d))
+				env[key] = value
+			}
 		}
+	}
+
+	return nil
+}
+
+// perKeyFormats returns the per-key configuration of the given prefix indexed
+// by key name, or nil if per-key configuration does not apply. Per-key
+// configuration is ignored when the prefix has a format of its own.
+func perKeyFormats(cp *PrefixConfig) map[string][]*KeyFormat {
+	if cp.Keys == nil || config.StringPresent(cp.Format) {
+		return nil
+	}
+
+	// pre-populate key formats map here so we don't have a potential O(n^2)
+	// complexity in the loop later
+	keyFormats := make(map[string][]*KeyFormat)
+	for _, v := range *cp.Keys {
+		keyFormats[config.StringVal(v.Name)] = append(keyFormats[config.StringVal(v.Name)], v)
+	}
+	return keyFormats
+}
 
-		// If the user specified a custom format, apply that here.
-		if config.StringPresent(cp.Format) {
-			key, err = applyFormatTemplate(config.StringVal(cp.Format), key)
+// applyKeyFormats returns the list of names the key is exported as, one for
+// each per-key format. The key itself is returned if none of the formats is
+// set.
+func applyKeyFormats(formats []*KeyFormat, key, subpath string) ([]string, error) {
+	keys := []string{}
+	for _, format := range formats {
+		if config.StringPresent(format.Format) {
+			k, err := applyFormatTemplate(*format.Format, key, subpath)
 			if err != nil {
-				return err
+				return nil, err
 			}
+			keys = append(keys, k)
 		}
+	}
 
-		if config.BoolVal(r.config.Sanitize) {
-			key = InvalidRegexp.ReplaceAllString(key, "_")
-		}
+	if len(keys) == 0 {
+		return []string{key}, nil
+	}
+	return keys, nil
+}
 
-		if config.BoolVal(r.config.Upcase) {
-			key = strings.ToUpper(key)
-		}
+// withSecretMetadata returns a copy of the KV v2 secret data with the version,
+// creation time and custom metadata of the secret added as "metadata_version",
+// "metadata_created_time" and "metadata_custom_<key>" keys.
+func withSecretMetadata(data, metadata map[string]interface{}) map[string]interface{} {
+	r := make(map[string]interface{}, len(data)+2)
+	for k, v := range data {
+		r[k] = v
+	}
 
-		logger := namedLogger("runner")
-		if current, ok := env[key]; ok {
-			logger.Debug(fmt.Sprintf("overwriting %s=%q (was %q) from %s", key, value, current, d))
-			env[key] = value
-		} else {
-			logger.Debug(fmt.Sprintf("setting %s=%q from %s", key, value, d))
-			env[key] = value
+	if v := metadata["version"]; v != nil {
+		r["metadata_version"] = fmt.Sprint(v)
+	}
+
+	if v := metadata["created_time"]; v != nil {
+		r["metadata_created_time"] = fmt.Sprint(v)
+	}
+
+	if custom, ok := metadata["custom_metadata"].(map[string]interface{}); ok {
+		for k, v := range custom {
+			if v != nil {
+				r["metadata_custom_"+k] = fmt.Sprint(v)
+			}
 		}
 	}
 
-	return nil
+	return r
 }
 
 func isVaultKv2(data map[string]interface{}) bool {
@@ -611,14 +1739,23 @@ func (r *Runner) appendSecrets(
 	var err error
 	logger := namedLogger("runner")
 
+	// Get the PrefixConfig so we can get configuration from it.
+	cp := r.configPrefixMap[d.String()]
+
+	// A deleted secret is stored as the error reading it, see
+	// receiveDeletedSecret.
+	if err, ok := data.(error); ok {
+		if config.BoolVal(cp.ErrorOnDeleted) {
+			return fmt.Errorf("%s: %w", err, ErrSecretDeleted)
+		}
+		return nil
+	}
+
 	typed, ok := data.(*dep.Secret)
 	if !ok {
 		return fmt.Errorf("error converting to secret %s", d)
 	}
 
-	// Get the PrefixConfig so we can get configuration from it.
-	cp := r.configPrefixMap[d.String()]
-
 	valueMap := typed.Data
 	if isVaultKv2(valueMap) {
 		// Vault Secrets KV1 and KV2 return different formats. Here we check the key
@@ -643,27 +1780,30 @@ func (r *Runner) appendSecrets(
 		// 		}
 		// }
 		logger.Debug("Found KV2 secret")
+		metadata := valueMap["metadata"].(map[string]interface{})
 
 		if valueMap["data"] == nil {
 			logger.Debug("KV2 secret is nil or was deleted")
+			if config.BoolVal(cp.ErrorOnDeleted) {
+				return fmt.Errorf("%s: %w", d, ErrSecretDeleted)
+			}
 			valueMap = nil
 		} else {
 			valueMap = valueMap["data"].(map[string]interface{})
 		}
-	}
-
-	var applyPerKeyFormat bool
-	var keyFormats map[string][]*KeyFormat
 
-	// pre-populate key formats map here so we don't have a potential O(n^2) complexity in the loop later
-	if cp.Keys != nil && !config.StringPresent(cp.Format) {
-		applyPerKeyFormat = true
-		keyFormats = make(map[string][]*KeyFormat)
-		for _, v := range *cp.Keys {
-			keyFormats[*v.Name] = append(keyFormats[*v.Name], v)
+		if config.BoolVal(cp.ExportMetadata) {
+			valueMap = withSecretMetadata(valueMap, metadata)
 		}
 	}
 
+	rules := r.keyRulesMap[d.String()]
+	keyFormats := perKeyFormats(cp)
+
+	// subpath is the path of the secret relative to the recursive secret it
+	// was found under, if any.
+	subpath := r.subpathMap[d.String()]
+
 	for originalKey, value := range valueMap {
 		// Ignore any keys that are empty (not sure if this is even possible in
 		// Vault, but I play defense).
@@ -676,28 +1816,23 @@ func (r *Runner) appendSecrets(
 			continue
 		}
 
-		keys := []string{originalKey}
+		// Apply the include/exclude filters on the original key.
+		if !rules.allowed(originalKey) {
+			logger.Debug(fmt.Sprintf("skipping key '%s' since it is filtered out", originalKey))
+			continue
+		}
+
+		keys := []string{rules.renamed(originalKey)}
 		// Check for per-key configuration override on a very early stage
 		// before the `key` is updated with prefix or become uppercase
-		if applyPerKeyFormat {
-			keyFormat, ok := keyFormats[originalKey]
+		if keyFormats != nil {
+			formats, ok := keyFormats[originalKey]
 			if !ok {
 				logger.Debug(fmt.Sprintf("skipping key '%s' since it is not listed in configuration", originalKey))
 				continue
 			}
-			appliedFormats := []string{}
-			for _, format := range keyFormat {
-				if config.StringPresent(format.Format) {
-					key, err := applyFormatTemplate(*format.Format, originalKey)
-					if err != nil {
-						return err
-					}
-					appliedFormats = append(appliedFormats, key)
-				}
-			}
-			// reset keys slice in case of per-key formatting
-			if len(appliedFormats) > 0 {
-				keys = appliedFormats
+			if keys, err = applyKeyFormats(formats, keys[0], subpath); err != nil {
+				return err
 			}
 		}
 
@@ -723,7 +1858,7 @@ func (r *Runner) appendSecrets(
 
 			// If the user specified a custom format for all keys, apply that here.
 			if config.StringPresent(cp.Format) {
-				key, err = applyFormatTemplate(config.StringVal(cp.Format), key)
+				key, err = applyFormatTemplate(config.StringVal(cp.Format), key, subpath)
 				if err != nil {
 					return err
 				}
@@ -791,6 +1926,9 @@ func (r *Runner) init(clients *dep.ClientSet) error {
 		}
 		r.dependencies = append(r.dependencies, d)
 		r.configPrefixMap[d.String()] = p
+		if r.keyRulesMap[d.String()], err = newKeyRules(p); err != nil {
+			return err
+		}
 	}
 
 	// Parse and add consul services
@@ -804,6 +1942,37 @@ func (r *Runner) init(clients *dep.ClientSet) error {
 		r.configServiceMap[d.String()] = s
 	}
 
+	// Parse and add meta sources - the prefixes they list come after the
+	// configured prefixes and the secrets they list before the configured
+	// secrets. appendDependencies adds all the Consul data before the Vault
+	// data, so Consul values never overwrite values from Vault.
+	for _, m := range *r.config.Meta {
+		var d dep.Dependency
+		switch {
+		case config.StringPresent(m.ConsulKey):
+			path, err := applyPathTemplate(config.StringVal(m.ConsulKey))
+			if err != nil {
+				return err
+			}
+			if d, err = dep.NewKVGetQuery(path); err != nil {
+				return err
+			}
+		case config.StringPresent(m.VaultSecret):
+			path, err := applyPathTemplate(config.StringVal(m.VaultSecret))
+			if err != nil {
+				return err
+			}
+			if d, err = dep.NewVaultReadQuery(path); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("meta requires one of consul_key or vault_secret")
+		}
+
+		r.dependencies = append(r.dependencies, d)
+		r.configMetaMap[d.String()] = m
+	}
+
 	// Parse and add vault dependencies - it is important that this come after
 	// consul, because consul should never be permitted to overwrite values from
 	// vault; that would expose a security hole since access to consul is
@@ -814,13 +1983,35 @@ func (r *Runner) init(clients *dep.ClientSet) error {
 			return err
 		}
 
+		// Pin KV v2 secrets to a specific version if requested.
+		if v := config.IntVal(s.Version); v > 0 && !config.BoolVal(s.Recursive) {
+			path = fmt.Sprintf("%s?version=%d", path, v)
+		}
+
 		logger.Info("looking at vault", "path", path)
-		d, err := dep.NewVaultReadQuery(path)
+		var d dep.Dependency
+		if config.BoolVal(s.Recursive) {
+			d, err = dep.NewVaultListQuery(path)
+		} else {
+			d, err = dep.NewVaultReadQuery(path)
+		}
 		if err != nil {
 			return err
 		}
 		r.dependencies = append(r.dependencies, d)
 		r.configPrefixMap[d.String()] = s
+		if r.keyRulesMap[d.String()], err = newKeyRules(s); err != nil {
+			return err
+		}
+	}
+
+	// Open the audit log last, so that it is not left open on errors above
+	if config.BoolVal(r.config.Audit.Enabled) {
+		r.audit, err = openAuditLog(config.StringVal(r.config.Audit.Path),
+			[]byte(config.StringVal(r.config.Audit.HMACKey)))
+		if err != nil {
+			return errors.Wrap(err, "opening audit log")
+		}
 	}
 
 	return nil
@@ -837,9 +2028,11 @@ func (r *Runner) stopWatchers() {
 	}
 }
 
+// stopChild stops the child process, under the write lock so that stopping
+// is serialised with starting and signaling it.
 func (r *Runner) stopChild() {
-	r.childLock.RLock()
-	defer r.childLock.RUnlock()
+	r.childLock.Lock()
+	defer r.childLock.Unlock()
 
 	if r.child != nil {
 		namedLogger("runner").Debug("stopping child process")
@@ -847,6 +2040,14 @@ func (r *Runner) stopChild() {
 	}
 }
 
+// setChild replaces the child process and the environment it was started
+// with.
+func (r *Runner) setChild(c *child.Child, env []string) {
+	r.childLock.Lock()
+	defer r.childLock.Unlock()
+	r.child, r.childEnv = c, env
+}
+
 // storePid is used to write out a PID file to disk.
 func (r *Runner) storePid() error {
 	path := config.StringVal(r.config.PidFile)
@@ -870,6 +2071,56 @@ func (r *Runner) storePid() error {
 	return nil
 }
 
+// runnerStatus is the content of the status file.
+type runnerStatus struct {
+	Status   string   `json:"status"`
+	Pid      int      `json:"pid,omitempty"`
+	LastDiff *EnvDiff `json:"last_diff,omitempty"`
+}
+
+// storeStatus writes the status of the child process and the last change of
+// its environment to the status file, if one is configured.
+func (r *Runner) storeStatus() error {
+	path := config.StringVal(r.config.StatusFile)
+	if path == "" {
+		return nil
+	}
+
+	status := &runnerStatus{Status: r.status(), LastDiff: r.LastDiff()}
+	r.childLock.RLock()
+	if r.child != nil {
+		status.Pid = r.child.Pid()
+	}
+	r.childLock.RUnlock()
+
+	b, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Replace the file at once, so that it is never read half written
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(b, '\n'), 0o644); err != nil {
+		return fmt.Errorf("runner: could not write status file: %s", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("runner: could not write status file: %s", err)
+	}
+	return nil
+}
+
+// deleteStatus removes the status file on exit.
+func (r *Runner) deleteStatus() error {
+	path := config.StringVal(r.config.StatusFile)
+	if path == "" {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("runner: could not remove status file: %s", err)
+	}
+	return nil
+}
+
 // deletePid is used to remove the PID on exit.
 func (r *Runner) deletePid() error {
 	path := config.StringVal(r.config.PidFile)
@@ -1,14 +1,40 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/consul-template/config"
 	"github.com/hashicorp/consul-template/dependency"
+	"github.com/hashicorp/go-gatedio"
 )
 
+func TestMain(m *testing.M) {
+	// Child processes with listeners run the test binary as their exec shim
+	if settings, ok := os.LookupEnv(execShimEnv); ok {
+		os.Exit(runExecShim(settings, os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
 func TestRunner_appendSecrets(t *testing.T) {
 	t.Parallel()
 
@@ -231,6 +257,375 @@ func TestRunner_appendSecrets(t *testing.T) {
 	}
 }
 
+func TestRunner_appendSecretsKv2Metadata(t *testing.T) {
+	t.Parallel()
+
+	metadata := map[string]interface{}{
+		"created_time":  "2018-03-22T02:24:06.945319214Z",
+		"deletion_time": "",
+		"destroyed":     false,
+		"version":       "3",
+		"custom_metadata": map[string]interface{}{
+			"owner": "team-a",
+		},
+	}
+
+	cases := []struct {
+		name           string
+		data           map[string]interface{}
+		exportMetadata bool
+		errorOnDeleted bool
+		deleted        bool
+		expectedEnv    map[string]string
+		err            bool
+	}{
+		{
+			name: "metadata not exported by default",
+			data: map[string]interface{}{
+				"metadata": metadata,
+				"data":     map[string]interface{}{"bar": "baz"},
+			},
+			expectedEnv: map[string]string{"bar": "baz"},
+		},
+		{
+			name: "metadata exported",
+			data: map[string]interface{}{
+				"metadata": metadata,
+				"data":     map[string]interface{}{"bar": "baz"},
+			},
+			exportMetadata: true,
+			expectedEnv: map[string]string{
+				"bar":                   "baz",
+				"metadata_version":      "3",
+				"metadata_created_time": "2018-03-22T02:24:06.945319214Z",
+				"metadata_custom_owner": "team-a",
+			},
+		},
+		{
+			name: "deleted secret drops keys",
+			data: map[string]interface{}{
+				"metadata": metadata,
+				"data":     map[string]interface{}{"bar": "baz"},
+			},
+			deleted:     true,
+			expectedEnv: map[string]string{},
+		},
+		{
+			name: "deleted secret errors",
+			data: map[string]interface{}{
+				"metadata": metadata,
+				"data":     map[string]interface{}{"bar": "baz"},
+			},
+			errorOnDeleted: true,
+			deleted:        true,
+			expectedEnv:    map[string]string{},
+			err:            true,
+		},
+	}
+
+	// Vault responds to reading a deleted KV v2 secret with its metadata and
+	// a 404 status, which consul-template fails reading with
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v1/sys/internal/ui/mounts/secret/data/foo":
+			fmt.Fprint(w, `{"data": {"path": "secret/", "type": "kv", "options": {"version": "2"}}}`)
+		case "/v1/secret/data/foo":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"data": {"data": null, "metadata": {"deletion_time": "2018-03-23T02:24:06Z", "destroyed": false, "version": 3}}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer vault.Close()
+	clients := dependency.NewClientSet()
+	if err := clients.CreateVaultClient(&dependency.CreateVaultClientInput{
+		Address: vault.URL,
+		Token:   "token",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Secrets: &PrefixConfigs{
+					&PrefixConfig{
+						Path:           config.String("secret/data/foo"),
+						NoPrefix:       config.Bool(true),
+						ExportMetadata: config.Bool(tc.exportMetadata),
+						ErrorOnDeleted: config.Bool(tc.errorOnDeleted),
+					},
+				},
+			}
+			c := DefaultConfig().Merge(&cfg)
+			r, err := NewRunner(c, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vrq, err := dependency.NewVaultReadQuery("secret/data/foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Receive(vrq, &dependency.Secret{Data: tc.data})
+			if tc.deleted {
+				_, _, err := vrq.Fetch(clients, &dependency.QueryOptions{})
+				if err == nil {
+					t.Fatal("expected reading the deleted secret to fail")
+				}
+				if !r.receiveDeletedSecret(err) {
+					t.Fatalf("expected %q to be handled as a deleted secret", err)
+				}
+			}
+
+			env := make(map[string]string)
+			err = r.appendSecrets(env, vrq, r.data[vrq.String()])
+			if (err != nil) != tc.err {
+				t.Fatal(err)
+			}
+			if tc.err && !errors.Is(err, ErrSecretDeleted) {
+				t.Fatalf("expected ErrSecretDeleted, got %s", err)
+			}
+			if !reflect.DeepEqual(tc.expectedEnv, env) {
+				t.Errorf("\nexp: %#v\nact: %#v", tc.expectedEnv, env)
+			}
+		})
+	}
+}
+
+func TestRunner_secretVersion(t *testing.T) {
+	cfg := Config{
+		Secrets: &PrefixConfigs{
+			&PrefixConfig{
+				Path:    config.String("secret/data/foo"),
+				Version: config.Int(3),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.dependencies) != 1 {
+		t.Fatalf("expected 1 dependency, got %d", len(r.dependencies))
+	}
+	if exp, act := "vault.read(secret/data/foo.v3)", r.dependencies[0].String(); exp != act {
+		t.Errorf("expected %q, got %q", exp, act)
+	}
+}
+
+func TestRunner_recursiveSecrets(t *testing.T) {
+	cfg := Config{
+		Secrets: &PrefixConfigs{
+			&PrefixConfig{
+				Path:      config.String("secret/app"),
+				NoPrefix:  config.Bool(true),
+				Format:    config.String("{{ subpath }}_{{ key }}"),
+				Recursive: config.Bool(true),
+			},
+		},
+		Sanitize: config.Bool(true),
+		Upcase:   config.Bool(true),
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.stopWatchers()
+
+	if len(r.dependencies) != 1 {
+		t.Fatalf("expected 1 dependency, got %d", len(r.dependencies))
+	}
+	root := r.dependencies[0]
+	if exp, act := "vault.list(secret/app)", root.String(); exp != act {
+		t.Fatalf("expected %q, got %q", exp, act)
+	}
+
+	appendRoot := func() (map[string]string, bool) {
+		env := make(map[string]string)
+		ok, err := r.appendDependency(env, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return env, ok
+	}
+
+	// children are added as they are listed and need data before the
+	// environment is complete
+	r.data[root.String()] = []string{"db", "nested/"}
+	if _, ok := appendRoot(); ok {
+		t.Fatal("expected missing data for children")
+	}
+	if exp, act := 2, len(r.children[root.String()]); exp != act {
+		t.Fatalf("expected %d children, got %d", exp, act)
+	}
+
+	r.data["vault.read(secret/app/db)"] = &dependency.Secret{
+		Data: map[string]interface{}{"password": "hunter2"},
+	}
+	r.data["vault.list(secret/app/nested)"] = []string{"cache"}
+	if _, ok := appendRoot(); ok {
+		t.Fatal("expected missing data for nested children")
+	}
+
+	r.data["vault.read(secret/app/nested/cache)"] = &dependency.Secret{
+		Data: map[string]interface{}{"host": "cache.local"},
+	}
+	env, ok := appendRoot()
+	if !ok {
+		t.Fatal("expected data for all children")
+	}
+	expected := map[string]string{
+		"DB_PASSWORD":       "hunter2",
+		"NESTED_CACHE_HOST": "cache.local",
+	}
+	if !reflect.DeepEqual(expected, env) {
+		t.Errorf("\nexp: %#v\nact: %#v", expected, env)
+	}
+
+	// secrets that disappear are removed along with their data
+	r.data[root.String()] = []string{"db"}
+	env, ok = appendRoot()
+	if !ok {
+		t.Fatal("expected data for all children")
+	}
+	expected = map[string]string{
+		"DB_PASSWORD": "hunter2",
+	}
+	if !reflect.DeepEqual(expected, env) {
+		t.Errorf("\nexp: %#v\nact: %#v", expected, env)
+	}
+	for _, k := range []string{"vault.list(secret/app/nested)", "vault.read(secret/app/nested/cache)"} {
+		if _, ok := r.data[k]; ok {
+			t.Errorf("expected data for %s to be removed", k)
+		}
+		if _, ok := r.configPrefixMap[k]; ok {
+			t.Errorf("expected config for %s to be removed", k)
+		}
+	}
+}
+
+func TestRunner_metaSources(t *testing.T) {
+	cfg := Config{
+		Meta: &MetaConfigs{
+			&MetaConfig{
+				ConsulKey: config.String("deploy/web"),
+				NoPrefix:  config.Bool(true),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.stopWatchers()
+
+	if len(r.dependencies) != 1 {
+		t.Fatalf("expected 1 dependency, got %d", len(r.dependencies))
+	}
+	meta := r.dependencies[0]
+
+	appendMeta := func() (map[string]string, bool) {
+		env := make(map[string]string)
+		ok, err := r.appendDependency(env, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return env, ok
+	}
+
+	// a missing key adds nothing
+	r.data[meta.String()] = nil
+	env, ok := appendMeta()
+	if !ok || len(env) != 0 {
+		t.Fatalf("expected empty environment, got %#v", env)
+	}
+
+	r.data[meta.String()] = `{"prefixes": ["app/web"], "secrets": "secret/web"}`
+	if _, ok := appendMeta(); ok {
+		t.Fatal("expected missing data for listed dependencies")
+	}
+
+	r.data["kv.list(app/web)"] = []*dependency.KeyPair{
+		{Key: "password", Value: "from-consul"},
+		{Key: "host", Value: "web.local"},
+	}
+	r.data["vault.read(secret/web)"] = &dependency.Secret{
+		Data: map[string]interface{}{"password": "from-vault"},
+	}
+	env, ok = appendMeta()
+	if !ok {
+		t.Fatal("expected data for all listed dependencies")
+	}
+	expected := map[string]string{
+		"host":     "web.local",
+		"password": "from-vault",
+	}
+	if !reflect.DeepEqual(expected, env) {
+		t.Errorf("\nexp: %#v\nact: %#v", expected, env)
+	}
+
+	// dependencies that are no longer listed are removed
+	r.data[meta.String()] = `prefixes = ["app/web"]`
+	env, ok = appendMeta()
+	if !ok {
+		t.Fatal("expected data for all listed dependencies")
+	}
+	expected = map[string]string{
+		"host":     "web.local",
+		"password": "from-consul",
+	}
+	if !reflect.DeepEqual(expected, env) {
+		t.Errorf("\nexp: %#v\nact: %#v", expected, env)
+	}
+	if _, ok := r.data["vault.read(secret/web)"]; ok {
+		t.Error("expected data for removed secret to be removed")
+	}
+}
+
+func TestRunner_metaSourcesOrder(t *testing.T) {
+	cfg := Config{
+		Meta: &MetaConfigs{
+			&MetaConfig{
+				ConsulKey: config.String("deploy/one"),
+				NoPrefix:  config.Bool(true),
+			},
+			&MetaConfig{
+				ConsulKey: config.String("deploy/two"),
+				NoPrefix:  config.Bool(true),
+			},
+		},
+	}
+	r, err := NewRunner(DefaultConfig().Merge(&cfg), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.stopWatchers()
+
+	// The prefix listed by the second meta source sets the same key as the
+	// secret listed by the first one
+	r.data["kv.get(deploy/one)"] = `secrets = "secret/one"`
+	r.data["kv.get(deploy/two)"] = `prefixes = "app/two"`
+	r.data["vault.read(secret/one)"] = &dependency.Secret{
+		Data: map[string]interface{}{"password": "from-vault"},
+	}
+	r.data["kv.list(app/two)"] = []*dependency.KeyPair{
+		{Key: "password", Value: "from-consul"},
+	}
+
+	env := make(map[string]string)
+	ok, err := r.appendDependencies(env, r.dependencies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected data for all listed dependencies")
+	}
+	if act := env["password"]; act != "from-vault" {
+		t.Errorf("expected the value from Vault, got %q", act)
+	}
+}
+
 func TestRunner_perKeyConfigurationOverride(t *testing.T) {
 	cases := []struct {
 		name        string
@@ -551,6 +946,102 @@ func TestRunner_perKeyConfigurationOverride(t *testing.T) {
 	}
 }
 
+func TestRunner_perKeyConfigurationOverridePrefixes(t *testing.T) {
+	t.Parallel()
+
+	data := []*dependency.KeyPair{
+		{Key: "user", Value: "db-app-user"},
+		{Key: "password", Value: "db-app-password"},
+		{Key: "host", Value: "db.local"},
+	}
+
+	cases := []struct {
+		name        string
+		format      string
+		noPrefix    *bool
+		keys        *KeyFormats
+		expectedEnv map[string]string
+	}{
+		{
+			name: "unlisted keys are skipped",
+			keys: &KeyFormats{
+				&KeyFormat{Name: config.String("user")},
+			},
+			expectedEnv: map[string]string{
+				"user": "db-app-user",
+			},
+		},
+		{
+			name: "multiple env names per key",
+			keys: &KeyFormats{
+				&KeyFormat{Name: config.String("user"), Format: config.String("DB_{{ key }}")},
+				&KeyFormat{Name: config.String("user"), Format: config.String("PG{{ key }}")},
+				&KeyFormat{Name: config.String("password"), Format: config.String("DB_{{ key }}")},
+			},
+			expectedEnv: map[string]string{
+				"DB_user":     "db-app-user",
+				"PGuser":      "db-app-user",
+				"DB_password": "db-app-password",
+			},
+		},
+		{
+			name:     "prefix is applied after per-key format",
+			noPrefix: config.Bool(false),
+			keys: &KeyFormats{
+				&KeyFormat{Name: config.String("host"), Format: config.String("db_{{ key }}")},
+			},
+			expectedEnv: map[string]string{
+				"app_db_db_host": "db.local",
+			},
+		},
+		{
+			name:   "prefix format takes precedence over per-key formats",
+			format: "pg_{{ key }}",
+			keys: &KeyFormats{
+				&KeyFormat{Name: config.String("host"), Format: config.String("db_{{ key }}")},
+			},
+			expectedEnv: map[string]string{
+				"pg_user":     "db-app-user",
+				"pg_password": "db-app-password",
+				"pg_host":     "db.local",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Prefixes: &PrefixConfigs{
+					&PrefixConfig{
+						NoPrefix: tc.noPrefix,
+						Path:     config.String("app/db"),
+						Format:   config.String(tc.format),
+						Keys:     tc.keys,
+					},
+				},
+			}
+
+			c := DefaultConfig().Merge(&cfg)
+			r, err := NewRunner(c, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kvq, err := dependency.NewKVListQuery("app/db")
+			if err != nil {
+				t.Fatal(err)
+			}
+			env := make(map[string]string)
+			if err := r.appendPrefixes(env, kvq, data); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(tc.expectedEnv, env) {
+				t.Errorf("\nexp: %#v\nact: %#v", tc.expectedEnv, env)
+			}
+		})
+	}
+}
+
 func TestRunner_appendPrefixes(t *testing.T) {
 	t.Parallel()
 
@@ -640,62 +1131,206 @@ func TestRunner_appendPrefixes(t *testing.T) {
 	}
 }
 
-func TestRunner_appendServices(t *testing.T) {
+func TestRunner_keyRules(t *testing.T) {
 	t.Parallel()
 
 	cases := []struct {
-		name           string
-		query          string
-		config         Config
-		data           []*dependency.CatalogService
-		keyValue       map[string]string
-		serviceID      string
-		serviceName    string
-		serviceAddress string
-		serviceTag     string
-		servicePort    string
+		name        string
+		include     []string
+		exclude     []string
+		rename      *RenameConfigs
+		expectedEnv map[string]string
 	}{
 		{
-			name:   "service appends data",
-			query:  "service",
-			config: Config{},
-			data: []*dependency.CatalogService{
-				{
-					ServiceID:      "id",
-					ServiceName:    "foo",
-					ServiceAddress: "address",
-					ServiceTags:    dependency.ServiceTags{"tag1", "tag2"},
-					ServicePort:    8080,
-				},
+			name: "no rules keeps every key",
+			expectedEnv: map[string]string{
+				"DB_HOST":     "db.local",
+				"DB_PASSWORD": "hunter2",
+				"CACHE_HOST":  "cache.local",
 			},
-			keyValue: map[string]string{
-				"foo/id":      "id",
-				"foo/name":    "foo",
-				"foo/address": "address",
-				"foo/tag":     "tag1,tag2",
-				"foo/port":    "8080",
+		},
+		{
+			name:    "include glob",
+			include: []string{"DB_*"},
+			expectedEnv: map[string]string{
+				"DB_HOST":     "db.local",
+				"DB_PASSWORD": "hunter2",
 			},
-			serviceID:      "foo/id",
-			serviceName:    "foo/name",
-			serviceAddress: "foo/address",
-			serviceTag:     "foo/tag",
-			servicePort:    "foo/port",
 		},
 		{
-			name:   "service appends data",
-			query:  "service",
-			config: Config{},
-			data: []*dependency.CatalogService{
-				{
-					ServiceID:      "fail_id",
-					ServiceName:    "foo",
-					ServiceAddress: "fail_address",
-					ServiceTags:    dependency.ServiceTags{"tag1"},
-					ServicePort:    8081,
-				},
-				{
-					ServiceID:      "id",
-					ServiceName:    "foo",
+			name:    "include regexp",
+			include: []string{"/^CACHE_/"},
+			expectedEnv: map[string]string{
+				"CACHE_HOST": "cache.local",
+			},
+		},
+		{
+			name:    "exclude takes precedence over include",
+			include: []string{"DB_*"},
+			exclude: []string{"*PASSWORD"},
+			expectedEnv: map[string]string{
+				"DB_HOST": "db.local",
+			},
+		},
+		{
+			name:    "first matching rename wins",
+			include: []string{"DB_*"},
+			rename: &RenameConfigs{
+				&RenameConfig{
+					Pattern:     config.String("^DB_(.*)$"),
+					Replacement: config.String("DATABASE_$1"),
+				},
+				&RenameConfig{
+					Pattern:     config.String("^DATABASE_"),
+					Replacement: config.String("NOPE_"),
+				},
+			},
+			expectedEnv: map[string]string{
+				"DATABASE_HOST":     "db.local",
+				"DATABASE_PASSWORD": "hunter2",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			pc := &PrefixConfig{
+				Path:     config.String("shared"),
+				NoPrefix: config.Bool(true),
+				Include:  tc.include,
+				Exclude:  tc.exclude,
+				Rename:   tc.rename,
+			}
+			c := DefaultConfig().Merge(&Config{
+				Prefixes: &PrefixConfigs{pc},
+				Secrets:  &PrefixConfigs{pc.Copy()},
+			})
+			r, err := NewRunner(c, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			kvq, err := dependency.NewKVListQuery("shared")
+			if err != nil {
+				t.Fatal(err)
+			}
+			env := make(map[string]string)
+			err = r.appendPrefixes(env, kvq, []*dependency.KeyPair{
+				{Key: "DB_HOST", Value: "db.local"},
+				{Key: "DB_PASSWORD", Value: "hunter2"},
+				{Key: "CACHE_HOST", Value: "cache.local"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tc.expectedEnv, env) {
+				t.Errorf("prefix\nexp: %#v\nact: %#v", tc.expectedEnv, env)
+			}
+
+			vrq, err := dependency.NewVaultReadQuery("shared")
+			if err != nil {
+				t.Fatal(err)
+			}
+			env = make(map[string]string)
+			err = r.appendSecrets(env, vrq, &dependency.Secret{
+				Data: map[string]interface{}{
+					"DB_HOST":     "db.local",
+					"DB_PASSWORD": "hunter2",
+					"CACHE_HOST":  "cache.local",
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tc.expectedEnv, env) {
+				t.Errorf("secret\nexp: %#v\nact: %#v", tc.expectedEnv, env)
+			}
+		})
+	}
+}
+
+func TestRunner_invalidKeyRules(t *testing.T) {
+	c := DefaultConfig().Merge(&Config{
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path:    config.String("shared"),
+				Include: []string{"/(/"},
+			},
+		},
+	})
+	if _, err := NewRunner(c, true); err == nil {
+		t.Fatal("expected error for invalid include pattern")
+	}
+
+	c = DefaultConfig().Merge(&Config{
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{
+				Path:   config.String("shared"),
+				Rename: &RenameConfigs{&RenameConfig{Replacement: config.String("X")}},
+			},
+		},
+	})
+	if _, err := NewRunner(c, true); err == nil {
+		t.Fatal("expected error for rename without a pattern")
+	}
+}
+
+func TestRunner_appendServices(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name           string
+		query          string
+		config         Config
+		data           []*dependency.CatalogService
+		keyValue       map[string]string
+		serviceID      string
+		serviceName    string
+		serviceAddress string
+		serviceTag     string
+		servicePort    string
+	}{
+		{
+			name:   "service appends data",
+			query:  "service",
+			config: Config{},
+			data: []*dependency.CatalogService{
+				{
+					ServiceID:      "id",
+					ServiceName:    "foo",
+					ServiceAddress: "address",
+					ServiceTags:    dependency.ServiceTags{"tag1", "tag2"},
+					ServicePort:    8080,
+				},
+			},
+			keyValue: map[string]string{
+				"foo/id":      "id",
+				"foo/name":    "foo",
+				"foo/address": "address",
+				"foo/tag":     "tag1,tag2",
+				"foo/port":    "8080",
+			},
+			serviceID:      "foo/id",
+			serviceName:    "foo/name",
+			serviceAddress: "foo/address",
+			serviceTag:     "foo/tag",
+			servicePort:    "foo/port",
+		},
+		{
+			name:   "service appends data",
+			query:  "service",
+			config: Config{},
+			data: []*dependency.CatalogService{
+				{
+					ServiceID:      "fail_id",
+					ServiceName:    "foo",
+					ServiceAddress: "fail_address",
+					ServiceTags:    dependency.ServiceTags{"tag1"},
+					ServicePort:    8081,
+				},
+				{
+					ServiceID:      "id",
+					ServiceName:    "foo",
 					ServiceAddress: "address",
 					ServiceTags:    dependency.ServiceTags{"tag1", "tag2"},
 					ServicePort:    8080,
@@ -874,14 +1509,14 @@ func TestRunner_configEnv(t *testing.T) {
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
 			cfg := Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					Env: &config.EnvConfig{
 						Pristine:  &tc.pristine,
 						Denylist:  tc.denylist,
 						Allowlist: tc.allowlist,
 						Custom:    tc.custom,
 					},
-				},
+				}},
 			}
 			c := DefaultConfig().Merge(&cfg)
 			r, err := NewRunner(c, true)
@@ -934,14 +1569,14 @@ func TestRunner_configEnvDeprecated(t *testing.T) {
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
 			cfg := Config{
-				Exec: &config.ExecConfig{
+				Exec: &ExecConfig{ExecConfig: config.ExecConfig{
 					Env: &config.EnvConfig{
 						Pristine:            &tc.pristine,
 						DenylistDeprecated:  tc.denylistDeprecated,
 						AllowlistDeprecated: tc.allowlistDeprecated,
 						Custom:              tc.custom,
 					},
-				},
+				}},
 			}
 			c := DefaultConfig().Merge(&cfg)
 			r, err := NewRunner(c, true)
@@ -956,3 +1591,1366 @@ func TestRunner_configEnvDeprecated(t *testing.T) {
 		})
 	}
 }
+
+func TestRunner_Inherit(t *testing.T) {
+	t.Parallel()
+
+	newRunner := func(c *Config) *Runner {
+		cfg := DefaultConfig().Merge(c)
+		cfg.Exec.Command = []string{"sleep", "30"}
+		cfg.Finalize()
+
+		r, err := NewRunner(cfg, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	r1 := newRunner(&Config{})
+	defer r1.Stop()
+	if _, err := r1.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if r1.child == nil {
+		t.Fatal("expected a child")
+	}
+	pid := r1.child.Pid()
+
+	// The same environment and exec settings keep the child running
+	r2 := newRunner(&Config{})
+	defer r2.Stop()
+	r2.Inherit(r1)
+	if exitCh, err := r2.Run(); err != nil || exitCh != nil {
+		t.Fatalf("expected the child to be kept, got %v, %v", exitCh, err)
+	}
+	if r2.child == nil || r2.child.Pid() != pid {
+		t.Fatalf("expected child %d to be inherited", pid)
+	}
+	if r1.child != nil {
+		t.Errorf("expected the old runner to release the child")
+	}
+
+	// Changed exec settings restart the child
+	r3 := newRunner(&Config{
+		Exec: &ExecConfig{ExecConfig: config.ExecConfig{
+			KillTimeout: config.TimeDuration(10 * time.Second),
+		}},
+	})
+	defer r3.Stop()
+	r3.Inherit(r2)
+	exitCh, err := r3.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exitCh == nil || r3.child.Pid() == pid {
+		t.Errorf("expected the child to be restarted")
+	}
+}
+
+func TestRunner_InheritConcurrentRun(t *testing.T) {
+	t.Parallel()
+
+	kvq, err := dependency.NewKVListQuery("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		cfg := DefaultConfig().Merge(&Config{
+			Prefixes: &PrefixConfigs{
+				&PrefixConfig{Path: config.String("app")},
+			},
+		})
+		cfg.Exec.Command = []string{"sleep", "30"}
+		cfg.Finalize()
+
+		old, err := NewRunner(cfg, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewRunner(cfg.Copy(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The old runner keeps restarting its child while it is inherited
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for j := 0; j < 20; j++ {
+				old.Receive(kvq, []*dependency.KeyPair{{Key: "foo", Value: strconv.Itoa(j)}})
+				if _, err := old.Run(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		time.Sleep(time.Duration(i) * 10 * time.Millisecond)
+		r.Inherit(old)
+		<-done
+
+		if old.child != nil {
+			t.Errorf("expected the old runner to release the child")
+		}
+		if r.child != nil {
+			if err := syscall.Kill(r.child.Pid(), 0); r.child.Pid() == 0 || err != nil {
+				t.Errorf("expected the inherited child to be running: %v", err)
+			}
+		}
+		r.Stop()
+	}
+}
+
+func TestRunner_audit(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	key := []byte("s3cret")
+
+	cfg := DefaultConfig().Merge(&Config{
+		Audit: &AuditConfig{
+			Path:    config.String(path),
+			HMACKey: config.String(string(key)),
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{Path: config.String("app")},
+		},
+	})
+	cfg.Exec.Command = []string{"sleep", "30"}
+	cfg.Exec.KillTimeout = config.TimeDuration(5 * time.Second)
+	cfg.Finalize()
+
+	r, err := NewRunner(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	kvq, err := dependency.NewKVListQuery("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]*dependency.KeyPair{
+		{{Key: "foo", Value: "bar"}, {Key: "zip", Value: "zap"}},
+		{{Key: "foo", Value: "baz"}, {Key: "new", Value: "value"}},
+	} {
+		r.Receive(kvq, data)
+		if _, err := r.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pid := r.child.Pid()
+	diff := r.LastDiff()
+	r.Stop()
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(contents), "baz") || strings.Contains(string(contents), "zap") {
+		t.Errorf("expected no values in the audit log, got %s", contents)
+	}
+
+	var recs []*auditRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+		var rec auditRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, &rec)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(recs))
+	}
+
+	a := &auditLog{key: key}
+	exp := &auditRecord{
+		Time:    recs[1].Time,
+		Added:   []string{"new"},
+		Changed: []string{"foo"},
+		Removed: []string{"zip"},
+		Hashes: map[string]string{
+			"foo": a.hashValue("baz"),
+			"new": a.hashValue("value"),
+		},
+		Sources: map[string]string{
+			"foo": kvq.String(),
+			"new": kvq.String(),
+		},
+		ChildAction: auditChildRestart,
+		Pid:         pid,
+		Prev:        recs[0].HMAC,
+		HMAC:        recs[1].HMAC,
+	}
+	if !reflect.DeepEqual(exp, recs[1]) {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, recs[1])
+	}
+	if act := diff.String(); act != "added: new; changed: foo; removed: zip" {
+		t.Errorf("unexpected last diff %q", act)
+	}
+	if recs[0].ChildAction != auditChildStart {
+		t.Errorf("expected the first record to start the child, got %q", recs[0].ChildAction)
+	}
+
+	if n, err := verifyAuditLog(bytes.NewReader(contents), key); err != nil || n != 2 {
+		t.Errorf("expected 2 records verified, got %d, %v", n, err)
+	}
+}
+
+func TestAuditLog_verify(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	key := []byte("s3cret")
+
+	// The chain continues across reopening the log
+	for i, env := range []map[string]string{
+		{"foo": "bar"},
+		{"foo": "baz"},
+		{},
+	} {
+		a, err := openAuditLog(path, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Record(diffEnv(nil, env), env, nil, auditChildRestart, i+1, nil); err != nil {
+			t.Fatal(err)
+		}
+		a.Close()
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(contents), "\n")
+
+	cases := []struct {
+		name     string
+		contents string
+		key      string
+		n        int
+		err      string
+	}{
+		{
+			"valid",
+			string(contents),
+			"s3cret",
+			3,
+			"",
+		},
+		{
+			"wrong_key",
+			string(contents),
+			"other",
+			0,
+			"line 1: HMAC mismatch, the record was changed",
+		},
+		{
+			"changed",
+			lines[0] + strings.Replace(lines[1], `"pid":2`, `"pid":4`, 1) + lines[2],
+			"s3cret",
+			1,
+			"line 2: HMAC mismatch, the record was changed",
+		},
+		{
+			"removed",
+			lines[0] + lines[2],
+			"s3cret",
+			1,
+			"line 2: chain broken, a record was removed or reordered",
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			n, err := verifyAuditLog(strings.NewReader(tc.contents), []byte(tc.key))
+			var act string
+			if err != nil {
+				act = err.Error()
+			}
+			if act != tc.err {
+				t.Errorf("\nexp: %#v\nact: %#v", tc.err, act)
+			}
+			if n != tc.n {
+				t.Errorf("\nexp: %#v\nact: %#v", tc.n, n)
+			}
+		})
+	}
+}
+
+func TestAuditLog_noKey(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	env := map[string]string{"foo": "bar"}
+	read := func(path string) []*auditRecord {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var recs []*auditRecord
+		for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+			var rec auditRecord
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatal(err)
+			}
+			recs = append(recs, &rec)
+		}
+		return recs
+	}
+
+	// The salt in the header is kept across reopening the log
+	paths := []string{filepath.Join(dir, "a.log"), filepath.Join(dir, "b.log")}
+	for _, path := range paths {
+		for i := 0; i < 2; i++ {
+			a, err := openAuditLog(path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := a.Record(diffEnv(nil, env), env, nil, auditChildStart, 1, nil); err != nil {
+				t.Fatal(err)
+			}
+			a.Close()
+		}
+	}
+
+	a, b := read(paths[0]), read(paths[1])
+	if len(a) != 3 {
+		t.Fatalf("expected a header and 2 records, got %d lines", len(a))
+	}
+	if a[0].Salt == "" || a[0].Salt == b[0].Salt {
+		t.Errorf("expected a random salt in the header, got %q and %q", a[0].Salt, b[0].Salt)
+	}
+
+	// Values are hashed with the salt of the file
+	salt, err := hex.DecodeString(a[0].Salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := hmac.New(sha256.New, salt)
+	h.Write([]byte("bar"))
+	exp := "hmac-sha256:" + hex.EncodeToString(h.Sum(nil))
+	for _, rec := range a[1:] {
+		if act := rec.Hashes["foo"]; act != exp {
+			t.Errorf("expected %q, got %q", exp, act)
+		}
+	}
+	if b[1].Hashes["foo"] == exp {
+		t.Error("expected differing hashes across files")
+	}
+}
+
+func TestDiffEnv(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		old  map[string]string
+		env  map[string]string
+		exp  []string
+	}{
+		{
+			"first",
+			nil,
+			map[string]string{"B": "1", "A": "2"},
+			[]string{
+				"ENVCONSUL_ENV_ADDED=A,B",
+				"ENVCONSUL_ENV_CHANGED=",
+				"ENVCONSUL_ENV_REMOVED=",
+				"ENVCONSUL_ENV_DIFF=added: A, B",
+			},
+		},
+		{
+			"changes",
+			map[string]string{"A": "1", "B": "2", "C": "3"},
+			map[string]string{"A": "1", "B": "4", "D": "5"},
+			[]string{
+				"ENVCONSUL_ENV_ADDED=D",
+				"ENVCONSUL_ENV_CHANGED=B",
+				"ENVCONSUL_ENV_REMOVED=C",
+				"ENVCONSUL_ENV_DIFF=added: D; changed: B; removed: C",
+			},
+		},
+		{
+			"same",
+			map[string]string{"A": "1"},
+			map[string]string{"A": "1"},
+			[]string{
+				"ENVCONSUL_ENV_ADDED=",
+				"ENVCONSUL_ENV_CHANGED=",
+				"ENVCONSUL_ENV_REMOVED=",
+				"ENVCONSUL_ENV_DIFF=no changes",
+			},
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			act := diffEnv(tc.old, tc.env).Env()
+			if !reflect.DeepEqual(tc.exp, act) {
+				t.Errorf("\nexp: %#v\nact: %#v", tc.exp, act)
+			}
+		})
+	}
+}
+
+func TestRunner_hooks(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "hooks.log")
+
+	cfg := DefaultConfig().Merge(&Config{
+		Exec: &ExecConfig{
+			ExecConfig: config.ExecConfig{
+				Command:     []string{"sleep 30"},
+				KillTimeout: config.TimeDuration(100 * time.Millisecond),
+			},
+			Hooks: &HooksConfig{
+				PreStart:  config.String(fmt.Sprintf(`test "$foo" != fail && echo "pre_start $foo" >> %s`, path)),
+				PostStart: config.String(fmt.Sprintf(`echo "post_start $foo" >> %s`, path)),
+				OnChange:  config.String(fmt.Sprintf(`echo "on_change $ENVCONSUL_ENV_CHANGED" >> %s`, path)),
+				PreStop:   config.String(fmt.Sprintf(`echo "pre_stop $foo" >> %s`, path)),
+			},
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{Path: config.String("app")},
+		},
+	})
+	cfg.Finalize()
+
+	r, err := NewRunner(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	kvq, err := dependency.NewKVListQuery("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(value string) {
+		r.Receive(kvq, []*dependency.KeyPair{{Key: "foo", Value: value}})
+		if _, err := r.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run("bar")
+	run("baz")
+	pid := r.child.Pid()
+
+	// A failing pre_start hook keeps the current child
+	run("fail")
+	if r.child.Pid() != pid {
+		t.Errorf("expected child %d to keep running", pid)
+	}
+	if act := r.env["foo"]; act != "baz" {
+		t.Errorf("expected the previous environment, got %q", act)
+	}
+	r.Stop()
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := "pre_start bar\npost_start bar\n" +
+		"pre_start baz\npre_stop bar\npost_start baz\non_change foo\n" +
+		"pre_stop baz\n"
+	if act := string(contents); act != exp {
+		t.Errorf("\nexp: %#v\nact: %#v", exp, act)
+	}
+}
+
+func TestRunner_stopInterruptsHook(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "started")
+
+	cfg := DefaultConfig().Merge(&Config{
+		Exec: &ExecConfig{
+			ExecConfig: config.ExecConfig{
+				Command: []string{"sleep", "30"},
+			},
+			Hooks: &HooksConfig{
+				PreStart: config.String(fmt.Sprintf("touch %s && exec sleep 30", path)),
+			},
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{Path: config.String("app")},
+		},
+	})
+	cfg.Finalize()
+
+	r, err := NewRunner(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kvq, err := dependency.NewKVListQuery("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Receive(kvq, []*dependency.KeyPair{{Key: "foo", Value: "bar"}})
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := r.Run()
+		errCh <- err
+	}()
+
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		r.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pre_start hook was not interrupted")
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop waited for the pre_start hook")
+	}
+
+	if r.child != nil {
+		t.Error("expected no child to start")
+	}
+}
+
+func TestRunner_replaceStartFirst(t *testing.T) {
+	t.Parallel()
+
+	ready := filepath.Join(t.TempDir(), "ready")
+
+	cfg := DefaultConfig().Merge(&Config{
+		Exec: &ExecConfig{
+			ExecConfig: config.ExecConfig{
+				// The child gets ready unless its value is "broken"
+				Command:     []string{fmt.Sprintf(`test "$foo" = broken || touch %s; sleep 30`, ready)},
+				KillTimeout: config.TimeDuration(100 * time.Millisecond),
+			},
+			ReplaceStrategy: config.String(ReplaceStartFirst),
+			Ready: &ReadyConfig{
+				File:     config.String(ready),
+				Timeout:  config.TimeDuration(500 * time.Millisecond),
+				Interval: config.TimeDuration(10 * time.Millisecond),
+			},
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{Path: config.String("app")},
+		},
+	})
+	cfg.Finalize()
+
+	r, err := NewRunner(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	kvq, err := dependency.NewKVListQuery("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(value string) <-chan int {
+		r.Receive(kvq, []*dependency.KeyPair{{Key: "foo", Value: value}})
+		exitCh, err := r.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exitCh
+	}
+
+	// Let the first child get ready, so its ready file is not mistaken for the
+	// one of the next child
+	run("bar")
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(ready); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	oldPid := r.child.Pid()
+
+	// The new child replaces the old one once it is ready
+	if exitCh := run("baz"); exitCh == nil {
+		t.Fatal("expected a new child")
+	}
+	if r.child.Pid() == oldPid {
+		t.Fatal("expected the child to be replaced")
+	}
+	if err := syscall.Kill(oldPid, 0); err == nil {
+		t.Errorf("expected the old child %d to be stopped", oldPid)
+	}
+	current := r.child
+
+	// A new child that does not get ready is stopped, and the current one
+	// keeps running
+	if exitCh := run("broken"); exitCh != nil {
+		t.Errorf("expected no new child")
+	}
+	if r.child != current {
+		t.Errorf("expected child %d to keep running", current.Pid())
+	}
+	if err := syscall.Kill(current.Pid(), 0); err != nil {
+		t.Errorf("expected child %d to be running: %s", current.Pid(), err)
+	}
+	if act := r.env["foo"]; act != "baz" {
+		t.Errorf("expected the previous environment, got %q", act)
+	}
+}
+
+func TestRunner_replaceStartFirstListen(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	cfg := DefaultConfig().Merge(&Config{
+		Exec: &ExecConfig{
+			ExecConfig: config.ExecConfig{
+				// The child gets ready unless its value is "broken"
+				Command:     []string{fmt.Sprintf(`test "$foo" = broken || touch %s/$$; sleep 30`, dir)},
+				KillTimeout: config.TimeDuration(100 * time.Millisecond),
+			},
+			ReplaceStrategy: config.String(ReplaceStartFirst),
+			Ready: &ReadyConfig{
+				Command:  config.String(fmt.Sprintf(`test -e %s/$ENVCONSUL_CHILD_PID`, dir)),
+				Timeout:  config.TimeDuration(500 * time.Millisecond),
+				Interval: config.TimeDuration(10 * time.Millisecond),
+			},
+		},
+		Listeners: &ListenConfigs{
+			&ListenConfig{Address: config.String("127.0.0.1:0")},
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{Path: config.String("app")},
+		},
+	})
+	cfg.Finalize()
+
+	r, err := NewRunner(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	kvq, err := dependency.NewKVListQuery("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(value string) <-chan int {
+		r.Receive(kvq, []*dependency.KeyPair{{Key: "foo", Value: value}})
+		exitCh, err := r.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exitCh
+	}
+
+	run("bar")
+	current := r.child
+
+	// The port of the shared socket accepts connections for the current
+	// child, so a tcp check would pass for the new one
+	conn, err := net.Dial("tcp", r.listeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// The new child never gets ready, the check of its own pid fails
+	if exitCh := run("broken"); exitCh != nil {
+		t.Errorf("expected no new child")
+	}
+	if r.child != current {
+		t.Errorf("expected child %d to keep running", current.Pid())
+	}
+	if err := syscall.Kill(current.Pid(), 0); err != nil {
+		t.Errorf("expected child %d to be running: %s", current.Pid(), err)
+	}
+	if act := r.env["foo"]; act != "bar" {
+		t.Errorf("expected the previous environment, got %q", act)
+	}
+}
+
+func TestRunner_stopInterruptsReady(t *testing.T) {
+	t.Parallel()
+
+	cfg := DefaultConfig().Merge(&Config{
+		Exec: &ExecConfig{
+			ExecConfig: config.ExecConfig{
+				Command: []string{"sleep", "30"},
+			},
+			ReplaceStrategy: config.String(ReplaceStartFirst),
+			Ready: &ReadyConfig{
+				File:    config.String(filepath.Join(t.TempDir(), "ready")),
+				Timeout: config.TimeDuration(time.Minute),
+			},
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{Path: config.String("app")},
+		},
+	})
+	cfg.Finalize()
+
+	r, err := NewRunner(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kvq, err := dependency.NewKVListQuery("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Receive(kvq, []*dependency.KeyPair{{Key: "foo", Value: "bar"}})
+	if _, err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	current := r.child
+
+	// The new child never gets ready
+	r.Receive(kvq, []*dependency.KeyPair{{Key: "foo", Value: "baz"}})
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := r.Run()
+		errCh <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		r.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ready check was not interrupted")
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop waited for the ready check")
+	}
+
+	if r.child != current {
+		t.Error("expected the current child to be kept")
+	}
+}
+
+func TestRunner_listen(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("checks the descriptors of the child in /proc")
+	}
+	t.Parallel()
+
+	out := filepath.Join(t.TempDir(), "out")
+
+	cfg := DefaultConfig().Merge(&Config{
+		Exec: &ExecConfig{
+			ExecConfig: config.ExecConfig{
+				Command: []string{fmt.Sprintf(`test "$LISTEN_PID" = "$$" && `+
+					`echo "$foo $LISTEN_FDS $LISTEN_FDNAMES $(readlink /proc/$$/fd/3)" >> %s; sleep 30`, out)},
+				KillTimeout: config.TimeDuration(100 * time.Millisecond),
+			},
+		},
+		Listeners: &ListenConfigs{
+			&ListenConfig{
+				Address: config.String("127.0.0.1:0"),
+				Name:    config.String("http"),
+			},
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{Path: config.String("app")},
+		},
+	})
+	cfg.Finalize()
+
+	r, err := NewRunner(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	kvq, err := dependency.NewKVListQuery("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(value string) {
+		r.Receive(kvq, []*dependency.KeyPair{{Key: "foo", Value: value}})
+		if _, err := r.Run(); err != nil {
+			t.Fatal(err)
+		}
+		// Wait for the child to write its line
+		for i := 0; i < 100; i++ {
+			if b, _ := ioutil.ReadFile(out); strings.Contains(string(b), value+" ") {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("child with %q did not start", value)
+	}
+
+	run("bar")
+	l := r.listeners[0]
+
+	// The socket stays open across restarts
+	run("baz")
+	if r.listeners[0] != l {
+		t.Errorf("expected the listener to be kept")
+	}
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	contents, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", contents)
+	}
+	for i, value := range []string{"bar", "baz"} {
+		if !strings.HasPrefix(lines[i], value+" 1 http socket:") {
+			t.Errorf("expected the child to get the socket, got %q", lines[i])
+		}
+	}
+}
+
+// notifySocket listens on a Unix datagram socket standing in for the systemd
+// notification socket, and returns its path and the messages it receives.
+func notifySocket(t *testing.T) (string, <-chan string) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	ch := make(chan string, 100)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			ch <- string(buf[:n])
+		}
+	}()
+	return path, ch
+}
+
+// receiveNotify returns the next message received by the notification socket.
+func receiveNotify(t *testing.T, ch <-chan string) string {
+	t.Helper()
+
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a notification")
+	}
+	return ""
+}
+
+func TestRunner_notify(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no Unix datagram sockets")
+	}
+
+	path, ch := notifySocket(t)
+	t.Setenv("NOTIFY_SOCKET", path)
+	t.Setenv("WATCHDOG_USEC", "20000")
+
+	n := newNotifier()
+	if n == nil {
+		t.Fatal("expected a notifier")
+	}
+	if n.watchdog != 10*time.Millisecond {
+		t.Errorf("expected a 10ms watchdog, got %s", n.watchdog)
+	}
+	if _, ok := os.LookupEnv("NOTIFY_SOCKET"); ok {
+		t.Errorf("expected NOTIFY_SOCKET to be removed from the environment")
+	}
+
+	cfg := DefaultConfig().Merge(&Config{
+		Exec: &ExecConfig{
+			ExecConfig: config.ExecConfig{
+				Command:     []string{"sleep 30"},
+				KillTimeout: config.TimeDuration(100 * time.Millisecond),
+			},
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{Path: config.String("app")},
+		},
+	})
+	cfg.Finalize()
+
+	r, err := NewRunner(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	r.notifier = n
+
+	kvq, err := dependency.NewKVListQuery("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(value string) {
+		r.Receive(kvq, []*dependency.KeyPair{{Key: "foo", Value: value}})
+		if _, err := r.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Ready once the first child starts
+	run("bar")
+	exp := fmt.Sprintf("READY=1\nSTATUS=Running child process (pid %d), environment changed at %s (added: foo)",
+		r.child.Pid(), r.LastDiff().Time.Format(time.RFC3339))
+	if act := receiveNotify(t, ch); act != exp {
+		t.Errorf("expected %q, got %q", exp, act)
+	}
+
+	// Only the status changes when the child restarts, with the reason
+	run("baz")
+	exp = fmt.Sprintf("STATUS=Running child process (pid %d), environment changed at %s (changed: foo)",
+		r.child.Pid(), r.LastDiff().Time.Format(time.RFC3339))
+	if act := receiveNotify(t, ch); act != exp {
+		t.Errorf("expected %q, got %q", exp, act)
+	}
+
+	// The watchdog is pinged while the runner is running
+	go r.Start()
+	for i := 0; i < 2; i++ {
+		if act := receiveNotify(t, ch); act != "WATCHDOG=1" {
+			t.Errorf("expected a watchdog ping, got %q", act)
+		}
+	}
+}
+
+func TestRunner_statusFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "status.json")
+
+	cfg := DefaultConfig().Merge(&Config{
+		Exec: &ExecConfig{
+			ExecConfig: config.ExecConfig{
+				Command:     []string{"sleep", "30"},
+				KillTimeout: config.TimeDuration(5 * time.Second),
+			},
+		},
+		Prefixes: &PrefixConfigs{
+			&PrefixConfig{Path: config.String("app")},
+		},
+		StatusFile: config.String(path),
+	})
+	cfg.Finalize()
+
+	r, err := NewRunner(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	kvq, err := dependency.NewKVListQuery("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]*dependency.KeyPair{
+		{{Key: "foo", Value: "bar"}, {Key: "zip", Value: "zap"}},
+		{{Key: "foo", Value: "baz"}, {Key: "new", Value: "value"}},
+	} {
+		r.Receive(kvq, data)
+		if _, err := r.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var act runnerStatus
+	if err := json.Unmarshal(b, &act); err != nil {
+		t.Fatal(err)
+	}
+	exp := runnerStatus{
+		Status:   r.status(),
+		Pid:      r.child.Pid(),
+		LastDiff: r.LastDiff(),
+	}
+	exp.LastDiff.Time = exp.LastDiff.Time.Round(0)
+	if !reflect.DeepEqual(act, exp) {
+		t.Errorf("expected %#v, got %#v", exp, act)
+	}
+	if !reflect.DeepEqual(act.LastDiff.Changed, []string{"foo"}) {
+		t.Errorf("expected foo to be changed, got %v", act.LastDiff.Changed)
+	}
+
+	// The file is removed on exit
+	r.Stop()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the status file to be removed, got %v", err)
+	}
+}
+
+func TestRunner_execCredential(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("checks no_new_privs in /proc")
+	}
+	t.Parallel()
+
+	command := `echo "$(id -u) $(id -G) $(umask) $(pwd) ` +
+		`$(grep NoNewPrivs /proc/self/status | tr -d '\t ')"`
+	ec := &ExecConfig{
+		ExecConfig: config.ExecConfig{
+			Command: []string{command},
+		},
+		// The hooks run as the child
+		Hooks:      &HooksConfig{PreStart: config.String(command)},
+		Umask:      config.String("027"),
+		WorkingDir: config.String("/"),
+		NoNewPrivs: config.Bool(true),
+	}
+	exp := fmt.Sprintf("%d %d 0027 / NoNewPrivs:1\n", os.Getuid(), os.Getgid())
+	if os.Getuid() == 0 {
+		// Ids without a user or group are used as is
+		ec.User = config.String("65534")
+		ec.Group = config.String("65534")
+		ec.Groups = []string{"65533"}
+		exp = "65534 65534 65533 0027 / NoNewPrivs:1\n"
+	}
+
+	cfg := DefaultConfig().Merge(&Config{Exec: ec})
+	cfg.Finalize()
+
+	r, err := NewRunner(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	out := gatedio.NewByteBuffer()
+	r.outStream = out
+
+	exitCh, err := r.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case code := <-exitCh:
+		if code != 0 {
+			t.Fatalf("child exited with %d: %s", code, out.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("child did not exit")
+	}
+
+	if act := out.String(); act != exp+exp {
+		t.Errorf("expected %q, got %q", exp+exp, act)
+	}
+}
+
+func TestRunner_limits(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("limits are only applied on linux")
+	}
+
+	// A directory stands in for the cgroup hierarchy
+	root := t.TempDir()
+	self := filepath.Join(t.TempDir(), "cgroup")
+	if err := ioutil.WriteFile(self, []byte("0::/envconsul.service\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "envconsul.service"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(r, s string) { cgroupRoot, procSelfCgroup = r, s }(cgroupRoot, procSelfCgroup)
+	cgroupRoot, procSelfCgroup = root, self
+
+	cfg := DefaultConfig().Merge(&Config{
+		Exec: &ExecConfig{
+			ExecConfig: config.ExecConfig{
+				Command: []string{`echo "$(ulimit -Sn) $(ulimit -Hn) $(ulimit -c)"`},
+			},
+			Limits: &LimitsConfig{
+				NoFile: config.String("256:512"),
+				Core:   config.String("0"),
+				Cgroup: &CgroupConfig{
+					Path:      config.String("app/web"),
+					MemoryMax: config.String("512M"),
+					PidsMax:   config.String("100"),
+				},
+			},
+		},
+	})
+	cfg.Finalize()
+
+	r, err := NewRunner(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	out := gatedio.NewByteBuffer()
+	r.outStream = out
+
+	exitCh, err := r.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := r.child.Pid()
+	select {
+	case code := <-exitCh:
+		if code != 0 {
+			t.Fatalf("child exited with %d: %s", code, out.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("child did not exit")
+	}
+
+	if act, exp := out.String(), "256 512 0\n"; act != exp {
+		t.Errorf("expected %q, got %q", exp, act)
+	}
+
+	files := map[string]string{
+		"envconsul.service/cgroup.subtree_control":     "+memory +pids",
+		"envconsul.service/app/cgroup.subtree_control": "+memory +pids",
+		"envconsul.service/app/web/memory.max":         "512M",
+		"envconsul.service/app/web/pids.max":           "100",
+		"envconsul.service/app/web/cgroup.procs":       strconv.Itoa(pid),
+	}
+	for file, exp := range files {
+		b, err := ioutil.ReadFile(filepath.Join(root, file))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if act := string(b); act != exp {
+			t.Errorf("%s: expected %q, got %q", file, exp, act)
+		}
+	}
+
+	// The hooks and the ready command only join the cgroup set up for the
+	// child
+	memoryMax := filepath.Join(root, "envconsul.service/app/web/memory.max")
+	if err := ioutil.WriteFile(memoryMax, []byte("1G"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	shim, err := r.commandShim()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := filepath.Join(root, "envconsul.service/app/web"); shim.Cgroup != exp {
+		t.Errorf("expected cgroup %q, got %q", exp, shim.Cgroup)
+	}
+	if b, _ := ioutil.ReadFile(memoryMax); string(b) != "1G" {
+		t.Errorf("expected the cgroup to be set up once, got memory.max %q", b)
+	}
+}
+
+func TestRunner_terminate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("process groups are not supported on windows")
+	}
+
+	cases := []struct {
+		name    string
+		command string
+		kill    bool
+		code    int
+	}{
+		{
+			// The background sleep gets the signal too, with the group
+			"exits",
+			`trap 'exit 3' TERM; sleep 30 & touch "$READY"; wait`,
+			false,
+			3,
+		},
+		{
+			"killed",
+			`trap '' TERM; touch "$READY"; sleep 30`,
+			true,
+			-1,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ready := filepath.Join(t.TempDir(), "ready")
+			cfg := DefaultConfig().Merge(&Config{
+				Exec: &ExecConfig{
+					ExecConfig: config.ExecConfig{
+						Command:    []string{tc.command},
+						Env:        &config.EnvConfig{Custom: []string{"READY=" + ready}},
+						KillSignal: config.Signal(syscall.SIGTERM),
+					},
+				},
+				Init: config.Bool(true),
+			})
+			cfg.Finalize()
+
+			r, err := NewRunner(cfg, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Stop()
+
+			exitCh, err := r.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; ; i++ {
+				if _, err := os.Stat(ready); err == nil {
+					break
+				}
+				if i == 500 {
+					t.Fatal("child did not start")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if !r.Terminate() {
+				t.Fatal("expected a child to wait for")
+			}
+			if tc.kill {
+				select {
+				case code := <-exitCh:
+					t.Fatalf("child ignoring the signal exited with %d", code)
+				case <-time.After(200 * time.Millisecond):
+				}
+				r.Kill()
+			}
+
+			select {
+			case code := <-exitCh:
+				if code != tc.code {
+					t.Errorf("expected exit code %d, got %d", tc.code, code)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("child did not exit")
+			}
+
+			// No new child is started once terminating
+			if exitCh, err := r.Run(); err != nil || exitCh != nil {
+				t.Errorf("expected no new child, got %v, %v", exitCh, err)
+			}
+		})
+	}
+}
+
+func TestRunner_output(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the command is a shell script")
+	}
+
+	path := filepath.Join(t.TempDir(), "stderr.log")
+	cfg := DefaultConfig().Merge(&Config{
+		Exec: &ExecConfig{
+			ExecConfig: config.ExecConfig{
+				// The last line of stdout has no newline
+				Command: []string{`printf 'one\ntwo'; printf 'a\nb\nc\n' >&2`},
+			},
+			Stdout: &OutputConfig{
+				Format: config.String(OutputFormatPrefix),
+				Tag:    config.String("web"),
+			},
+			Stderr: &OutputConfig{
+				Format:   config.String(OutputFormatJSON),
+				File:     config.String(path),
+				MaxSize:  config.String("20"),
+				MaxFiles: config.Int(1),
+			},
+		},
+	})
+	cfg.Finalize()
+
+	r, err := NewRunner(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	out := gatedio.NewByteBuffer()
+	r.outStream = out
+
+	exitCh, err := r.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case code := <-exitCh:
+		if code != 0 {
+			t.Fatalf("child exited with %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("child did not exit")
+	}
+
+	// The lines are written once read from the pipes
+	readLines := func(path string) []string {
+		b, _ := ioutil.ReadFile(path)
+		return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	}
+	for i := 0; strings.Count(out.String(), "\n") < 2 ||
+		!strings.Contains(readLines(path)[0], `"@message":"c"`); i++ {
+		if i == 500 {
+			t.Fatalf("output was not written: %q", out.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stdout := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	for i, exp := range []string{"one", "two"} {
+		if fields := strings.Fields(stdout[i]); len(fields) != 3 ||
+			fields[1] != "[web]" || fields[2] != exp {
+			t.Errorf("expected a prefixed %q, got %q", exp, stdout[i])
+		} else if _, err := time.Parse(outputTimeFormat, fields[0]); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Every line goes over the size, the first one is dropped with the
+	// rotation
+	files := map[string]string{path: "c", path + ".1": "b"}
+	for file, exp := range files {
+		lines := readLines(file)
+		if len(lines) != 1 {
+			t.Errorf("%s: expected a single line, got %q", file, lines)
+			continue
+		}
+		var line outputLine
+		if err := json.Unmarshal([]byte(lines[0]), &line); err != nil {
+			t.Error(err)
+			continue
+		}
+		if line.Message != exp || line.Stream != "stderr" || line.Tag != "stderr" {
+			t.Errorf("%s: expected %q from stderr, got %#v", file, exp, line)
+		}
+	}
+	if _, err := os.Stat(path + ".2"); !os.IsNotExist(err) {
+		t.Errorf("expected no more rotated files, got %v", err)
+	}
+}
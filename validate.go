@@ -0,0 +1,662 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/hashicorp/consul-template/config"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/hashicorp/hcl/hcl/token"
+)
+
+// deprecatedKeys maps the deprecated configuration keys, by their full dotted
+// path, to the configuration that replaces them.
+var deprecatedKeys = map[string]string{
+	"auth":               "consul { auth { ... } }",
+	"path":               "the -config CLI option",
+	"retry":              "consul { retry { ... } } and vault { retry { ... } }",
+	"splay":              "exec { splay = \"...\" }",
+	"ssl":                "consul { ssl { ... } } and vault { ssl { ... } }",
+	"timeout":            "exec { kill_timeout = \"...\" }",
+	"token":              "consul { token = \"...\" }",
+	"exec.env.blacklist": "exec { env { denylist = [...] } }",
+	"exec.env.whitelist": "exec { env { allowlist = [...] } }",
+}
+
+// validateIssue is a problem found in the configuration by the validate
+// command.
+type validateIssue struct {
+	// Error is true for issues that prevent envconsul from running, false for
+	// warnings.
+	Error bool
+
+	// Pos is the location of the issue, as "file:line:col", "file" or empty
+	// when the issue is about the merged configuration.
+	Pos string
+
+	Message string
+
+	// line and column are the position of the issue in the file, zero when
+	// unknown.
+	line, column int
+}
+
+func (i *validateIssue) String() string {
+	severity := "warning"
+	if i.Error {
+		severity = "error"
+	}
+	if i.Pos == "" {
+		return fmt.Sprintf("%s: %s", severity, i.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", severity, i.Pos, i.Message)
+}
+
+// validator collects the issues found while validating configurations.
+type validator struct {
+	issues []*validateIssue
+}
+
+func (v *validator) errorf(pos, format string, args ...interface{}) {
+	v.issues = append(v.issues, &validateIssue{
+		Error:   true,
+		Pos:     pos,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) warnf(pos, format string, args ...interface{}) {
+	v.issues = append(v.issues, &validateIssue{
+		Pos:     pos,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) hasErrors() bool {
+	for _, i := range v.issues {
+		if i.Error {
+			return true
+		}
+	}
+	return false
+}
+
+// validateConfigs checks the configuration files at the given paths, and the
+// configuration they result in once merged with the overrides, like
+// loadConfigs. It returns every issue found, in the order they were found.
+func validateConfigs(paths []string, o *Config) []*validateIssue {
+	var v validator
+
+	for _, path := range paths {
+		files, err := configFiles(path)
+		if err != nil {
+			v.errorf("", "%s", err)
+			continue
+		}
+		for _, file := range files {
+			v.validateFile(file)
+		}
+	}
+
+	// Files with unknown keys or syntax errors do not load, and the error was
+	// already reported with its position.
+	if v.hasErrors() {
+		return v.issues
+	}
+
+	c, err := loadConfigs(paths, o)
+	if err != nil {
+		v.errorf("", "%s", err)
+		return v.issues
+	}
+	v.validateConfig(c)
+
+	// Check the config of every profile, reporting only the issues that are
+	// not already in the config without it
+	seen := make(map[string]bool, len(v.issues))
+	for _, i := range v.issues {
+		seen[i.String()] = true
+	}
+
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		po := (&Config{}).Merge(o)
+		po.Profile = config.String(name)
+
+		pc, err := loadConfigs(paths, po)
+		if err != nil {
+			v.errorf("", "%s", err)
+			continue
+		}
+
+		var pv validator
+		pv.validateConfig(pc)
+		for _, i := range pv.issues {
+			if seen[i.String()] {
+				continue
+			}
+			i.Message = fmt.Sprintf("profile %q: %s", name, i.Message)
+			v.issues = append(v.issues, i)
+		}
+	}
+
+	return v.issues
+}
+
+// validateFile checks the keys used in a single configuration file.
+func (v *validator) validateFile(path string) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		v.errorf(path, "%s", err)
+		return
+	}
+
+	format, ok := formatFromPath(path)
+	if !ok {
+		format = FormatHCL
+	}
+
+	// YAML has no AST with positions, so issues are reported for the file as a
+	// whole.
+	root, withPos, err := parseAST(contents, format)
+	if err != nil {
+		if pe, ok := syntaxError(err).(*ParseError); ok {
+			pe.File = path
+			v.errorf(pe.pos(), "%s", pe.Err)
+			return
+		}
+		v.errorf(path, "%s", err)
+		return
+	}
+	if root == nil {
+		return
+	}
+
+	list, ok := root.Node.(*ast.ObjectList)
+	if !ok {
+		v.errorf(path, "error converting config")
+		return
+	}
+
+	w := &fileWalker{validator: v, path: path, withPos: withPos}
+	if format == FormatJSON {
+		w.positions = jsonKeyPositions(contents)
+	}
+	w.walk(list, reflect.TypeOf(Config{}), "", "")
+}
+
+// fileWalker walks the AST of a configuration file, checking the keys against
+// the mapstructure tags of the config structs they are decoded into.
+type fileWalker struct {
+	*validator
+	path    string
+	withPos bool
+
+	// positions are the positions of the keys by their indexed path, for
+	// formats without positions in the AST, see jsonKeyPositions.
+	positions map[string]token.Pos
+}
+
+// at returns the position of a key node, falling back to the position of
+// its indexed path.
+func (w *fileWalker) at(n ast.Node, key string) token.Pos {
+	if !w.withPos {
+		return token.Pos{}
+	}
+	if p := n.Pos(); p.IsValid() {
+		return p
+	}
+	return w.positions[key]
+}
+
+func (w *fileWalker) errorAt(n ast.Node, key, format string, args ...interface{}) {
+	w.issueAt(true, n, key, format, args...)
+}
+
+func (w *fileWalker) warnAt(n ast.Node, key, format string, args ...interface{}) {
+	w.issueAt(false, n, key, format, args...)
+}
+
+func (w *fileWalker) issueAt(isError bool, n ast.Node, key, format string, args ...interface{}) {
+	i := &validateIssue{
+		Error:   isError,
+		Pos:     w.path,
+		Message: fmt.Sprintf(format, args...),
+	}
+	if p := w.at(n, key); p.IsValid() {
+		i.Pos = fmt.Sprintf("%s:%d:%d", w.path, p.Line, p.Column)
+		i.line, i.column = p.Line, p.Column
+	}
+	w.issues = append(w.issues, i)
+}
+
+// walk checks the keys of a block. Parent is the dotted path of the block,
+// indexed is the same path with the index of every block, like
+// "prefix[1].key[0]", to find the positions of keys.
+func (w *fileWalker) walk(list *ast.ObjectList, t reflect.Type, parent, indexed string) {
+	keys := configKeys(t)
+	counts := make(map[string]int)
+
+	for _, item := range list.Items {
+		if len(item.Keys) == 0 {
+			continue
+		}
+		name, _ := item.Keys[0].Token.Value().(string)
+		path, key := name, name
+		if parent != "" {
+			path = parent + "." + name
+		}
+		if indexed != "" {
+			key = indexed + "." + name
+		}
+
+		if parent == "" && name == "profile" {
+			w.walkProfiles(item)
+			continue
+		}
+
+		if replacement, ok := deprecatedKeys[path]; ok {
+			w.warnAt(item.Keys[0], key, "%s is deprecated, use %s instead",
+				path, replacement)
+			continue
+		}
+
+		ft, ok := keys[strings.ToLower(name)]
+		if !ok {
+			msg := fmt.Sprintf("unknown key %q", name)
+			if parent != "" {
+				msg += " in " + parent
+			}
+			if s := suggestKey(name, keys); s != "" {
+				msg += fmt.Sprintf(", did you mean %q?", s)
+			}
+			w.errorAt(item.Keys[0], key, "%s", msg)
+			continue
+		}
+
+		// Labeled blocks like `prefix "foo" {}`, and objects of objects in
+		// JSON, nest the other keys as blocks.
+		if len(item.Keys) > 1 {
+			nested := &ast.ObjectItem{Keys: item.Keys[1:], Val: item.Val}
+			if configKeys(ft) != nil {
+				w.walk(&ast.ObjectList{Items: []*ast.ObjectItem{nested}}, ft, path, key+"[0]")
+			} else {
+				label, _ := item.Keys[1].Token.Value().(string)
+				w.errorAt(item.Keys[1], key, "unknown key %q in %s", label, path)
+			}
+			continue
+		}
+
+		for _, obj := range objectValues(item.Val) {
+			blockKey := fmt.Sprintf("%s[%d]", key, counts[name])
+			counts[name]++
+
+			if parent == "" && (name == "prefix" || name == "secret") {
+				w.checkPath(item, obj, name, key)
+			}
+			if configKeys(ft) != nil {
+				w.walk(obj.List, ft, path, blockKey)
+			}
+		}
+	}
+}
+
+// walkProfiles checks the bodies of profile blocks like top-level configs.
+// Profiles are either labeled blocks, `profile "name" {}`, or a block of
+// named blocks like in JSON.
+func (w *fileWalker) walkProfiles(item *ast.ObjectItem) {
+	t := reflect.TypeOf(Config{})
+
+	if len(item.Keys) > 1 {
+		label, _ := item.Keys[1].Token.Value().(string)
+		for _, obj := range objectValues(item.Val) {
+			w.walk(obj.List, t, "", "profile[0]."+label+"[0]")
+		}
+		return
+	}
+
+	for _, obj := range objectValues(item.Val) {
+		for _, p := range obj.List.Items {
+			if len(p.Keys) == 0 {
+				continue
+			}
+			label, _ := p.Keys[0].Token.Value().(string)
+			for _, body := range objectValues(p.Val) {
+				w.walk(body.List, t, "", "profile[0]."+label+"[0]")
+			}
+		}
+	}
+}
+
+// checkPath warns about prefix and secret blocks without a path, which
+// PrefixConfigs.Finalize ignores.
+func (w *fileWalker) checkPath(item *ast.ObjectItem, obj *ast.ObjectType, name, key string) {
+	for _, i := range obj.List.Items {
+		if len(i.Keys) == 0 {
+			continue
+		}
+		if k, _ := i.Keys[0].Token.Value().(string); k != "path" {
+			continue
+		}
+		if lit, ok := i.Val.(*ast.LiteralType); ok {
+			if s, _ := lit.Token.Value().(string); s == "" {
+				break
+			}
+		}
+		return
+	}
+	w.warnAt(item.Keys[0], key, "%s block without a path is ignored", name)
+}
+
+// objectValues returns the blocks of an item value, which is either a single
+// block or, in JSON, a list of them.
+func objectValues(n ast.Node) []*ast.ObjectType {
+	switch n := n.(type) {
+	case *ast.ObjectType:
+		return []*ast.ObjectType{n}
+	case *ast.ListType:
+		var r []*ast.ObjectType
+		for _, e := range n.List {
+			if obj, ok := e.(*ast.ObjectType); ok {
+				r = append(r, obj)
+			}
+		}
+		return r
+	}
+	return nil
+}
+
+// configKeys returns the keys accepted in a block decoded into the given type,
+// mapped to the type of their value. It returns nil if the type is not a
+// struct.
+func configKeys(t reflect.Type) map[string]reflect.Type {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	keys := make(map[string]reflect.Type, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if squashed(t.Field(i)) {
+			for key, ft := range configKeys(t.Field(i).Type) {
+				keys[key] = ft
+			}
+			continue
+		}
+		if key := configKey(t.Field(i)); key != "" {
+			keys[key] = t.Field(i).Type
+		}
+	}
+	return keys
+}
+
+// configKey returns the key a struct field is decoded from by mapstructure, or
+// the empty string if the field is not decoded. Fields without a tag use their
+// name; keys are matched case-insensitively, so the key is lower-cased.
+func configKey(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		return ""
+	}
+	tag := strings.Split(f.Tag.Get("mapstructure"), ",")[0]
+	switch tag {
+	case "-":
+		return ""
+	case "":
+		return strings.ToLower(f.Name)
+	}
+	return strings.ToLower(tag)
+}
+
+// squashed reports whether f is an embedded struct whose fields mapstructure
+// decodes as fields of the parent, like the consul-template part of
+// ExecConfig.
+func squashed(f reflect.StructField) bool {
+	if !f.Anonymous {
+		return false
+	}
+	for _, opt := range strings.Split(f.Tag.Get("mapstructure"), ",")[1:] {
+		if opt == "squash" {
+			return true
+		}
+	}
+	return false
+}
+
+// validateConfig checks the merged and finalized configuration.
+func (v *validator) validateConfig(c *Config) {
+	if f := strings.ToLower(config.StringVal(c.LogFormat)); f != "text" && f != "json" {
+		v.errorf("", "invalid log format %q, expected text or json", f)
+	}
+	if config.BoolVal(c.Audit.Enabled) && !config.StringPresent(c.Audit.Path) {
+		v.errorf("", "audit is enabled but has no path")
+	}
+
+	for _, l := range *c.Listeners {
+		switch n := config.StringVal(l.Network); n {
+		case "tcp", "tcp4", "tcp6", "unix":
+		default:
+			v.errorf("", "invalid listen network %q, expected tcp, tcp4, tcp6 or unix", n)
+		}
+		if !config.StringPresent(l.Address) {
+			v.errorf("", "listen requires an address")
+		}
+		if name := config.StringVal(l.Name); strings.Contains(name, ":") {
+			v.errorf("", "invalid listen name %q, names cannot contain \":\"", name)
+		}
+	}
+
+	if config.StringPresent(c.Exec.Umask) {
+		if _, err := parseUmask(config.StringVal(c.Exec.Umask)); err != nil {
+			v.errorf("", "%s", err)
+		}
+	}
+	if config.BoolVal(c.Exec.NoNewPrivs) && runtime.GOOS != "linux" {
+		v.warnf("", "exec no_new_privs is only supported on linux, it is ignored")
+	}
+	if limits := c.Exec.Limits; !limits.Empty() {
+		if _, err := parseRlimits(limits); err != nil {
+			v.errorf("", "%s", err)
+		}
+		if p := config.StringVal(limits.Cgroup.Path); strings.HasPrefix(path.Clean(p), "..") {
+			v.errorf("", "exec limits cgroup path %q is not below the cgroup of envconsul", p)
+		}
+	}
+	for _, o := range []struct {
+		stream string
+		c      *OutputConfig
+	}{{"stdout", c.Exec.Stdout}, {"stderr", c.Exec.Stderr}} {
+		switch f := config.StringVal(o.c.Format); f {
+		case OutputFormatRaw, OutputFormatPrefix, OutputFormatJSON:
+		default:
+			v.errorf("", "invalid exec %s format %q, expected raw, prefix or json", o.stream, f)
+		}
+		if config.StringPresent(o.c.MaxSize) {
+			if _, err := parseSize(config.StringVal(o.c.MaxSize)); err != nil {
+				v.errorf("", "exec %s max_size: %s", o.stream, err)
+			}
+		}
+		if config.IntVal(o.c.MaxFiles) < 0 {
+			v.errorf("", "exec %s max_files cannot be negative", o.stream)
+		}
+	}
+	// The users and groups may only exist where envconsul runs
+	ec := c.Exec
+	if config.StringPresent(ec.User) || config.StringPresent(ec.Group) || len(ec.Groups) > 0 {
+		if _, err := lookupCredential(config.StringVal(ec.User),
+			config.StringVal(ec.Group), ec.Groups); err != nil {
+			v.warnf("", "%s", err)
+		}
+	}
+
+	switch s := config.StringVal(c.Exec.ReplaceStrategy); s {
+	case ReplaceStopFirst:
+	case ReplaceStartFirst:
+		ready := c.Exec.Ready
+		if ready.Empty() {
+			v.warnf("", "exec replace_strategy %q has no ready check, the new child "+
+				"is considered ready as soon as it starts", s)
+		}
+
+		// Both children accept connections on a shared socket, so the tcp and
+		// http checks may be answered by the current child
+		if config.StringPresent(ready.TCP) || config.StringPresent(ready.HTTP) {
+			perChild := config.StringPresent(ready.Command) || config.StringPresent(ready.File)
+			switch {
+			case len(*c.Listeners) > 0:
+				v.errorf("", "exec ready tcp and http checks cannot tell the children apart "+
+					"on a listen socket with replace_strategy %q, use a command or file check", s)
+			case !perChild:
+				v.warnf("", "exec ready tcp and http checks may be answered by the current "+
+					"child if both bind with SO_REUSEPORT, add a command or file check")
+			}
+		}
+	default:
+		v.errorf("", "invalid exec replace_strategy %q, expected %s or %s",
+			s, ReplaceStopFirst, ReplaceStartFirst)
+	}
+
+	for _, kind := range []string{"prefix", "secret"} {
+		prefixes := c.Prefixes
+		if kind == "secret" {
+			prefixes = c.Secrets
+		}
+		for _, p := range *prefixes {
+			v.validatePrefix(kind, p)
+		}
+	}
+
+	for _, m := range *c.Meta {
+		source := config.StringVal(m.ConsulKey)
+		if source == "" {
+			source = config.StringVal(m.VaultSecret)
+		}
+		v.validateTemplate(config.StringVal(m.Format), formatTemplateFuncs("", ""),
+			"format of meta %q", source)
+	}
+
+	for _, s := range *c.Services {
+		name := config.StringVal(s.Query)
+		formats := []struct {
+			field  string
+			format *string
+		}{
+			{"format_id", s.FormatId},
+			{"format_name", s.FormatName},
+			{"format_address", s.FormatAddress},
+			{"format_tag", s.FormatTag},
+			{"format_port", s.FormatPort},
+		}
+		for _, f := range formats {
+			v.validateTemplate(config.StringVal(f.format), serviceTemplateFuncs("", ""),
+				"%s of service %q", f.field, name)
+		}
+	}
+
+	env := c.Exec.Env
+	allowlist := combineLists(env.Allowlist, env.AllowlistDeprecated)
+	denylist := combineLists(env.Denylist, env.DenylistDeprecated)
+	for _, p := range append(append([]string{}, allowlist...), denylist...) {
+		if _, err := filepath.Match(p, ""); err != nil {
+			v.errorf("", "invalid exec env pattern %q: %s", p, err)
+		}
+	}
+	for _, allow := range allowlist {
+		for _, deny := range denylist {
+			if globShadows(deny, allow, filepath.Match) {
+				v.warnf("", "exec env allowlist pattern %q is always removed by "+
+					"denylist pattern %q", allow, deny)
+			}
+		}
+	}
+
+	usesVault := len(*c.Secrets) > 0
+	for _, m := range *c.Meta {
+		if config.StringPresent(m.VaultSecret) {
+			usesVault = true
+		}
+	}
+	// A Vault agent proxy adds the token itself, so this is not an error
+	if usesVault && !config.StringPresent(c.Vault.Token) &&
+		!config.StringPresent(c.Vault.VaultAgentTokenFile) &&
+		!config.StringPresent(c.Vault.K8SAuthRoleName) {
+		v.warnf("", "secrets are read from Vault but there is no Vault token: "+
+			"set vault { token }, VAULT_TOKEN, ~/.vault-token, "+
+			"vault_agent_token_file or k8s_auth_role_name, unless a Vault "+
+			"agent proxy adds it")
+	}
+}
+
+func (v *validator) validatePrefix(kind string, p *PrefixConfig) {
+	path := config.StringVal(p.Path)
+
+	v.validateTemplate(config.StringVal(p.Format), formatTemplateFuncs("", ""),
+		"format of %s %q", kind, path)
+	if p.Keys != nil {
+		for _, k := range *p.Keys {
+			v.validateTemplate(config.StringVal(k.Format), formatTemplateFuncs("", ""),
+				"format of key %q in %s %q", config.StringVal(k.Name), kind, path)
+		}
+	}
+
+	if _, err := newKeyRules(p); err != nil {
+		v.errorf("", "%s %q: %s", kind, path, err)
+		return
+	}
+	for _, include := range p.Include {
+		for _, exclude := range p.Exclude {
+			if globShadows(exclude, include, keyPatternMatch) {
+				v.warnf("", "%s %q: include pattern %q is always removed by "+
+					"exclude pattern %q", kind, path, include, exclude)
+			}
+		}
+	}
+}
+
+// validateTemplate reports the format template if it does not parse. Such
+// templates are silently ignored at runtime.
+func (v *validator) validateTemplate(contents string, funcs template.FuncMap,
+	format string, args ...interface{}) {
+	if contents == "" {
+		return
+	}
+	if _, err := template.New("filter").Funcs(funcs).Parse(contents); err != nil {
+		v.errorf("", "invalid %s: %s", fmt.Sprintf(format, args...), err)
+	}
+}
+
+// globShadows reports whether the pattern a matches everything the pattern b
+// matches. Only identical patterns and literal patterns matched by a are
+// detected.
+func globShadows(a, b string, match func(pattern, name string) (bool, error)) bool {
+	if a == b {
+		return true
+	}
+	if strings.ContainsAny(b, `*?[\`) || strings.HasPrefix(b, "/") {
+		return false
+	}
+	matched, _ := match(a, b)
+	return matched
+}
+
+// keyPatternMatch matches a key against an include or exclude pattern.
+func keyPatternMatch(pattern, key string) (bool, error) {
+	m, err := newKeyMatcher(pattern)
+	if err != nil {
+		return false, err
+	}
+	return m.match(key), nil
+}